@@ -5,8 +5,13 @@
 package oauth2
 
 import (
+	"errors"
+	"fmt"
+	"log"
 	"net/http"
 	"net/url"
+	"strings"
+	"time"
 
 	"github.com/hooklift/oauth2/internal/render"
 	"github.com/hooklift/oauth2/types"
@@ -21,6 +26,14 @@ var AuthzHandlers map[string]func(http.ResponseWriter, *http.Request, config) =
 
 // AuthzData defines properties used to render the authorization form view
 // that asks for authorization to the resource owner when using the web flow.
+//
+// The form is expected to be posted back along with the resource owner's
+// decision: a "decision" field set to "approve" grants access, any other value
+// denies it. Resource owners may also approve only part of the requested scopes
+// by sending one or more "approved_scope" fields, usually checkboxes. Forms
+// letting them do so must also send a "scope_selection" field set to "1", so
+// unchecking every scope denies the request. Forms without it approve every
+// requested scope.
 type AuthzData struct {
 	// Client information.
 	Client types.Client
@@ -28,27 +41,41 @@ type AuthzData struct {
 	Scopes types.Scopes
 	// List of errors to display to the resource owner.
 	Errors []types.AuthzError
-	// Grant type is either "code" or "token" for implicit authorizations.
+	// Requested response type, such as "code", "token" for implicit
+	// authorizations or any of the OpenID Connect combinations with "id_token".
+	// Multiple values are sorted alphabetically.
 	GrantType string
 	// State can be used to store CSRF tokens by the 3rd-party client app
 	State string
+	// CSRF token protecting the authorization form, it must be posted back
+	// in a "csrf_token" field.
+	CSRFToken string
+	// Hint about the login identifier the resource owner might use, as sent
+	// by the client in the "login_hint" parameter.
+	LoginHint string
+	// Authentication context class references requested by the client, in
+	// order of preference.
+	ACRValues []string
+
+	// PKCE code challenge to bind to the authorization code.
+	codeChallenge       string
+	codeChallengeMethod string
+	// Response mode used to deliver the authorization response to the client.
+	responseMode string
+	// OpenID Connect nonce to include in ID tokens.
+	nonce string
+	// OpenID Connect prompt and maximum authentication age requested.
+	prompt    string
+	maxAge    time.Duration
+	maxAgeSet bool
 }
 
 // CreateGrant generates the authorization code for 3rd-party clients to use
 // in order to get access and refresh tokens, asking the resource owner for authorization.
 func CreateGrant(w http.ResponseWriter, req *http.Request, cfg config) {
-	provider := cfg.provider
-	if yes := provider.IsUserAuthenticated(); !yes {
-		u := cfg.loginURL.url
-		query := u.Query()
-		query.Set(cfg.loginURL.redirectParam, req.URL.String())
-		u.RawQuery = query.Encode()
-
-		http.Redirect(w, req, u.String(), http.StatusFound)
-		return
-	}
-
-	vars := []string{"client_id", "state", "redirect_uri", "scope", "response_type"}
+	vars := []string{"client_id", "state", "redirect_uri", "scope", "response_type", "prompt",
+		"code_challenge", "code_challenge_method", "response_mode", "nonce", "max_age",
+		"login_hint", "acr_values"}
 	params := make(map[string]string)
 	for _, v := range vars {
 		// FormValue also parses query string if method is GET
@@ -61,10 +88,88 @@ func CreateGrant(w http.ResponseWriter, req *http.Request, cfg config) {
 		return
 	}
 
+	session, err := userSession(req, cfg)
+	if err != nil {
+		redirectErr(w, req, cfg, authzData.Client, authzData.responseMode, ErrServerError(authzData.State, err))
+		return
+	}
+
+	if loginRequest(req, cfg) {
+		login(w, req, cfg, authzData, params)
+		return
+	}
+
+	if authTimeUnknown(authenticated(cfg, session), session, authzData) {
+		e := ErrLoginRequired(authzData.State)
+		e.Description = "The time the resource owner authenticated is unknown, max_age can't be honored."
+		redirectErr(w, req, cfg, authzData.Client, authzData.responseMode, e)
+		return
+	}
+
+	if authenticationRequired(authenticated(cfg, session), session, authzData) {
+		if hasPrompt(authzData.prompt, "none") {
+			redirectErr(w, req, cfg, authzData.Client, authzData.responseMode, ErrLoginRequired(authzData.State))
+			return
+		}
+
+		if builtinLogin(cfg) {
+			renderLogin(w, req, cfg, authzData, params)
+			return
+		}
+
+		loginRedirect(w, req, cfg, authzData, params)
+		return
+	}
+
+	if acr, maxAge, required := stepUpRequired(cfg, session, authzData.Scopes); required {
+		if hasPrompt(authzData.prompt, "none") {
+			redirectErr(w, req, cfg, authzData.Client, authzData.responseMode, ErrLoginRequired(authzData.State))
+			return
+		}
+
+		stepUp(w, req, cfg, authzData, params, session, acr, maxAge)
+		return
+	}
+
 	if req.Method == "GET" {
+		// Skips the authorization form if the client is trusted or if the
+		// resource owner already approved the requested scopes.
+		approved, err := consented(req, cfg, authzData, authzData.prompt)
+		if err != nil {
+			log.Printf("[ERROR] Error looking up resource owner's consent: %v", err)
+		}
+
+		if approved {
+			authzResponse(w, req, cfg, authzData, authzData.Scopes)
+			return
+		}
+
+		// The authorization form can't be displayed to the resource owner.
+		// -- http://openid.net/specs/openid-connect-core-1_0.html#AuthError
+		if hasPrompt(authzData.prompt, "none") {
+			e := ErrInteractionRequired(authzData.State)
+			if cfg.consent.store != nil {
+				e = ErrConsentRequired(authzData.State)
+			}
+			redirectErr(w, req, cfg, authzData.Client, authzData.responseMode, e)
+			return
+		}
+
+		authzData.CSRFToken, err = csrfToken(w, req, cfg, params)
+		if err != nil {
+			render.HTML(w, render.Options{
+				Status: http.StatusOK,
+				Data: AuthzData{
+					Errors: []types.AuthzError{
+						ErrServerError("", err),
+					}},
+				Template: cfg.authzForm,
+			})
+			return
+		}
+
 		// Displays authorization form to resource owner in order for her to
 		// authorize 3rd-party client app.
-		// TODO(c4milo): Figure out how to generate a CSRF token not tied to user's session
 		render.HTML(w, render.Options{
 			Status:    http.StatusOK,
 			Data:      authzData,
@@ -74,9 +179,99 @@ func CreateGrant(w http.ResponseWriter, req *http.Request, cfg config) {
 		return
 	}
 
-	if params["response_type"] == "token" {
-		// Continue with implicit grant flow
-		implicitGrant(w, req, cfg, authzData)
+	if !verifyCSRFToken(req, cfg, params) {
+		render.HTML(w, render.Options{
+			Status: http.StatusForbidden,
+			Data: AuthzData{
+				Errors: []types.AuthzError{
+					ErrInvalidCSRFToken,
+				}},
+			Template:  cfg.authzForm,
+			STSMaxAge: cfg.stsMaxAge,
+		})
+		return
+	}
+
+	// The resource owner has to explicitly approve the request, anything else
+	// is taken as a denial.
+	if req.PostFormValue("decision") != "approve" {
+		redirectErr(w, req, cfg, authzData.Client, authzData.responseMode, ErrAccessDenied(authzData.State))
+		return
+	}
+
+	requested := authzData.Scopes
+	approved, err := approvedScopes(req, cfg, requested)
+	if err == errNoScopeApproved {
+		redirectErr(w, req, cfg, authzData.Client, authzData.responseMode, ErrAccessDenied(authzData.State))
+		return
+	}
+
+	if err != nil {
+		e := ErrInvalidScope
+		e.Description = err.Error()
+		e.State = authzData.State
+		redirectErr(w, req, cfg, authzData.Client, authzData.responseMode, e)
+		return
+	}
+	authzData.Scopes = approved
+
+	if err := saveConsent(req, cfg, authzData.Client, approved); err != nil {
+		log.Printf("[ERROR] Error saving resource owner's consent: %v", err)
+	}
+
+	authzResponse(w, req, cfg, authzData, requested)
+}
+
+// errNoScopeApproved is returned by approvedScopes when the resource owner
+// unselected every requested scope.
+var errNoScopeApproved = errors.New("no scope was approved")
+
+// approvedScopes returns the subset of the requested scopes approved by the
+// resource owner through the approved_scope form fields. If the form does not
+// support selecting scopes, every requested scope is considered approved.
+func approvedScopes(req *http.Request, cfg config, requested types.Scopes) (types.Scopes, error) {
+	var ids []string
+	for _, v := range req.PostForm["approved_scope"] {
+		ids = append(ids, strings.Fields(v)...)
+	}
+
+	if len(ids) == 0 {
+		if req.PostFormValue("scope_selection") != "" {
+			return nil, errNoScopeApproved
+		}
+		return requested, nil
+	}
+
+	var approved types.Scopes
+	for _, id := range ids {
+		scope := types.Scope{ID: id}
+		for _, r := range requested {
+			if r.ID == id {
+				scope = r
+				break
+			}
+		}
+
+		if !cfg.scopeMatcher.Covers(requested, types.Scopes{scope}) {
+			return nil, fmt.Errorf("scope %q was not requested by the client", id)
+		}
+		approved = append(approved, scope)
+	}
+	return approved, nil
+}
+
+// authzResponse issues an authorization code, an access token for implicit
+// authorizations, an ID token or any combination of them, depending on the
+// response type, with the scopes approved by the resource owner.
+func authzResponse(w http.ResponseWriter, req *http.Request, cfg config, authzData *AuthzData, requested types.Scopes) {
+	responseType := authzData.GrantType
+	params := url.Values{
+		"state": {authzData.State},
+	}
+
+	session, err := userSession(req, cfg)
+	if err != nil {
+		redirectErr(w, req, cfg, authzData.Client, authzData.responseMode, ErrServerError(authzData.State, err))
 		return
 	}
 
@@ -87,27 +282,65 @@ func CreateGrant(w http.ResponseWriter, req *http.Request, cfg config) {
 	// redirection URI using the "application/x-www-form-urlencoded" format,
 	// per Appendix B:
 	// http://tools.ietf.org/html/rfc6749#section-4.2.1
-	grant, err := provider.GenGrant(authzData.Client, authzData.Scopes, cfg.authzExpiration)
-	if err != nil {
-		render.HTML(w, render.Options{
-			Status: http.StatusOK,
-			Data: AuthzData{
-				Errors: []types.AuthzError{
-					ErrServerError("", err),
-				}},
-			Template: cfg.authzForm,
-		})
-		return
+	var code string
+	if hasResponseType(responseType, "code") {
+		grant, err := genGrant(cfg, types.Grant{
+			Scopes:              authzData.Scopes,
+			RequestedScopes:     requested,
+			CodeChallenge:       authzData.codeChallenge,
+			CodeChallengeMethod: authzData.codeChallengeMethod,
+			Subject:             session.Subject,
+			Nonce:               authzData.nonce,
+			AuthTime:            session.AuthTime,
+			ACR:                 session.ACR,
+		}, authzData.Client, authzExpiration(cfg, authzData.Client))
+		if err != nil {
+			render.HTML(w, render.Options{
+				Status: http.StatusOK,
+				Data: AuthzData{
+					Errors: []types.AuthzError{
+						ErrServerError("", err),
+					}},
+				Template: cfg.authzForm,
+			})
+			return
+		}
+		code = grant.Code
+		params.Set("code", code)
+	}
+
+	// Implements http://tools.ietf.org/html/rfc6749#section-4.2
+	var accessToken string
+	if hasResponseType(responseType, "token") {
+		noAuthzGrant := types.Grant{
+			Scopes:   authzData.Scopes,
+			Subject:  session.Subject,
+			AuthTime: session.AuthTime,
+			ACR:      session.ACR,
+		}
+
+		token, err := genToken(cfg, noAuthzGrant, authzData.Client, false, tokenExpiration(cfg, authzData.Client))
+		if err != nil {
+			redirectErr(w, req, cfg, authzData.Client, authzData.responseMode, ErrServerError(authzData.State, err))
+			return
+		}
+		accessToken = token.Value
+		params.Set("access_token", token.Value)
+		params.Set("token_type", token.Type)
+		params.Set("expires_in", token.ExpiresIn)
+		params.Set("scope", token.Scopes.Encode())
 	}
 
-	u := authzData.Client.RedirectURL
-	query := u.Query()
-	query.Set("code", grant.Code)
-	query.Set("state", authzData.State)
-	u.RawQuery = query.Encode()
+	if hasResponseType(responseType, "id_token") {
+		token, err := idToken(cfg, authzData.Client, session, authzData.nonce, code, accessToken)
+		if err != nil {
+			redirectErr(w, req, cfg, authzData.Client, authzData.responseMode, ErrServerError(authzData.State, err))
+			return
+		}
+		params.Set("id_token", token)
+	}
 
-	// log.Printf("[DEBUG] Redirect to: %s", u.String())
-	http.Redirect(w, req, u.String(), http.StatusFound)
+	respond(w, req, cfg, authzData.Client, authzData.responseMode, params)
 }
 
 // AuthCodeGrant1 implements http://tools.ietf.org/html/rfc6749#section-4.1.1 and
@@ -145,7 +378,7 @@ func authCodeGrant1(w http.ResponseWriter, req *http.Request, cfg config, params
 		return nil
 	}
 
-	if cinfo == (types.Client{}) {
+	if cinfo.ID == "" {
 		render.HTML(w, render.Options{
 			Status: http.StatusOK,
 			Data: AuthzData{
@@ -163,7 +396,7 @@ func authCodeGrant1(w http.ResponseWriter, req *http.Request, cfg config, params
 	// owner of the error and MUST NOT automatically redirect the user-agent to the
 	// invalid redirection URI.
 	var redirectURL *url.URL
-	if u, ok := params["redirect_uri"]; ok {
+	if u := params["redirect_uri"]; u != "" {
 		var err error
 		redirectURL, err = url.Parse(u)
 		if err != nil {
@@ -181,7 +414,8 @@ func authCodeGrant1(w http.ResponseWriter, req *http.Request, cfg config, params
 			return nil
 		}
 	} else {
-		redirectURL = cinfo.RedirectURL
+		u := *cinfo.RedirectURL
+		redirectURL = &u
 	}
 
 	if redirectURL.Scheme != "https" {
@@ -213,73 +447,116 @@ func authCodeGrant1(w http.ResponseWriter, req *http.Request, cfg config, params
 		return nil
 	}
 
+	// Errors found before the response type is validated are delivered using
+	// the default response mode, as the requested one may not be valid.
+	grantType := normalizeResponseType(params["response_type"])
+	mode := responseMode(grantType, "")
+
 	// An opaque value used by the client to maintain state between the request
 	// and callback.  The authorization server includes this value when redirecting
 	// the user-agent back to the client.  The parameter SHOULD be used for preventing
 	// cross-site request forgery as described in Section 10.12.
 	state := params["state"]
 	if state == "" {
-		EncodeErrInURI(redirectURL, ErrStateRequired(state))
-		http.Redirect(w, req, redirectURL.String(), http.StatusFound)
+		redirectErr(w, req, cfg, cinfo, mode, ErrStateRequired(state))
 		return nil
 	}
 
 	// response_type
-	// Value MUST be set to "code" or "token" for implicit authorizations.
-	grantType := params["response_type"]
-	if grantType != "code" && grantType != "token" {
-		EncodeErrInURI(redirectURL, ErrUnsupportedResponseType(state))
-		http.Redirect(w, req, redirectURL.String(), http.StatusFound)
+	// Value MUST be set to "code" or "token" for implicit authorizations. OpenID
+	// Connect clients may also combine them with "id_token".
+	if !supportedResponseType(cfg, grantType) {
+		redirectErr(w, req, cfg, cinfo, mode, ErrUnsupportedResponseType(state))
 		return nil
 	}
 
+	if !allowedResponseType(cinfo, grantType) {
+		redirectErr(w, req, cfg, cinfo, mode, ErrUnauthorizedResponseType(state))
+		return nil
+	}
+
+	if !validResponseMode(cfg, grantType, params["response_mode"]) {
+		redirectErr(w, req, cfg, cinfo, mode, ErrUnsupportedResponseMode(state))
+		return nil
+	}
+	mode = responseMode(grantType, params["response_mode"])
+
 	// The scope of the access request as described by Section 3.3.
 	scope := params["scope"]
 	if scope == "" {
-		EncodeErrInURI(redirectURL, ErrScopeRequired(state))
-		http.Redirect(w, req, redirectURL.String(), http.StatusFound)
+		scope = cinfo.DefaultScopes.Encode()
+	}
+
+	if scope == "" {
+		redirectErr(w, req, cfg, cinfo, mode, ErrScopeRequired(state))
+		return nil
+	}
+
+	if _, err := cfg.scopeMatcher.Parse(scope); err != nil {
+		e := ErrInvalidScope
+		e.Description = err.Error()
+		e.State = state
+		redirectErr(w, req, cfg, cinfo, mode, e)
 		return nil
 	}
 
 	scopes, err := provider.ScopesInfo(scope)
 	if err != nil {
-		EncodeErrInURI(redirectURL, ErrServerError(state, err))
-		http.Redirect(w, req, redirectURL.String(), http.StatusFound)
+		redirectErr(w, req, cfg, cinfo, mode, ErrServerError(state, err))
 		return nil
 	}
 
-	return &AuthzData{
-		Client:    cinfo,
-		Scopes:    scopes,
-		GrantType: grantType,
-		State:     state,
+	if !scopesAllowed(cfg, cinfo, scopes) {
+		e := ErrScopeNotAllowed
+		e.State = state
+		redirectErr(w, req, cfg, cinfo, mode, e)
+		return nil
 	}
-}
 
-// ImplicitGrant implements http://tools.ietf.org/html/rfc6749#section-4.2
-func implicitGrant(w http.ResponseWriter, req *http.Request, cfg config, authzData *AuthzData) {
-	provider := cfg.provider
-	u := authzData.Client.RedirectURL
+	nonce := params["nonce"]
+	if nonce == "" && nonceRequired(grantType) {
+		redirectErr(w, req, cfg, cinfo, mode, ErrNonceRequired(state))
+		return nil
+	}
 
-	noAuthzGrant := types.Grant{
-		Scopes: authzData.Scopes,
+	prompt := params["prompt"]
+	if !validPrompt(prompt) {
+		redirectErr(w, req, cfg, cinfo, mode, ErrInvalidPrompt(state))
+		return nil
 	}
 
-	token, err := provider.GenToken(noAuthzGrant, authzData.Client, false, cfg.tokenExpiration)
+	maxAge, maxAgeSet, err := parseMaxAge(params["max_age"])
 	if err != nil {
-		EncodeErrInURI(u, ErrServerError(authzData.State, err))
-		http.Redirect(w, req, u.String(), http.StatusFound)
-		return
+		redirectErr(w, req, cfg, cinfo, mode, ErrInvalidMaxAge(state))
+		return nil
 	}
 
-	query := url.Values{
-		"access_token": {token.Value},
-		"token_type":   {token.Type},
-		"expires_in":   {token.ExpiresIn},
-		"scope":        {token.Scopes.Encode()},
-		"state":        {authzData.State},
+	// Binds the authorization code to the client instance that requested it.
+	// -- https://tools.ietf.org/html/rfc7636#section-4.4
+	var challenge, method string
+	if hasResponseType(grantType, "code") {
+		var e *types.AuthzError
+		challenge = params["code_challenge"]
+		method, e = codeChallenge(cfg, cinfo, challenge, params["code_challenge_method"], state)
+		if e != nil {
+			redirectErr(w, req, cfg, cinfo, mode, *e)
+			return nil
+		}
 	}
 
-	u.Fragment = "#" + query.Encode()
-	http.Redirect(w, req, u.String(), http.StatusFound)
+	return &AuthzData{
+		Client:              cinfo,
+		Scopes:              scopes,
+		GrantType:           grantType,
+		State:               state,
+		codeChallenge:       challenge,
+		codeChallengeMethod: method,
+		LoginHint:           params["login_hint"],
+		ACRValues:           strings.Fields(params["acr_values"]),
+		responseMode:        mode,
+		nonce:               nonce,
+		prompt:              prompt,
+		maxAge:              maxAge,
+		maxAgeSet:           maxAgeSet,
+	}
 }
@@ -10,6 +10,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"regexp"
 	"strings"
 	"testing"
 	"time"
@@ -38,38 +39,87 @@ func setupTest() config {
 					<figure><img src="{{.Client.LogoURL}}"/></figure>
 				</a>
 			</div>
+			<form method="post">
 			<div id="scopes">
 				<ul>
 					{{range .Scopes}}
-						<li>{{.ID}}: {{.Description}}</li>
+						<li>
+							<input type="checkbox" name="approved_scope" value="{{.ID}}" checked/>
+							{{.ID}}: {{.Description}}
+						</li>
 					{{end}}
 				</ul>
 			</div>
-			<form>
+			 <input type="hidden" name="scope_selection" value="1"/>
 			 <input type="hidden" name="client_id" value="{{.Client.ID}}"/>
 			 <input type="hidden" name="response_type" value="{{.GrantType}}"/>
 			 <input type="hidden" name="redirect_uri" value="{{.Client.RedirectURL}}"/>
 			 <input type="hidden" name="scope" value="{{.Scopes.Encode}}"/>
 			 <input type="hidden" name="state" value="{{.State}}"/>
+			 <input type="hidden" name="csrf_token" value="{{.CSRFToken}}"/>
+			 <button type="submit" name="decision" value="approve">Approve</button>
+			 <button type="submit" name="decision" value="deny">Deny</button>
 			</form>
 		{{end}}
 		</body>
 	</html>
 	`
 	cfg := config{
-		tokenEndpoint:   "/oauth2/tokens",
-		authzEndpoint:   "/oauth2/authzs",
-		stsMaxAge:       time.Duration(0) * time.Second,
-		authzExpiration: time.Duration(1) * time.Minute,
-		tokenExpiration: time.Duration(10) * time.Minute,
+		tokenEndpoint:      "/oauth2/tokens",
+		authzEndpoint:      "/oauth2/authzs",
+		revocationEndpoint: "/oauth2/revoke",
+		stsMaxAge:          time.Duration(0) * time.Second,
+		authzExpiration:    time.Duration(1) * time.Minute,
+		tokenExpiration:    time.Duration(10) * time.Minute,
 	}
 
 	SetAuthzForm(authzForm)(&cfg)
+	SetCSRFKey([]byte("csrf-test-key"))(&cfg)
+	SetLineageStore(NewMemoryLineageStore(time.Hour))(&cfg)
 	SetLoginURL("https://api.hooklift.io/accounts/login", "redirect_to")(&cfg)
 
 	return cfg
 }
 
+var csrfTokenRe = regexp.MustCompile(`name="csrf_token" value="([^"]+)"`)
+
+// authzPostTest displays the authorization form for the request described by
+// values and posts it back the way a browser would, along with the CSRF cookie
+// and token.
+func authzPostTest(t *testing.T, cfg config, values url.Values) *httptest.ResponseRecorder {
+	query := url.Values{}
+	for k, v := range values {
+		if k != "decision" && k != "approved_scope" {
+			query[k] = v
+		}
+	}
+
+	req, err := http.NewRequest("GET", "https://example.com/oauth2/authzs?"+query.Encode(), nil)
+	ok(t, err)
+
+	w := httptest.NewRecorder()
+	CreateGrant(w, req, cfg)
+
+	m := csrfTokenRe.FindStringSubmatch(w.Body.String())
+	assert(t, m != nil, "CSRF token was not found in authorization form: %s", w.Body.String())
+
+	post := url.Values{"csrf_token": {m[1]}}
+	for k, v := range values {
+		post[k] = v
+	}
+
+	req, err = http.NewRequest("POST", "https://example.com/oauth2/authzs", bytes.NewBufferString(post.Encode()))
+	ok(t, err)
+	req.Header.Set("Content-type", "application/x-www-form-urlencoded")
+	for _, c := range w.Result().Cookies() {
+		req.AddCookie(c)
+	}
+
+	w = httptest.NewRecorder()
+	CreateGrant(w, req, cfg)
+	return w
+}
+
 // getTestAuthzCode returns authorization tokens for access tokens issuing tests
 func getTestAuthzCode(t *testing.T) (config, string) {
 	cfg := setupTest()
@@ -116,14 +166,8 @@ func getTestAuthzCode(t *testing.T) (config, string) {
 	}
 
 	// Sending post to acquire authorization token
-	buffer := bytes.NewBufferString(queryStr)
-	req, err = http.NewRequest("POST", "https://example.com/oauth2/authzs", buffer)
-	ok(t, err)
-
-	req.Header.Set("Content-type", "application/x-www-form-urlencoded")
-
-	w = httptest.NewRecorder()
-	CreateGrant(w, req, cfg)
+	values.Set("decision", "approve")
+	w = authzPostTest(t, cfg, values)
 
 	// Tests http://tools.ietf.org/html/rfc6749#section-4.1.2
 	equals(t, http.StatusFound, w.Code)
@@ -232,14 +276,8 @@ func TestImplicitGrant(t *testing.T) {
 	}
 
 	// Sending post to acquire authorization token
-	buffer := bytes.NewBufferString(queryStr)
-	req, err = http.NewRequest("POST", "https://example.com/oauth2/authzs", buffer)
-	ok(t, err)
-
-	req.Header.Set("Content-type", "application/x-www-form-urlencoded")
-
-	w = httptest.NewRecorder()
-	CreateGrant(w, req, cfg)
+	values.Set("decision", "approve")
+	w = authzPostTest(t, cfg, values)
 
 	// Tests http://tools.ietf.org/html/rfc6749#section-4.2.2
 	equals(t, http.StatusFound, w.Code)
@@ -267,6 +305,11 @@ func TestImplicitGrant(t *testing.T) {
 func TestReplayAttackProtection(t *testing.T) {
 	cfg, authzCode := getTestAuthzCode(t)
 
+	var events []types.AuditEvent
+	SetAuditLogger(func(e types.AuditEvent) {
+		events = append(events, e)
+	})(&cfg)
+
 	req := AuthzGrantTokenRequestTest(t, "authorization_code", authzCode)
 	req.SetBasicAuth("test_client_id", "test_client_id")
 
@@ -289,6 +332,17 @@ func TestReplayAttackProtection(t *testing.T) {
 	equals(t, "invalid_grant", authzErr.Code)
 	equals(t, "Grant code was revoked, expired or already used.", authzErr.Description)
 
+	// Tokens issued from the reused authorization code must be revoked.
+	provider := cfg.provider.(*test.Provider)
+	_, found := provider.AccessTokens[token.Value]
+	equals(t, false, found)
+	_, found = provider.RefreshTokens[token.RefreshToken]
+	equals(t, false, found)
+
+	equals(t, 1, len(events))
+	equals(t, types.EventAuthzCodeReused, events[0].Type)
+	equals(t, 2, events[0].RevokedTokens)
+
 }
 
 // TestRedirectURLMatch makes sure redirect_uri for requesting an authorization
@@ -477,3 +531,391 @@ func TestRedirectURIScheme(t *testing.T) {
 	assert(t, strings.Contains(body, "access_denied") == true, "access-denied was not found in response body")
 	assert(t, strings.Contains(body, "3rd-party client app provided an invalid redirect_uri. It does not comply with http://tools.ietf.org/html/rfc3986#section-4.3 or does not use HTTPS") == true, "error description does not match.")
 }
+
+// TestAuthzDenied tests that the client is informed when the resource owner
+// denies the authorization request.
+// http://tools.ietf.org/html/rfc6749#section-4.1.2.1
+func TestAuthzDenied(t *testing.T) {
+	cfg := setupTest()
+	provider := test.NewProvider(true)
+	cfg.provider = provider
+
+	values := url.Values{
+		"client_id":     {provider.Client.ID},
+		"response_type": {"code"},
+		"state":         {"state-test"},
+		"redirect_uri":  {provider.Client.RedirectURL.String()},
+		"scope":         {"read write identity"},
+		"decision":      {"deny"},
+	}
+
+	w := authzPostTest(t, cfg, values)
+	equals(t, http.StatusFound, w.Code)
+
+	u, err := url.Parse(w.Header().Get("Location"))
+	ok(t, err)
+	equals(t, "access_denied", u.Query().Get("error"))
+	equals(t, "state-test", u.Query().Get("state"))
+	equals(t, "", u.Query().Get("code"))
+	equals(t, 0, len(provider.Grants))
+}
+
+// TestPartialScopeApproval tests that resource owners can approve only some of
+// the requested scopes and that clients are told about it when getting tokens.
+func TestPartialScopeApproval(t *testing.T) {
+	cfg := setupTest()
+	provider := test.NewProvider(true)
+	cfg.provider = provider
+
+	values := url.Values{
+		"client_id":      {provider.Client.ID},
+		"response_type":  {"code"},
+		"state":          {"state-test"},
+		"redirect_uri":   {provider.Client.RedirectURL.String()},
+		"scope":          {"read write identity"},
+		"decision":       {"approve"},
+		"approved_scope": {"read", "identity"},
+	}
+
+	w := authzPostTest(t, cfg, values)
+	equals(t, http.StatusFound, w.Code)
+
+	u, err := url.Parse(w.Header().Get("Location"))
+	ok(t, err)
+	authzCode := u.Query().Get("code")
+	assert(t, authzCode != "", "It looks like the authorization code came back empty: %s", authzCode)
+
+	req := AuthzGrantTokenRequestTest(t, "authorization_code", authzCode)
+	req.SetBasicAuth("testclient", "testclient")
+
+	w = httptest.NewRecorder()
+	IssueToken(w, req, cfg)
+	equals(t, http.StatusOK, w.Code)
+
+	token := types.Token{}
+	err = json.Unmarshal(w.Body.Bytes(), &token)
+	ok(t, err)
+	equals(t, "read identity", token.Scope)
+
+	// Approving scopes that were never requested is not allowed.
+	values.Set("approved_scope", "admin")
+	w = authzPostTest(t, cfg, values)
+	equals(t, http.StatusFound, w.Code)
+
+	u, err = url.Parse(w.Header().Get("Location"))
+	ok(t, err)
+	equals(t, "invalid_scope", u.Query().Get("error"))
+
+	// Unchecking every scope denies the request.
+	values.Del("approved_scope")
+	values.Set("scope_selection", "1")
+	w = authzPostTest(t, cfg, values)
+	equals(t, http.StatusFound, w.Code)
+
+	u, err = url.Parse(w.Header().Get("Location"))
+	ok(t, err)
+	equals(t, "access_denied", u.Query().Get("error"))
+	equals(t, "", u.Query().Get("code"))
+
+	// Forms not supporting scope selection approve every requested scope.
+	values.Del("scope_selection")
+	w = authzPostTest(t, cfg, values)
+	equals(t, http.StatusFound, w.Code)
+
+	u, err = url.Parse(w.Header().Get("Location"))
+	ok(t, err)
+	assert(t, u.Query().Get("code") != "", "authorization code was not issued: %s", u)
+}
+
+// TestRememberedConsent tests that resource owners are not asked again to
+// approve scopes they already approved, unless the client asks for it.
+func TestRememberedConsent(t *testing.T) {
+	cfg := setupTest()
+	provider := test.NewProvider(true)
+	cfg.provider = provider
+	SetConsentStore(provider)(&cfg)
+
+	values := url.Values{
+		"client_id":     {provider.Client.ID},
+		"response_type": {"code"},
+		"state":         {"state-test"},
+		"redirect_uri":  {provider.Client.RedirectURL.String()},
+		"scope":         {"read write"},
+	}
+
+	authzRequest := func(values url.Values) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("GET", "https://example.com/oauth2/authzs?"+values.Encode(), nil)
+		ok(t, err)
+
+		w := httptest.NewRecorder()
+		CreateGrant(w, req, cfg)
+		return w
+	}
+
+	// No consent has been given yet.
+	equals(t, http.StatusOK, authzRequest(values).Code)
+
+	values.Set("decision", "approve")
+	w := authzPostTest(t, cfg, values)
+	equals(t, http.StatusFound, w.Code)
+	values.Del("decision")
+
+	// Same or fewer scopes are approved right away.
+	values.Set("scope", "read")
+	w = authzRequest(values)
+	equals(t, http.StatusFound, w.Code)
+	u, err := url.Parse(w.Header().Get("Location"))
+	ok(t, err)
+	assert(t, u.Query().Get("code") != "", "An authorization code was expected: %s", u)
+
+	// The client can force the authorization form to be displayed.
+	values.Set("prompt", "consent")
+	equals(t, http.StatusOK, authzRequest(values).Code)
+	values.Del("prompt")
+
+	// New scopes require the resource owner's approval.
+	values.Set("scope", "read identity")
+	equals(t, http.StatusOK, authzRequest(values).Code)
+
+	// First-party clients never ask for approval.
+	provider.Client.FirstParty = true
+	equals(t, http.StatusFound, authzRequest(values).Code)
+}
+
+// TestCSRFProtection tests that the authorization form can't be posted from
+// other sites on behalf of a logged-in resource owner.
+func TestCSRFProtection(t *testing.T) {
+	cfg := setupTest()
+	provider := test.NewProvider(true)
+	cfg.provider = provider
+
+	values := url.Values{
+		"client_id":     {provider.Client.ID},
+		"response_type": {"code"},
+		"state":         {"state-test"},
+		"redirect_uri":  {provider.Client.RedirectURL.String()},
+		"scope":         {"read write identity"},
+		"decision":      {"approve"},
+	}
+
+	post := func(values url.Values, cookie *http.Cookie) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("POST", "https://example.com/oauth2/authzs", bytes.NewBufferString(values.Encode()))
+		ok(t, err)
+		req.Header.Set("Content-type", "application/x-www-form-urlencoded")
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+
+		w := httptest.NewRecorder()
+		CreateGrant(w, req, cfg)
+		return w
+	}
+
+	// Auto-submitted forms from other sites have neither cookie nor token.
+	w := post(values, nil)
+	equals(t, http.StatusForbidden, w.Code)
+
+	req, err := http.NewRequest("GET", "https://example.com/oauth2/authzs?"+values.Encode(), nil)
+	ok(t, err)
+	w = httptest.NewRecorder()
+	CreateGrant(w, req, cfg)
+	cookies := w.Result().Cookies()
+	equals(t, 1, len(cookies))
+	token := csrfTokenRe.FindStringSubmatch(w.Body.String())[1]
+
+	// Tokens are bound to the browser's cookie.
+	values.Set("csrf_token", token)
+	w = post(values, &http.Cookie{Name: csrfCookie, Value: "attacker"})
+	equals(t, http.StatusForbidden, w.Code)
+
+	// Tokens are bound to the authorization request parameters.
+	values.Set("scope", "read write identity admin")
+	w = post(values, cookies[0])
+	equals(t, http.StatusForbidden, w.Code)
+	equals(t, 0, len(provider.Grants))
+
+	values.Set("scope", "read write identity")
+	w = post(values, cookies[0])
+	equals(t, http.StatusFound, w.Code)
+	equals(t, 1, len(provider.Grants))
+}
+
+// TestResponseModes tests that authorization responses are delivered using the
+// requested response mode, along with the issuer identifier.
+func TestResponseModes(t *testing.T) {
+	cfg := setupTest()
+	provider := test.NewProvider(true)
+	cfg.provider = provider
+	SetIssuer("https://example.com")(&cfg)
+
+	values := url.Values{
+		"client_id":     {provider.Client.ID},
+		"response_type": {"code"},
+		"response_mode": {"form_post"},
+		"state":         {"state-test"},
+		"redirect_uri":  {provider.Client.RedirectURL.String()},
+		"scope":         {"read"},
+		"decision":      {"approve"},
+	}
+
+	w := authzPostTest(t, cfg, values)
+	equals(t, http.StatusOK, w.Code)
+
+	body := w.Body.String()
+	assert(t, strings.Contains(body, `action="https://example.com/oauth2/callback"`), "form action not found: %s", body)
+	assert(t, strings.Contains(body, `name="code"`), "authorization code not found: %s", body)
+	assert(t, strings.Contains(body, `name="iss" value="https://example.com"`), "issuer not found: %s", body)
+
+	values.Set("response_mode", "fragment")
+	w = authzPostTest(t, cfg, values)
+	equals(t, http.StatusFound, w.Code)
+
+	u, err := url.Parse(w.Header().Get("Location"))
+	ok(t, err)
+	equals(t, "", u.RawQuery)
+
+	fragment, err := url.ParseQuery(u.Fragment)
+	ok(t, err)
+	assert(t, fragment.Get("code") != "", "we were expecting an authorization code: %s", u)
+	equals(t, "state-test", fragment.Get("state"))
+	equals(t, "https://example.com", fragment.Get("iss"))
+
+	// Access tokens can't be sent in the query string.
+	values.Set("response_type", "token")
+	values.Set("response_mode", "query")
+	req, err := http.NewRequest("GET", "https://example.com/oauth2/authzs?"+values.Encode(), nil)
+	ok(t, err)
+	w = httptest.NewRecorder()
+	CreateGrant(w, req, cfg)
+	equals(t, http.StatusFound, w.Code)
+
+	u, err = url.Parse(w.Header().Get("Location"))
+	ok(t, err)
+	fragment, err = url.ParseQuery(u.Fragment)
+	ok(t, err)
+	equals(t, "invalid_request", fragment.Get("error"))
+}
+
+// TestPromptNone tests that errors are sent back to the client instead of
+// displaying any user interface when prompt=none is requested.
+func TestPromptNone(t *testing.T) {
+	cfg := setupTest()
+	provider := test.NewProvider(false)
+	cfg.provider = provider
+
+	values := url.Values{
+		"client_id":     {provider.Client.ID},
+		"response_type": {"code"},
+		"state":         {"state-test"},
+		"redirect_uri":  {provider.Client.RedirectURL.String()},
+		"scope":         {"read"},
+		"prompt":        {"none"},
+	}
+
+	authzRequest := func() url.Values {
+		req, err := http.NewRequest("GET", "https://example.com/oauth2/authzs?"+values.Encode(), nil)
+		ok(t, err)
+
+		w := httptest.NewRecorder()
+		CreateGrant(w, req, cfg)
+		equals(t, http.StatusFound, w.Code)
+
+		u, err := url.Parse(w.Header().Get("Location"))
+		ok(t, err)
+		return u.Query()
+	}
+
+	equals(t, "login_required", authzRequest().Get("error"))
+
+	cfg.provider = test.NewProvider(true)
+	equals(t, "interaction_required", authzRequest().Get("error"))
+
+	SetConsentStore(cfg.provider.(ConsentStore))(&cfg)
+	equals(t, "consent_required", authzRequest().Get("error"))
+
+	values.Set("prompt", "none login")
+	equals(t, "invalid_request", authzRequest().Get("error"))
+}
+
+// TestMaxAge tests that resource owners are sent to the login URL, along with
+// the authentication parameters, when their authentication is too old.
+func TestMaxAge(t *testing.T) {
+	cfg := setupTest()
+	provider := test.NewProvider(true)
+	provider.AuthTime = time.Now().Add(-time.Hour)
+	cfg.provider = provider
+
+	values := url.Values{
+		"client_id":     {provider.Client.ID},
+		"response_type": {"code"},
+		"state":         {"state-test"},
+		"redirect_uri":  {provider.Client.RedirectURL.String()},
+		"scope":         {"read"},
+		"max_age":       {"600"},
+		"login_hint":    {"test_user@example.com"},
+		"acr_values":    {"urn:mace:incommon:iap:silver"},
+	}
+
+	req, err := http.NewRequest("GET", "https://example.com/oauth2/authzs?"+values.Encode(), nil)
+	ok(t, err)
+	w := httptest.NewRecorder()
+	CreateGrant(w, req, cfg)
+	equals(t, http.StatusFound, w.Code)
+
+	u, err := url.Parse(w.Header().Get("Location"))
+	ok(t, err)
+	equals(t, "api.hooklift.io", u.Host)
+	equals(t, "600", u.Query().Get("max_age"))
+	equals(t, "test_user@example.com", u.Query().Get("login_hint"))
+	equals(t, "urn:mace:incommon:iap:silver", u.Query().Get("acr_values"))
+
+	// max_age is kept in the URL the resource owner comes back to, so the
+	// authentication time is checked again.
+	back, err := url.Parse(u.Query().Get("redirect_to"))
+	ok(t, err)
+	equals(t, "600", back.Query().Get("max_age"))
+	equals(t, "test_user@example.com", back.Query().Get("login_hint"))
+
+	// The login page did not refresh the authentication time.
+	req, err = http.NewRequest("GET", back.String(), nil)
+	ok(t, err)
+	w = httptest.NewRecorder()
+	CreateGrant(w, req, cfg)
+	equals(t, http.StatusFound, w.Code)
+	u, err = url.Parse(w.Header().Get("Location"))
+	ok(t, err)
+	equals(t, "api.hooklift.io", u.Host)
+
+	// A recent authentication is good enough.
+	provider.AuthTime = time.Now()
+	w = httptest.NewRecorder()
+	CreateGrant(w, req, cfg)
+	equals(t, http.StatusOK, w.Code)
+
+	// max_age=0 is handled like prompt=login and not forwarded back.
+	values.Set("max_age", "0")
+	req, err = http.NewRequest("GET", "https://example.com/oauth2/authzs?"+values.Encode(), nil)
+	ok(t, err)
+	w = httptest.NewRecorder()
+	CreateGrant(w, req, cfg)
+	equals(t, http.StatusFound, w.Code)
+	u, err = url.Parse(w.Header().Get("Location"))
+	ok(t, err)
+	back, err = url.Parse(u.Query().Get("redirect_to"))
+	ok(t, err)
+	equals(t, "", back.Query().Get("max_age"))
+
+	// Sessions not reporting an authentication time can't satisfy max_age,
+	// so the resource owner is not sent back to log in over and over.
+	provider.AuthTime = time.Time{}
+	values.Set("max_age", "600")
+	req, err = http.NewRequest("GET", "https://example.com/oauth2/authzs?"+values.Encode(), nil)
+	ok(t, err)
+	w = httptest.NewRecorder()
+	CreateGrant(w, req, cfg)
+	equals(t, http.StatusFound, w.Code)
+	u, err = url.Parse(w.Header().Get("Location"))
+	ok(t, err)
+	equals(t, "example.com", u.Host)
+	equals(t, "login_required", u.Query().Get("error"))
+}
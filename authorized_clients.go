@@ -0,0 +1,141 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package oauth2
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/hooklift/oauth2/internal/render"
+)
+
+// AuthorizedClientsHandlers is a map to functions where each function handles
+// a particular HTTP verb or method.
+var AuthorizedClientsHandlers map[string]func(http.ResponseWriter, *http.Request, config) = map[string]func(http.ResponseWriter, *http.Request, config){
+	"GET":    ListAuthorizedClients,
+	"DELETE": RevokeAuthorizedClient,
+}
+
+// authorizedClient is the representation of types.AuthorizedClient sent back
+// to resource owners.
+type authorizedClient struct {
+	ClientID     string    `json:"client_id"`
+	Name         string    `json:"name"`
+	Description  string    `json:"description,omitempty"`
+	LogoURL      string    `json:"logo_url,omitempty"`
+	HomepageURL  string    `json:"homepage_url,omitempty"`
+	Scope        string    `json:"scope"`
+	AuthorizedAt time.Time `json:"authorized_at"`
+	LastUsedAt   time.Time `json:"last_used_at"`
+}
+
+// ListAuthorizedClients sends back the clients authorized by the resource owner.
+func ListAuthorizedClients(w http.ResponseWriter, req *http.Request, cfg config) {
+	subject, ok := authorizedClientsSession(w, req, cfg)
+	if !ok {
+		return
+	}
+
+	provider := cfg.provider.(AuthorizedClientsProvider)
+	clients, err := provider.AuthorizedClients(subject)
+	if err != nil {
+		render.JSON(w, render.Options{
+			Status: http.StatusInternalServerError,
+			Data:   ErrServerError("", err),
+		})
+		return
+	}
+
+	data := make([]authorizedClient, 0, len(clients))
+	for _, c := range clients {
+		ac := authorizedClient{
+			ClientID:     c.Client.ID,
+			Name:         c.Client.Name,
+			Description:  c.Client.Description,
+			Scope:        c.Scopes.Encode(),
+			AuthorizedAt: c.AuthorizedAt,
+			LastUsedAt:   c.LastUsedAt,
+		}
+
+		if c.Client.LogoURL != nil {
+			ac.LogoURL = c.Client.LogoURL.String()
+		}
+
+		if c.Client.HomepageURL != nil {
+			ac.HomepageURL = c.Client.HomepageURL.String()
+		}
+		data = append(data, ac)
+	}
+
+	render.JSON(w, render.Options{
+		Status: http.StatusOK,
+		Data:   data,
+	})
+}
+
+// RevokeAuthorizedClient revokes every grant and token issued to the client
+// identified in the URL path on behalf of the resource owner, and forgets her
+// consent so the client has to ask for authorization again.
+func RevokeAuthorizedClient(w http.ResponseWriter, req *http.Request, cfg config) {
+	subject, ok := authorizedClientsSession(w, req, cfg)
+	if !ok {
+		return
+	}
+
+	clientID := strings.Trim(strings.TrimPrefix(req.URL.Path, cfg.authorizedClientsEndpoint), "/")
+	if clientID == "" {
+		render.JSON(w, render.Options{
+			Status: http.StatusBadRequest,
+			Data:   ErrClientIDMissing,
+		})
+		return
+	}
+
+	provider := cfg.provider.(AuthorizedClientsProvider)
+	if err := provider.RevokeClient(subject, clientID); err != nil {
+		render.JSON(w, render.Options{
+			Status: http.StatusInternalServerError,
+			Data:   ErrServerError("", err),
+		})
+		return
+	}
+
+	if cfg.consent.store != nil {
+		if err := cfg.consent.store.RevokeConsent(subject, clientID); err != nil {
+			render.JSON(w, render.Options{
+				Status: http.StatusInternalServerError,
+				Data:   ErrServerError("", err),
+			})
+			return
+		}
+	}
+
+	render.JSON(w, render.Options{
+		Status: http.StatusOK,
+	})
+}
+
+// authorizedClientsSession returns the identifier of the resource owner making
+// the request, replying with an error if she does not have a valid session.
+func authorizedClientsSession(w http.ResponseWriter, req *http.Request, cfg config) (string, bool) {
+	session, err := userSession(req, cfg)
+	if err != nil {
+		render.JSON(w, render.Options{
+			Status: http.StatusInternalServerError,
+			Data:   ErrServerError("", err),
+		})
+		return "", false
+	}
+
+	if !authenticated(cfg, session) || session.Subject == "" {
+		render.JSON(w, render.Options{
+			Status: http.StatusUnauthorized,
+			Data:   ErrSessionRequired,
+		})
+		return "", false
+	}
+	return session.Subject, true
+}
@@ -0,0 +1,85 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package oauth2
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/hooklift/oauth2/providers/test"
+)
+
+// TestAuthorizedClients tests that resource owners can list and revoke the
+// clients they authorized.
+func TestAuthorizedClients(t *testing.T) {
+	cfg := setupTest()
+	provider := test.NewProvider(true)
+	cfg.provider = provider
+	SetConsentStore(provider)(&cfg)
+	SetAuthorizedClientsEndpoint("/oauth2/authorized_clients")(&cfg)
+
+	values := url.Values{
+		"client_id":     {provider.Client.ID},
+		"response_type": {"code"},
+		"state":         {"state-test"},
+		"redirect_uri":  {provider.Client.RedirectURL.String()},
+		"scope":         {"read write"},
+		"decision":      {"approve"},
+	}
+
+	w := authzPostTest(t, cfg, values)
+	equals(t, http.StatusFound, w.Code)
+
+	req, err := http.NewRequest("GET", "https://example.com/oauth2/authorized_clients", nil)
+	ok(t, err)
+
+	w = httptest.NewRecorder()
+	ListAuthorizedClients(w, req, cfg)
+	equals(t, http.StatusOK, w.Code)
+
+	var clients []authorizedClient
+	err = json.Unmarshal(w.Body.Bytes(), &clients)
+	ok(t, err)
+	equals(t, 1, len(clients))
+	equals(t, provider.Client.ID, clients[0].ClientID)
+	equals(t, "read write", clients[0].Scope)
+
+	req, err = http.NewRequest("DELETE", "https://example.com/oauth2/authorized_clients/"+provider.Client.ID, nil)
+	ok(t, err)
+
+	w = httptest.NewRecorder()
+	RevokeAuthorizedClient(w, req, cfg)
+	equals(t, http.StatusOK, w.Code)
+	equals(t, 0, len(provider.Consents))
+
+	for _, g := range provider.Grants {
+		equals(t, "revoked", string(g.Status))
+	}
+}
+
+// TestAuthorizedClientsSession tests that a session is required to manage
+// authorized clients.
+func TestAuthorizedClientsSession(t *testing.T) {
+	cfg := setupTest()
+	cfg.provider = test.NewProvider(false)
+	SetAuthorizedClientsEndpoint("/oauth2/authorized_clients")(&cfg)
+
+	req, err := http.NewRequest("GET", "https://example.com/oauth2/authorized_clients", nil)
+	ok(t, err)
+
+	w := httptest.NewRecorder()
+	ListAuthorizedClients(w, req, cfg)
+	equals(t, http.StatusUnauthorized, w.Code)
+
+	req, err = http.NewRequest("DELETE", "https://example.com/oauth2/authorized_clients/test_client_id", nil)
+	ok(t, err)
+
+	w = httptest.NewRecorder()
+	RevokeAuthorizedClient(w, req, cfg)
+	equals(t, http.StatusUnauthorized, w.Code)
+}
@@ -0,0 +1,578 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package oauth2
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hooklift/oauth2/internal/render"
+	"github.com/hooklift/oauth2/types"
+)
+
+// Grant type used by clients to redeem backchannel authentication requests.
+// -- http://openid.net/specs/openid-client-initiated-backchannel-authentication-core-1_0.html#token_request
+const cibaGrantType = "urn:openid:params:grant-type:ciba"
+
+// Token delivery modes.
+const (
+	deliveryPoll = "poll"
+	deliveryPing = "ping"
+	deliveryPush = "push"
+)
+
+// BackchannelNotifier reaches resource owners on their authentication device,
+// such as a phone, so they can approve authentication requests started by
+// clients on their behalf.
+type BackchannelNotifier interface {
+	// ResolveUser returns the identifier of the resource owner designated by
+	// the login hint sent by the client. An empty identifier is returned if
+	// there is none.
+	ResolveUser(loginHint string) (subject string, err error)
+
+	// Notify asks the resource owner to approve the request on their
+	// authentication device. Once they approve or deny it, usually from a
+	// different HTTP request, complete has to be called with their decision.
+	Notify(request types.BackchannelRequest, complete func(approved bool) error) error
+}
+
+// BackchannelStore keeps backchannel authentication requests until they are
+// redeemed or expire.
+type BackchannelStore interface {
+	// SaveBackchannelRequest stores or replaces a request.
+	SaveBackchannelRequest(request types.BackchannelRequest) error
+
+	// BackchannelRequest returns the request with the given identifier. A
+	// zero value is returned if there is none.
+	BackchannelRequest(id string) (types.BackchannelRequest, error)
+
+	// UpdateBackchannelRequest replaces the stored request with the same
+	// identifier only if its status is still status, returning false
+	// otherwise. The check and the update must be atomic, so that polling
+	// clients can't overwrite the resource owner's decision.
+	UpdateBackchannelRequest(request types.BackchannelRequest, status types.BackchannelStatus) (bool, error)
+
+	// TakeBackchannelRequest removes the request with the given identifier
+	// and returns it. It must be atomic, so that only one of several
+	// concurrent callers gets the request, the others get a zero value.
+	TakeBackchannelRequest(id string) (types.BackchannelRequest, error)
+
+	// DeleteBackchannelRequest removes a request.
+	DeleteBackchannelRequest(id string) error
+}
+
+// memoryBackchannel is an in-memory BackchannelStore.
+type memoryBackchannel struct {
+	sync.Mutex
+	requests map[string]types.BackchannelRequest
+}
+
+// NewMemoryBackchannelStore returns a BackchannelStore keeping requests in
+// memory. It is only suitable for single instance deployments, since requests
+// are not shared between processes.
+func NewMemoryBackchannelStore() BackchannelStore {
+	return &memoryBackchannel{
+		requests: make(map[string]types.BackchannelRequest),
+	}
+}
+
+func (m *memoryBackchannel) SaveBackchannelRequest(request types.BackchannelRequest) error {
+	m.Lock()
+	defer m.Unlock()
+
+	now := time.Now()
+	for k, r := range m.requests {
+		if r.ExpiresAt.Before(now) {
+			delete(m.requests, k)
+		}
+	}
+	m.requests[request.ID] = request
+	return nil
+}
+
+func (m *memoryBackchannel) BackchannelRequest(id string) (types.BackchannelRequest, error) {
+	m.Lock()
+	defer m.Unlock()
+	return m.requests[id], nil
+}
+
+func (m *memoryBackchannel) UpdateBackchannelRequest(request types.BackchannelRequest, status types.BackchannelStatus) (bool, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	if r, ok := m.requests[request.ID]; !ok || r.Status != status {
+		return false, nil
+	}
+	m.requests[request.ID] = request
+	return true, nil
+}
+
+func (m *memoryBackchannel) TakeBackchannelRequest(id string) (types.BackchannelRequest, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	request := m.requests[id]
+	delete(m.requests, id)
+	return request, nil
+}
+
+func (m *memoryBackchannel) DeleteBackchannelRequest(id string) error {
+	m.Lock()
+	defer m.Unlock()
+	delete(m.requests, id)
+	return nil
+}
+
+// BackchannelHandlers is a map to functions where each function handles a
+// particular HTTP verb or method.
+var BackchannelHandlers map[string]func(http.ResponseWriter, *http.Request, config) = map[string]func(http.ResponseWriter, *http.Request, config){
+	"POST": BackchannelAuthenticate,
+}
+
+type backchannelResponse struct {
+	AuthReqID string `json:"auth_req_id"`
+	ExpiresIn int64  `json:"expires_in"`
+	Interval  int64  `json:"interval,omitempty"`
+}
+
+// BackchannelAuthenticate starts an authentication request the resource owner
+// approves on their authentication device, in accordance with
+// http://openid.net/specs/openid-client-initiated-backchannel-authentication-core-1_0.html#auth_request
+func BackchannelAuthenticate(w http.ResponseWriter, req *http.Request, cfg config) {
+	provider := cfg.provider
+	cinfo, ok := authenticateClient(req, cfg)
+	if !ok || cinfo.Public() {
+		invalidClient(w, req)
+		return
+	}
+
+	if !allowed(cinfo.GrantTypes, cibaGrantType) {
+		render.JSON(w, render.Options{
+			Status: http.StatusBadRequest,
+			Data:   ErrUnauthorizedGrantType,
+		})
+		return
+	}
+
+	scope := req.PostFormValue("scope")
+	if _, err := cfg.scopeMatcher.Parse(scope); err != nil {
+		e := ErrInvalidScope
+		e.Description = err.Error()
+		render.JSON(w, render.Options{
+			Status: http.StatusBadRequest,
+			Data:   e,
+		})
+		return
+	}
+
+	scopes, err := provider.ScopesInfo(scope)
+	if err != nil {
+		render.JSON(w, render.Options{
+			Status: http.StatusInternalServerError,
+			Data:   ErrServerError("", err),
+		})
+		return
+	}
+
+	if !openIDRequest(cfg, scopes) {
+		render.JSON(w, render.Options{
+			Status: http.StatusBadRequest,
+			Data:   ErrOpenIDScopeRequired,
+		})
+		return
+	}
+
+	if !scopesAllowed(cfg, cinfo, scopes) {
+		render.JSON(w, render.Options{
+			Status: http.StatusBadRequest,
+			Data:   ErrScopeNotAllowed,
+		})
+		return
+	}
+
+	loginHint := req.PostFormValue("login_hint")
+	if loginHint == "" {
+		render.JSON(w, render.Options{
+			Status: http.StatusBadRequest,
+			Data:   ErrLoginHintRequired,
+		})
+		return
+	}
+
+	mode := cinfo.BackchannelTokenDeliveryMode
+	if mode == "" {
+		mode = deliveryPoll
+	}
+
+	notificationToken := req.PostFormValue("client_notification_token")
+	if mode != deliveryPoll && (notificationToken == "" || cinfo.BackchannelNotificationURL == nil) {
+		render.JSON(w, render.Options{
+			Status: http.StatusBadRequest,
+			Data:   ErrClientNotificationTokenRequired,
+		})
+		return
+	}
+
+	expiration := cfg.backchannel.expiration
+	if v := req.PostFormValue("requested_expiry"); v != "" {
+		seconds, err := strconv.ParseUint(v, 10, 32)
+		if err != nil || seconds == 0 {
+			render.JSON(w, render.Options{
+				Status: http.StatusBadRequest,
+				Data:   ErrInvalidRequestedExpiry,
+			})
+			return
+		}
+
+		if d := time.Duration(seconds) * time.Second; d < expiration {
+			expiration = d
+		}
+	}
+
+	subject, err := cfg.backchannel.notifier.ResolveUser(loginHint)
+	if err != nil {
+		render.JSON(w, render.Options{
+			Status: http.StatusInternalServerError,
+			Data:   ErrServerError("", err),
+		})
+		return
+	}
+
+	if subject == "" {
+		render.JSON(w, render.Options{
+			Status: http.StatusBadRequest,
+			Data:   ErrUnknownUserID,
+		})
+		return
+	}
+
+	id := make([]byte, 32)
+	if _, err := rand.Read(id); err != nil {
+		render.JSON(w, render.Options{
+			Status: http.StatusInternalServerError,
+			Data:   ErrServerError("", err),
+		})
+		return
+	}
+
+	request := types.BackchannelRequest{
+		ID:                      base64.RawURLEncoding.EncodeToString(id),
+		ClientID:                cinfo.ID,
+		Subject:                 subject,
+		Scopes:                  scopes,
+		BindingMessage:          req.PostFormValue("binding_message"),
+		ClientNotificationToken: notificationToken,
+		DeliveryMode:            mode,
+		Interval:                cfg.backchannel.interval,
+		ExpiresAt:               time.Now().Add(expiration),
+		Status:                  types.BackchannelPending,
+	}
+
+	store := cfg.backchannel.store
+	if err := store.SaveBackchannelRequest(request); err != nil {
+		render.JSON(w, render.Options{
+			Status: http.StatusInternalServerError,
+			Data:   ErrServerError("", err),
+		})
+		return
+	}
+
+	if err := cfg.backchannel.notifier.Notify(request, completeBackchannel(cfg, request.ID)); err != nil {
+		store.DeleteBackchannelRequest(request.ID)
+		render.JSON(w, render.Options{
+			Status: http.StatusInternalServerError,
+			Data:   ErrServerError("", err),
+		})
+		return
+	}
+
+	res := backchannelResponse{
+		AuthReqID: request.ID,
+		ExpiresIn: int64(expiration.Seconds()),
+	}
+
+	if mode != deliveryPush {
+		res.Interval = int64(request.Interval.Seconds())
+	}
+
+	render.JSON(w, render.Options{
+		Status: http.StatusOK,
+		Data:   res,
+	})
+}
+
+// completeBackchannel returns the function recording the resource owner's
+// decision on a backchannel authentication request, notifying the client if
+// it uses the ping or push delivery modes.
+func completeBackchannel(cfg config, id string) func(bool) error {
+	return func(approved bool) error {
+		store := cfg.backchannel.store
+		request, err := store.BackchannelRequest(id)
+		if err != nil {
+			return err
+		}
+
+		if request.ID == "" || request.ExpiresAt.Before(time.Now()) {
+			return errors.New("backchannel authentication request not found or expired")
+		}
+
+		if request.Status != types.BackchannelPending {
+			return errors.New("backchannel authentication request was already completed")
+		}
+
+		request.Status = types.BackchannelDenied
+		if approved {
+			request.Status = types.BackchannelApproved
+			request.AuthTime = time.Now()
+		}
+
+		updated, err := store.UpdateBackchannelRequest(request, types.BackchannelPending)
+		if err != nil {
+			return err
+		}
+
+		if !updated {
+			return errors.New("backchannel authentication request was already completed")
+		}
+
+		cinfo, err := cfg.provider.ClientInfo(request.ClientID)
+		if err != nil {
+			return err
+		}
+
+		switch request.DeliveryMode {
+		case deliveryPing:
+			return notifyClient(cfg, cinfo, request, map[string]string{
+				"auth_req_id": request.ID,
+			})
+		case deliveryPush:
+			// Push clients never call the token endpoint, so the request is
+			// redeemed right away.
+			request, err = store.TakeBackchannelRequest(request.ID)
+			if err != nil {
+				return err
+			}
+
+			if request.ID == "" {
+				return errors.New("backchannel authentication request was already redeemed")
+			}
+
+			if !approved {
+				e := ErrAccessDenied("")
+				return notifyClient(cfg, cinfo, request, map[string]string{
+					"auth_req_id":       request.ID,
+					"error":             e.Code,
+					"error_description": e.Description,
+				})
+			}
+
+			token, err := backchannelTokens(cfg, cinfo, request)
+			if err != nil {
+				return err
+			}
+
+			return notifyClient(cfg, cinfo, request, struct {
+				AuthReqID string `json:"auth_req_id"`
+				types.Token
+			}{request.ID, token})
+		}
+		return nil
+	}
+}
+
+// notifyClient posts a notification to the client's notification endpoint.
+// -- http://openid.net/specs/openid-client-initiated-backchannel-authentication-core-1_0.html#ping_callback
+func notifyClient(cfg config, cinfo types.Client, request types.BackchannelRequest, data interface{}) error {
+	body, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", cinfo.BackchannelNotificationURL.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+request.ClientNotificationToken)
+
+	res, err := cfg.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("client notification endpoint responded with %s", res.Status)
+	}
+	return nil
+}
+
+// backchannelTokens issues the tokens of an approved backchannel
+// authentication request.
+func backchannelTokens(cfg config, cinfo types.Client, request types.BackchannelRequest) (types.Token, error) {
+	grant := types.Grant{
+		Scopes:   request.Scopes,
+		Subject:  request.Subject,
+		AuthTime: request.AuthTime,
+	}
+
+	token, err := genToken(cfg, grant, cinfo, issueRefreshToken(cfg, cinfo), tokenExpiration(cfg, cinfo))
+	if err != nil {
+		return token, err
+	}
+
+	if openIDRequest(cfg, request.Scopes) {
+		session := types.Session{
+			Subject:  request.Subject,
+			AuthTime: request.AuthTime,
+		}
+		claims, err := newIDTokenClaims(cfg, cinfo, session, "", "", token.Value)
+		if err != nil {
+			return token, err
+		}
+
+		// Pushed ID tokens are bound to the request and the refresh token
+		// delivered along with them.
+		// -- http://openid.net/specs/openid-client-initiated-backchannel-authentication-core-1_0.html#rfc.section.10.3.1
+		if request.DeliveryMode == deliveryPush {
+			claims.AuthReqID = request.ID
+			claims.RTHash = halfHash(token.RefreshToken)
+		}
+
+		if token.IDToken, err = signJWT(cfg, "", claims); err != nil {
+			return token, err
+		}
+	}
+
+	stored := storedToken(cfg, token)
+	link(cfg, "", cinfo, stored.RefreshToken)
+	link(cfg, stored.RefreshToken, cinfo, stored.Value)
+	return token, nil
+}
+
+// Implements http://openid.net/specs/openid-client-initiated-backchannel-authentication-core-1_0.html#token_request
+func backchannelGrant(w http.ResponseWriter, req *http.Request, cfg config, cinfo types.Client) {
+	store := cfg.backchannel.store
+	if store == nil {
+		render.JSON(w, render.Options{
+			Status: http.StatusBadRequest,
+			Data:   ErrUnsupportedGrantType,
+		})
+		return
+	}
+
+	request, err := store.BackchannelRequest(req.FormValue("auth_req_id"))
+	if err != nil {
+		render.JSON(w, render.Options{
+			Status: http.StatusInternalServerError,
+			Data:   ErrServerError("", err),
+		})
+		return
+	}
+
+	if request.ID == "" || request.ClientID != cinfo.ID {
+		render.JSON(w, render.Options{
+			Status: http.StatusBadRequest,
+			Data:   ErrInvalidGrant,
+		})
+		return
+	}
+
+	if request.DeliveryMode == deliveryPush {
+		render.JSON(w, render.Options{
+			Status: http.StatusBadRequest,
+			Data:   ErrUnauthorizedGrantType,
+		})
+		return
+	}
+
+	if request.ExpiresAt.Before(time.Now()) {
+		store.DeleteBackchannelRequest(request.ID)
+		render.JSON(w, render.Options{
+			Status: http.StatusBadRequest,
+			Data:   ErrExpiredToken,
+		})
+		return
+	}
+
+	if request.Status == types.BackchannelPending {
+		e := ErrAuthorizationPending
+		now := time.Now()
+		if request.DeliveryMode == deliveryPoll && now.Sub(request.LastPolledAt) < request.Interval {
+			// Polling interval has to be increased by at least 5 seconds
+			// for all subsequent requests.
+			e = ErrSlowDown
+			request.Interval += 5 * time.Second
+		}
+		request.LastPolledAt = now
+
+		// The request is only updated if the resource owner did not
+		// complete it meanwhile, so their decision is never lost.
+		updated, err := store.UpdateBackchannelRequest(request, types.BackchannelPending)
+		if err != nil {
+			render.JSON(w, render.Options{
+				Status: http.StatusInternalServerError,
+				Data:   ErrServerError("", err),
+			})
+			return
+		}
+
+		if updated {
+			render.JSON(w, render.Options{
+				Status: http.StatusBadRequest,
+				Data:   e,
+			})
+			return
+		}
+	}
+
+	// Completed requests can only be redeemed once.
+	request, err = store.TakeBackchannelRequest(request.ID)
+	if err != nil {
+		render.JSON(w, render.Options{
+			Status: http.StatusInternalServerError,
+			Data:   ErrServerError("", err),
+		})
+		return
+	}
+
+	if request.ID == "" || request.Status == types.BackchannelPending {
+		render.JSON(w, render.Options{
+			Status: http.StatusBadRequest,
+			Data:   ErrInvalidGrant,
+		})
+		return
+	}
+
+	if request.Status == types.BackchannelDenied {
+		render.JSON(w, render.Options{
+			Status: http.StatusBadRequest,
+			Data:   ErrAccessDenied(""),
+		})
+		return
+	}
+
+	token, err := backchannelTokens(cfg, cinfo, request)
+	if err != nil {
+		render.JSON(w, render.Options{
+			Status: http.StatusInternalServerError,
+			Data:   ErrServerError("", err),
+		})
+		return
+	}
+
+	render.JSON(w, render.Options{
+		Status: http.StatusOK,
+		Data:   token,
+	})
+}
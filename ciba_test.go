@@ -0,0 +1,281 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package oauth2
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hooklift/oauth2/internal/jose"
+	"github.com/hooklift/oauth2/providers/test"
+	"github.com/hooklift/oauth2/types"
+)
+
+// testNotifier records the requests sent to resource owners' devices.
+type testNotifier struct {
+	requests []types.BackchannelRequest
+	complete func(bool) error
+}
+
+func (n *testNotifier) ResolveUser(loginHint string) (string, error) {
+	if loginHint == "test_user@example.com" {
+		return "test_user", nil
+	}
+	return "", nil
+}
+
+func (n *testNotifier) Notify(request types.BackchannelRequest, complete func(bool) error) error {
+	n.requests = append(n.requests, request)
+	n.complete = complete
+	return nil
+}
+
+func setupBackchannelTest(t *testing.T, provider *test.Provider) (config, *testNotifier) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ok(t, err)
+
+	notifier := new(testNotifier)
+	cfg := setupTest()
+	cfg.provider = provider
+	SetIssuer("https://example.com")(&cfg)
+	SetSigningKeys(SigningKey{ID: "key-1", Key: key})(&cfg)
+	SetBackchannelAuthenticationEndpoint("/oauth2/bc-authorize", notifier)(&cfg)
+	SetBackchannelStore(NewMemoryBackchannelStore())(&cfg)
+	SetBackchannelExpiration(time.Duration(10)*time.Minute, time.Duration(5)*time.Second)(&cfg)
+	return cfg, notifier
+}
+
+func backchannelRequestTest(t *testing.T, cfg config, fn func(http.ResponseWriter, *http.Request, config), values url.Values) *httptest.ResponseRecorder {
+	req, err := http.NewRequest("POST", "https://example.com/oauth2/bc-authorize", strings.NewReader(values.Encode()))
+	ok(t, err)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth("test_client_id", "test_client_id")
+
+	w := httptest.NewRecorder()
+	fn(w, req, cfg)
+	return w
+}
+
+// TestBackchannelPoll tests the poll delivery mode, from the authentication
+// request to redeeming the approved request at the token endpoint.
+func TestBackchannelPoll(t *testing.T) {
+	provider := test.NewProvider(true)
+	cfg, notifier := setupBackchannelTest(t, provider)
+
+	w := backchannelRequestTest(t, cfg, BackchannelAuthenticate, url.Values{
+		"scope":      {"openid read"},
+		"login_hint": {"nobody@example.com"},
+	})
+	equals(t, http.StatusBadRequest, w.Code)
+	assert(t, strings.Contains(w.Body.String(), ErrUnknownUserID.Code), "unexpected response: %s", w.Body.String())
+
+	w = backchannelRequestTest(t, cfg, BackchannelAuthenticate, url.Values{
+		"scope":      {"read"},
+		"login_hint": {"test_user@example.com"},
+	})
+	equals(t, http.StatusBadRequest, w.Code)
+
+	// Scopes are validated as in every other grant.
+	w = backchannelRequestTest(t, cfg, BackchannelAuthenticate, url.Values{
+		"scope":      {"openid re*d"},
+		"login_hint": {"test_user@example.com"},
+	})
+	equals(t, http.StatusBadRequest, w.Code)
+	assert(t, strings.Contains(w.Body.String(), ErrInvalidScope.Code), "unexpected response: %s", w.Body.String())
+
+	provider.Client.Scopes = types.Scopes{{ID: "openid"}, {ID: "read"}}
+	w = backchannelRequestTest(t, cfg, BackchannelAuthenticate, url.Values{
+		"scope":      {"openid write"},
+		"login_hint": {"test_user@example.com"},
+	})
+	equals(t, http.StatusBadRequest, w.Code)
+	assert(t, strings.Contains(w.Body.String(), ErrScopeNotAllowed.Code), "unexpected response: %s", w.Body.String())
+	equals(t, 0, len(notifier.requests))
+
+	// Clients failing to authenticate get an invalid_client error.
+	req, err := http.NewRequest("POST", "https://example.com/oauth2/bc-authorize", strings.NewReader("scope=openid"))
+	ok(t, err)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w = httptest.NewRecorder()
+	BackchannelAuthenticate(w, req, cfg)
+	equals(t, http.StatusUnauthorized, w.Code)
+	assert(t, strings.Contains(w.Body.String(), ErrInvalidClient.Code), "unexpected response: %s", w.Body.String())
+
+	w = backchannelRequestTest(t, cfg, BackchannelAuthenticate, url.Values{
+		"scope":           {"openid read"},
+		"login_hint":      {"test_user@example.com"},
+		"binding_message": {"W4SCT"},
+	})
+	equals(t, http.StatusOK, w.Code)
+
+	res := backchannelResponse{}
+	ok(t, json.Unmarshal(w.Body.Bytes(), &res))
+	assert(t, res.AuthReqID != "", "auth_req_id should not be empty")
+	equals(t, int64(600), res.ExpiresIn)
+	equals(t, int64(5), res.Interval)
+	equals(t, 1, len(notifier.requests))
+	equals(t, "test_user", notifier.requests[0].Subject)
+	equals(t, "W4SCT", notifier.requests[0].BindingMessage)
+
+	tokenRequest := func() *httptest.ResponseRecorder {
+		return backchannelRequestTest(t, cfg, IssueToken, url.Values{
+			"grant_type":  {cibaGrantType},
+			"auth_req_id": {res.AuthReqID},
+		})
+	}
+
+	w = tokenRequest()
+	equals(t, http.StatusBadRequest, w.Code)
+	assert(t, strings.Contains(w.Body.String(), ErrAuthorizationPending.Code), "unexpected response: %s", w.Body.String())
+
+	// Polling again right away requires slowing down.
+	w = tokenRequest()
+	equals(t, http.StatusBadRequest, w.Code)
+	assert(t, strings.Contains(w.Body.String(), ErrSlowDown.Code), "unexpected response: %s", w.Body.String())
+
+	ok(t, notifier.complete(true))
+	assert(t, notifier.complete(false) != nil, "requests should only be completed once")
+
+	w = tokenRequest()
+	equals(t, http.StatusOK, w.Code)
+
+	token := types.Token{}
+	ok(t, json.Unmarshal(w.Body.Bytes(), &token))
+	assert(t, token.Value != "", "access token should not be empty")
+	assert(t, token.IDToken != "", "ID token should not be empty")
+
+	w = tokenRequest()
+	equals(t, http.StatusBadRequest, w.Code)
+	assert(t, strings.Contains(w.Body.String(), ErrInvalidGrant.Code), "approved requests should only be redeemed once: %s", w.Body.String())
+}
+
+// TestBackchannelPingPush tests notifying clients once resource owners
+// approve or deny backchannel authentication requests.
+func TestBackchannelPingPush(t *testing.T) {
+	notifications := make(chan *http.Request, 1)
+	bodies := make(chan map[string]interface{}, 1)
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body := make(map[string]interface{})
+		json.NewDecoder(req.Body).Decode(&body)
+		notifications <- req
+		bodies <- body
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	provider := test.NewProvider(true)
+	provider.Client.BackchannelTokenDeliveryMode = "ping"
+	provider.Client.BackchannelNotificationURL, _ = url.Parse(ts.URL + "/cb")
+	cfg, notifier := setupBackchannelTest(t, provider)
+	SetHTTPClient(ts.Client())(&cfg)
+
+	values := url.Values{
+		"scope":      {"openid"},
+		"login_hint": {"test_user@example.com"},
+	}
+
+	w := backchannelRequestTest(t, cfg, BackchannelAuthenticate, values)
+	equals(t, http.StatusBadRequest, w.Code)
+	assert(t, strings.Contains(w.Body.String(), "client_notification_token"), "unexpected response: %s", w.Body.String())
+
+	values.Set("client_notification_token", "notification-token")
+	w = backchannelRequestTest(t, cfg, BackchannelAuthenticate, values)
+	equals(t, http.StatusOK, w.Code)
+
+	res := backchannelResponse{}
+	ok(t, json.Unmarshal(w.Body.Bytes(), &res))
+
+	ok(t, notifier.complete(false))
+	req := <-notifications
+	equals(t, "Bearer notification-token", req.Header.Get("Authorization"))
+	equals(t, res.AuthReqID, (<-bodies)["auth_req_id"])
+
+	w = backchannelRequestTest(t, cfg, IssueToken, url.Values{
+		"grant_type":  {cibaGrantType},
+		"auth_req_id": {res.AuthReqID},
+	})
+	equals(t, http.StatusBadRequest, w.Code)
+	assert(t, strings.Contains(w.Body.String(), "access_denied"), "unexpected response: %s", w.Body.String())
+
+	// Push clients get tokens delivered to their notification endpoint.
+	provider.Client.BackchannelTokenDeliveryMode = "push"
+	w = backchannelRequestTest(t, cfg, BackchannelAuthenticate, values)
+	equals(t, http.StatusOK, w.Code)
+
+	res = backchannelResponse{}
+	ok(t, json.Unmarshal(w.Body.Bytes(), &res))
+	equals(t, int64(0), res.Interval)
+
+	w = backchannelRequestTest(t, cfg, IssueToken, url.Values{
+		"grant_type":  {cibaGrantType},
+		"auth_req_id": {res.AuthReqID},
+	})
+	equals(t, http.StatusBadRequest, w.Code)
+
+	ok(t, notifier.complete(true))
+	<-notifications
+	body := <-bodies
+	equals(t, res.AuthReqID, body["auth_req_id"])
+	assert(t, body["access_token"] != nil, "access token should have been pushed: %v", body)
+	assert(t, body["id_token"] != nil, "ID token should have been pushed: %v", body)
+
+	payload, err := jose.Verify(body["id_token"].(string), cfg.signingKeys[0].Key.Public())
+	ok(t, err)
+	claims := idTokenClaims{}
+	ok(t, json.Unmarshal(payload, &claims))
+	equals(t, res.AuthReqID, claims.AuthReqID)
+	equals(t, halfHash(body["access_token"].(string)), claims.ATHash)
+	equals(t, halfHash(body["refresh_token"].(string)), claims.RTHash)
+}
+
+// TestBackchannelStoreAtomicity tests that stale polls can't overwrite the
+// resource owner's decision and that requests are only taken once.
+func TestBackchannelStoreAtomicity(t *testing.T) {
+	store := NewMemoryBackchannelStore()
+	pending := types.BackchannelRequest{
+		ID:        "req-1",
+		Status:    types.BackchannelPending,
+		ExpiresAt: time.Now().Add(time.Minute),
+	}
+	ok(t, store.SaveBackchannelRequest(pending))
+
+	approved := pending
+	approved.Status = types.BackchannelApproved
+	updated, err := store.UpdateBackchannelRequest(approved, types.BackchannelPending)
+	ok(t, err)
+	assert(t, updated, "pending request should have been approved")
+
+	// A poll that read the request before it was approved.
+	pending.LastPolledAt = time.Now()
+	updated, err = store.UpdateBackchannelRequest(pending, types.BackchannelPending)
+	ok(t, err)
+	assert(t, !updated, "stale poll should not overwrite the approval")
+
+	results := make(chan types.BackchannelRequest, 10)
+	for i := 0; i < cap(results); i++ {
+		go func() {
+			r, err := store.TakeBackchannelRequest("req-1")
+			ok(t, err)
+			results <- r
+		}()
+	}
+
+	taken := 0
+	for i := 0; i < cap(results); i++ {
+		if r := <-results; r.ID != "" {
+			equals(t, types.BackchannelApproved, r.Status)
+			taken++
+		}
+	}
+	equals(t, 1, taken)
+}
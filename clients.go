@@ -0,0 +1,53 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package oauth2
+
+import (
+	"net/http"
+
+	"github.com/hooklift/oauth2/internal/render"
+	"github.com/hooklift/oauth2/types"
+)
+
+// authenticateClient authenticates the client making a request to the token or
+// revocation endpoints. Confidential clients authenticate using HTTP Basic
+// whereas public clients, having no credentials, only identify themselves
+// through the client_id parameter.
+// -- http://tools.ietf.org/html/rfc6749#section-3.2.1
+func authenticateClient(req *http.Request, cfg config) (types.Client, bool) {
+	provider := cfg.provider
+	if username, password, ok := req.BasicAuth(); ok {
+		cinfo, err := provider.AuthenticateClient(username, password)
+		if err != nil {
+			return types.Client{}, false
+		}
+		return cinfo, true
+	}
+
+	clientID := req.PostFormValue("client_id")
+	if clientID == "" {
+		return types.Client{}, false
+	}
+
+	cinfo, err := provider.ClientInfo(clientID)
+	if err != nil || cinfo.ID != clientID || !cinfo.Public() {
+		return types.Client{}, false
+	}
+	return cinfo, true
+}
+
+// invalidClient answers requests from clients that failed to authenticate,
+// asking them to use HTTP Basic if that is what they tried.
+// -- http://tools.ietf.org/html/rfc6749#section-5.2
+func invalidClient(w http.ResponseWriter, req *http.Request) {
+	if _, _, basic := req.BasicAuth(); basic {
+		w.Header().Set("WWW-Authenticate", "Basic")
+	}
+
+	render.JSON(w, render.Options{
+		Status: http.StatusUnauthorized,
+		Data:   ErrInvalidClient,
+	})
+}
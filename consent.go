@@ -0,0 +1,95 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package oauth2
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/hooklift/oauth2/types"
+)
+
+// hasPrompt returns whether the space-delimited prompt parameter includes value.
+// http://openid.net/specs/openid-connect-core-1_0.html#AuthRequest
+func hasPrompt(prompt, value string) bool {
+	for _, v := range strings.Fields(prompt) {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// consented returns whether the authorization request can be approved without
+// asking the resource owner, either because the client is a first-party one
+// or because the resource owner already consented to the requested scopes.
+func consented(req *http.Request, cfg config, authzData *AuthzData, prompt string) (bool, error) {
+	if hasPrompt(prompt, "consent") {
+		return false, nil
+	}
+
+	if authzData.Client.FirstParty {
+		return true, nil
+	}
+
+	if cfg.consent.store == nil {
+		return false, nil
+	}
+
+	session, err := userSession(req, cfg)
+	if err != nil || session.Subject == "" {
+		return false, err
+	}
+
+	consent, err := cfg.consent.store.Consent(session.Subject, authzData.Client.ID)
+	if err != nil {
+		return false, err
+	}
+
+	if !consent.ExpiresAt.IsZero() && consent.ExpiresAt.Before(time.Now()) {
+		return false, nil
+	}
+
+	return cfg.scopeMatcher.Covers(consent.Scopes, authzData.Scopes), nil
+}
+
+// saveConsent remembers the scopes approved by the resource owner, along with
+// the ones previously approved for the same client.
+func saveConsent(req *http.Request, cfg config, client types.Client, approved types.Scopes) error {
+	if cfg.consent.store == nil {
+		return nil
+	}
+
+	session, err := userSession(req, cfg)
+	if err != nil || session.Subject == "" {
+		return err
+	}
+
+	prev, err := cfg.consent.store.Consent(session.Subject, client.ID)
+	if err != nil {
+		return err
+	}
+
+	consent := types.Consent{
+		Subject:  session.Subject,
+		ClientID: client.ID,
+		Scopes:   approved,
+	}
+
+	if prev.ExpiresAt.IsZero() || prev.ExpiresAt.After(time.Now()) {
+		for _, s := range prev.Scopes {
+			if !cfg.scopeMatcher.Covers(consent.Scopes, types.Scopes{s}) {
+				consent.Scopes = append(consent.Scopes, s)
+			}
+		}
+	}
+
+	if cfg.consent.expiration > 0 {
+		consent.ExpiresAt = time.Now().Add(cfg.consent.expiration)
+	}
+
+	return cfg.consent.store.SaveConsent(consent)
+}
@@ -0,0 +1,93 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package oauth2
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+)
+
+// Name of the cookie holding the browser's CSRF secret.
+const csrfCookie = "oauth2_csrf"
+
+// csrfToken returns the CSRF token to embed in the authorization form, setting
+// the CSRF cookie if the browser does not have one yet.
+//
+// The authorization form is protected against cross-site request forgery
+// using a signed double-submit cookie: a random secret is stored in a cookie
+// when the form is displayed, and the form carries an HMAC of that secret along
+// with the authorization request parameters and the resource owner's identity.
+// Other sites can neither read the cookie nor compute the HMAC, so they are
+// unable to forge a valid authorization POST for a logged-in resource owner.
+// https://tools.ietf.org/html/rfc6819#section-4.4.1.8
+func csrfToken(w http.ResponseWriter, req *http.Request, cfg config, params map[string]string) (string, error) {
+	var secret string
+	if c, err := req.Cookie(csrfCookie); err == nil && c.Value != "" {
+		secret = c.Value
+	} else {
+		b := make([]byte, 32)
+		if _, err := rand.Read(b); err != nil {
+			return "", err
+		}
+		secret = base64.RawURLEncoding.EncodeToString(b)
+
+		http.SetCookie(w, &http.Cookie{
+			Name:     csrfCookie,
+			Value:    secret,
+			Path:     "/",
+			Secure:   true,
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+
+	return csrfMAC(req, cfg, params, secret)
+}
+
+// verifyCSRFToken checks the CSRF token posted along with the authorization form.
+func verifyCSRFToken(req *http.Request, cfg config, params map[string]string) bool {
+	c, err := req.Cookie(csrfCookie)
+	if err != nil || c.Value == "" {
+		return false
+	}
+
+	expected, err := csrfMAC(req, cfg, params, c.Value)
+	if err != nil {
+		return false
+	}
+
+	return hmac.Equal([]byte(expected), []byte(req.PostFormValue("csrf_token")))
+}
+
+func csrfMAC(req *http.Request, cfg config, params map[string]string, secret string) (string, error) {
+	session, err := userSession(req, cfg)
+	if err != nil {
+		return "", err
+	}
+
+	mac := hmac.New(sha256.New, cfg.csrfKey)
+	mac.Write([]byte(secret))
+	for _, v := range []string{
+		session.Subject,
+		params["client_id"],
+		params["redirect_uri"],
+		params["response_type"],
+		params["scope"],
+		params["state"],
+		params["code_challenge"],
+		params["code_challenge_method"],
+		params["response_mode"],
+		params["nonce"],
+		params["form"],
+	} {
+		mac.Write([]byte{0})
+		mac.Write([]byte(v))
+	}
+
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
@@ -7,6 +7,8 @@ package oauth2
 import (
 	"log"
 	"net/url"
+	"strconv"
+	"time"
 
 	"github.com/hooklift/oauth2/types"
 )
@@ -43,6 +45,86 @@ var (
 		Description: "You must provide an authorization header with your client credentials.",
 	}
 
+	ErrInvalidClient = types.AuthzError{
+		Code:        "invalid_client",
+		Description: "Client authentication failed.",
+	}
+
+	ErrUnauthorizedGrantType = types.AuthzError{
+		Code:        "unauthorized_client",
+		Description: "The authenticated client is not authorized to use this authorization grant type.",
+	}
+
+	ErrScopeNotAllowed = types.AuthzError{
+		Code:        "invalid_scope",
+		Description: "Requested scope exceeds the scope allowed for this client.",
+	}
+
+	ErrPublicClientGrantType = types.AuthzError{
+		Code:        "unauthorized_client",
+		Description: "Public clients are not allowed to use this authorization grant type.",
+	}
+
+	ErrQueryAccessToken = types.AuthzError{
+		Code:        "invalid_request",
+		Description: "Access tokens are not accepted in the URI query string.",
+	}
+
+	ErrInvalidCodeVerifier = types.AuthzError{
+		Code:        "invalid_grant",
+		Description: "Code verifier is missing or does not match the code challenge.",
+	}
+
+	ErrInvalidIDTokenHint = types.AuthzError{
+		Code:        "invalid_request",
+		Description: "ID token hint was not issued by this server or belongs to another resource owner.",
+	}
+
+	ErrPostLogoutRedirectURLMismatch = types.AuthzError{
+		Code:        "invalid_request",
+		Description: "Post-logout redirect URI does not match the URI registered for this client.",
+	}
+
+	ErrOpenIDScopeRequired = types.AuthzError{
+		Code:        "invalid_scope",
+		Description: "Backchannel authentication requests must include the openid scope.",
+	}
+
+	ErrLoginHintRequired = types.AuthzError{
+		Code:        "invalid_request",
+		Description: "login_hint parameter is required.",
+	}
+
+	ErrClientNotificationTokenRequired = types.AuthzError{
+		Code:        "invalid_request",
+		Description: "client_notification_token parameter and a registered notification endpoint are required for the ping and push delivery modes.",
+	}
+
+	ErrInvalidRequestedExpiry = types.AuthzError{
+		Code:        "invalid_request",
+		Description: "requested_expiry must be a positive number of seconds.",
+	}
+
+	ErrUnknownUserID = types.AuthzError{
+		Code:        "unknown_user_id",
+		Description: "login_hint does not identify a valid resource owner.",
+	}
+
+	ErrAuthorizationPending = types.AuthzError{
+		Code:        "authorization_pending",
+		Description: "The resource owner has not yet approved the authentication request.",
+	}
+
+	ErrSlowDown = types.AuthzError{
+		Code:        "slow_down",
+		Description: "The authentication request is still pending and polling interval must be increased by at least 5 seconds.",
+	}
+
+	ErrExpiredToken = types.AuthzError{
+		Code:        "expired_token",
+		Description: "auth_req_id has expired, the client must start a new authentication request.",
+	}
+
 	ErrUnsupportedGrantType = types.AuthzError{
 		Code:        "unsupported_grant_type",
 		Description: "grant_type provided is not supported by this authorization server.",
@@ -68,6 +150,21 @@ var (
 		Description: "Authenticated client did not generate token used.",
 	}
 
+	ErrInvalidCSRFToken = types.AuthzError{
+		Code:        "access_denied",
+		Description: "The authorization form expired or was not submitted from this site, please try again.",
+	}
+
+	ErrSessionRequired = types.AuthzError{
+		Code:        "login_required",
+		Description: "You must be logged in to manage your authorized applications.",
+	}
+
+	ErrTokenRequired = types.AuthzError{
+		Code:        "invalid_request",
+		Description: "token parameter is required.",
+	}
+
 	ErrUnsupportedTokenType = types.AuthzError{
 		Code:        "invalid_token",
 		Description: "Unsupported token type.",
@@ -92,21 +189,29 @@ var (
 // Encodes errors as query string values in accordance to http://tools.ietf.org/html/rfc6749#section-4.1.2.1
 func EncodeErrInURI(u *url.URL, err types.AuthzError) {
 	queryStr := u.Query()
-	queryStr.Set("error", err.Code)
+	for k, v := range errParams(err) {
+		queryStr[k] = v
+	}
+	u.RawQuery = queryStr.Encode()
+}
+
+// errParams returns the authorization error response parameters for err.
+func errParams(err types.AuthzError) url.Values {
+	params := url.Values{}
+	params.Set("error", err.Code)
 
 	if err.Description != "" {
-		queryStr.Set("error_description", err.Description)
+		params.Set("error_description", err.Description)
 	}
 
 	if err.State != "" {
-		queryStr.Set("state", err.State)
+		params.Set("state", err.State)
 	}
 
 	if err.URI != "" {
-		queryStr.Set("error_uri", err.URI)
+		params.Set("error_uri", err.URI)
 	}
-
-	u.RawQuery = queryStr.Encode()
+	return params
 }
 
 // Errors returned to 3rd-party client apps in accordance to spec.
@@ -118,6 +223,118 @@ func ErrUnsupportedResponseType(state string) types.AuthzError {
 	}
 }
 
+func ErrUnauthorizedResponseType(state string) types.AuthzError {
+	return types.AuthzError{
+		Code:        "unauthorized_client",
+		Description: "3rd-party client app is not authorized to request an authorization using this method.",
+		State:       state,
+	}
+}
+
+func ErrCodeChallengeRequired(state string) types.AuthzError {
+	return types.AuthzError{
+		Code:        "invalid_request",
+		Description: "3rd-party client app must send a PKCE code challenge.",
+		State:       state,
+	}
+}
+
+func ErrUnsupportedCodeChallengeMethod(state string) types.AuthzError {
+	return types.AuthzError{
+		Code:        "invalid_request",
+		Description: "Code challenge method is not supported.",
+		State:       state,
+	}
+}
+
+func ErrInvalidCodeChallenge(state string) types.AuthzError {
+	return types.AuthzError{
+		Code:        "invalid_request",
+		Description: "Code challenge must be between 43 and 128 unreserved characters.",
+		State:       state,
+	}
+}
+
+func ErrUnsupportedResponseMode(state string) types.AuthzError {
+	return types.AuthzError{
+		Code:        "invalid_request",
+		Description: "Response mode is not supported for this response type.",
+		State:       state,
+	}
+}
+
+func ErrNonceRequired(state string) types.AuthzError {
+	return types.AuthzError{
+		Code:        "invalid_request",
+		Description: "3rd-party client app must send a nonce when requesting ID tokens from the authorization endpoint.",
+		State:       state,
+	}
+}
+
+func ErrInvalidPrompt(state string) types.AuthzError {
+	return types.AuthzError{
+		Code:        "invalid_request",
+		Description: "Prompt parameter has unknown values or combines none with other values.",
+		State:       state,
+	}
+}
+
+func ErrInvalidMaxAge(state string) types.AuthzError {
+	return types.AuthzError{
+		Code:        "invalid_request",
+		Description: "Maximum authentication age must be a non-negative number of seconds.",
+		State:       state,
+	}
+}
+
+func ErrLoginRequired(state string) types.AuthzError {
+	return types.AuthzError{
+		Code:        "login_required",
+		Description: "Resource owner has to authenticate but the client asked not to display any user interface.",
+		State:       state,
+	}
+}
+
+func ErrConsentRequired(state string) types.AuthzError {
+	return types.AuthzError{
+		Code:        "consent_required",
+		Description: "Resource owner has to consent but the client asked not to display any user interface.",
+		State:       state,
+	}
+}
+
+func ErrInteractionRequired(state string) types.AuthzError {
+	return types.AuthzError{
+		Code:        "interaction_required",
+		Description: "Resource owner has to interact with the authorization server but the client asked not to display any user interface.",
+		State:       state,
+	}
+}
+
+func ErrUnmetAuthenticationRequirements(state string) types.AuthzError {
+	return types.AuthzError{
+		Code:        "unmet_authentication_requirements",
+		Description: "The authorization server is unable to meet the authentication requirements of the requested scopes.",
+		State:       state,
+	}
+}
+
+// ErrInsufficientUserAuthentication is returned by resource servers when the
+// resource owner has to authenticate again, or with a stronger method, in
+// accordance with https://tools.ietf.org/html/rfc9470#section-3
+func ErrInsufficientUserAuthentication(acr string, maxAge time.Duration) types.AuthzError {
+	e := types.AuthzError{
+		Code:        "insufficient_user_authentication",
+		Description: "A different authentication level is required to access this resource.",
+		ACRValues:   acr,
+	}
+
+	if maxAge > 0 {
+		e.MaxAge = strconv.FormatFloat(maxAge.Seconds(), 'f', 0, 64)
+	}
+	return e
+}
+
 func ErrStateRequired(state string) types.AuthzError {
 	return types.AuthzError{
 		Code:        "invalid_request",
@@ -134,6 +351,14 @@ func ErrScopeRequired(state string) types.AuthzError {
 	}
 }
 
+func ErrAccessDenied(state string) types.AuthzError {
+	return types.AuthzError{
+		Code:        "access_denied",
+		Description: "The resource owner denied the request.",
+		State:       state,
+	}
+}
+
 func ErrServerError(state string, err error) types.AuthzError {
 	log.Printf("[ERROR] Internal server error: %v", err)
 
@@ -40,12 +40,15 @@ func ExampleExamples_basic() {
 					{{end}}
 				</ul>
 			</div>
-			<form>
+			<form method="post">
 			 <input type="hidden" name="client_id" value="{{.Client.ID}}"/>
 			 <input type="hidden" name="response_type" value="{{.GrantType}}"/>
 			 <input type="hidden" name="redirect_uri" value="{{.Client.RedirectURL}}"/>
 			 <input type="hidden" name="scope" value="{{.Scopes.Encode}}"/>
 			 <input type="hidden" name="state" value="{{.State}}"/>
+			 <input type="hidden" name="csrf_token" value="{{.CSRFToken}}"/>
+			 <button type="submit" name="decision" value="approve">Approve</button>
+			 <button type="submit" name="decision" value="deny">Deny</button>
 			</form>
 		{{end}}
 		</body>
@@ -0,0 +1,306 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package jose implements the small subset of JSON Web Signature, JSON Web
+// Encryption and JSON Web Key needed by the authorization server, using only
+// the standard library.
+//
+// Supported algorithms are RS256 and ES256 for signing and RSA-OAEP-256 with
+// A256GCM for encryption.
+package jose
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"strings"
+)
+
+// Signing and encryption algorithms.
+const (
+	RS256       = "RS256"
+	ES256       = "ES256"
+	RSAOAEP256  = "RSA-OAEP-256"
+	A256GCM     = "A256GCM"
+	ecKeyLength = 32
+)
+
+// Errors
+var (
+	ErrUnsupportedKey = errors.New("jose: unsupported key type, only RSA and P-256 EC keys are supported")
+	ErrMalformed      = errors.New("jose: malformed token")
+	ErrSignature      = errors.New("jose: invalid signature")
+)
+
+var b64 = base64.RawURLEncoding
+
+// Algorithm returns the JWS algorithm used to sign with key.
+func Algorithm(key crypto.PublicKey) (string, error) {
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		return RS256, nil
+	case *ecdsa.PublicKey:
+		if k.Curve == elliptic.P256() {
+			return ES256, nil
+		}
+	}
+	return "", ErrUnsupportedKey
+}
+
+type header struct {
+	Alg string `json:"alg"`
+	Enc string `json:"enc,omitempty"`
+	Kid string `json:"kid,omitempty"`
+	Typ string `json:"typ,omitempty"`
+	Cty string `json:"cty,omitempty"`
+}
+
+// Sign serializes claims as JSON and signs them using key, returning a JWT in
+// compact serialization. The key identifier is sent in the kid header if not empty.
+func Sign(claims interface{}, kid string, key crypto.Signer) (string, error) {
+	return SignType(claims, kid, "JWT", key)
+}
+
+// SignType is like Sign but sends typ in the typ header, for JWTs that must
+// not be confused with other kinds of JWTs.
+// -- https://tools.ietf.org/html/rfc8725#section-3.11
+func SignType(claims interface{}, kid, typ string, key crypto.Signer) (string, error) {
+	alg, err := Algorithm(key.Public())
+	if err != nil {
+		return "", err
+	}
+
+	h, err := json.Marshal(header{Alg: alg, Kid: kid, Typ: typ})
+	if err != nil {
+		return "", err
+	}
+
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	input := b64.EncodeToString(h) + "." + b64.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(input))
+	sig, err := key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		return "", err
+	}
+
+	// ECDSA signers return ASN.1 DER signatures whereas JWS uses the
+	// concatenation of R and S.
+	// -- https://tools.ietf.org/html/rfc7518#section-3.4
+	if alg == ES256 {
+		var es struct{ R, S *big.Int }
+		if _, err := asn1.Unmarshal(sig, &es); err != nil {
+			return "", err
+		}
+		sig = make([]byte, 2*ecKeyLength)
+		es.R.FillBytes(sig[:ecKeyLength])
+		es.S.FillBytes(sig[ecKeyLength:])
+	}
+
+	return input + "." + b64.EncodeToString(sig), nil
+}
+
+// Verify checks the signature of a JWT in compact serialization with key,
+// returning its payload.
+func Verify(token string, key crypto.PublicKey) ([]byte, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrMalformed
+	}
+
+	var h header
+	if err := decodeJSON(parts[0], &h); err != nil {
+		return nil, err
+	}
+
+	sig, err := b64.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrMalformed
+	}
+
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if h.Alg != RS256 || rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], sig) != nil {
+			return nil, ErrSignature
+		}
+	case *ecdsa.PublicKey:
+		if h.Alg != ES256 || len(sig) != 2*ecKeyLength {
+			return nil, ErrSignature
+		}
+		r := new(big.Int).SetBytes(sig[:ecKeyLength])
+		s := new(big.Int).SetBytes(sig[ecKeyLength:])
+		if !ecdsa.Verify(k, digest[:], r, s) {
+			return nil, ErrSignature
+		}
+	default:
+		return nil, ErrUnsupportedKey
+	}
+
+	return b64.DecodeString(parts[1])
+}
+
+// Encrypt encrypts a nested JWT for the holder of key using RSA-OAEP-256 and
+// A256GCM, returning a JWE in compact serialization.
+func Encrypt(jwt string, kid string, key *rsa.PublicKey) (string, error) {
+	h, err := json.Marshal(header{Alg: RSAOAEP256, Enc: A256GCM, Kid: kid, Cty: "JWT"})
+	if err != nil {
+		return "", err
+	}
+
+	cek := make([]byte, 32)
+	if _, err := rand.Read(cek); err != nil {
+		return "", err
+	}
+
+	encryptedKey, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, key, cek, nil)
+	if err != nil {
+		return "", err
+	}
+
+	gcm, err := newGCM(cek)
+	if err != nil {
+		return "", err
+	}
+
+	iv := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(iv); err != nil {
+		return "", err
+	}
+
+	protected := b64.EncodeToString(h)
+	sealed := gcm.Seal(nil, iv, []byte(jwt), []byte(protected))
+	ciphertext, tag := sealed[:len(sealed)-gcm.Overhead()], sealed[len(sealed)-gcm.Overhead():]
+
+	return strings.Join([]string{
+		protected,
+		b64.EncodeToString(encryptedKey),
+		b64.EncodeToString(iv),
+		b64.EncodeToString(ciphertext),
+		b64.EncodeToString(tag),
+	}, "."), nil
+}
+
+// Decrypt decrypts a JWE in compact serialization produced by Encrypt,
+// returning the nested JWT.
+func Decrypt(token string, key *rsa.PrivateKey) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 5 {
+		return "", ErrMalformed
+	}
+
+	var h header
+	if err := decodeJSON(parts[0], &h); err != nil {
+		return "", err
+	}
+
+	if h.Alg != RSAOAEP256 || h.Enc != A256GCM {
+		return "", ErrMalformed
+	}
+
+	var values [4][]byte
+	for i, p := range parts[1:] {
+		v, err := b64.DecodeString(p)
+		if err != nil {
+			return "", ErrMalformed
+		}
+		values[i] = v
+	}
+
+	cek, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, key, values[0], nil)
+	if err != nil {
+		return "", err
+	}
+
+	gcm, err := newGCM(cek)
+	if err != nil {
+		return "", err
+	}
+
+	if len(values[1]) != gcm.NonceSize() {
+		return "", ErrMalformed
+	}
+
+	plaintext, err := gcm.Open(nil, values[1], append(values[2], values[3]...), []byte(parts[0]))
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func decodeJSON(part string, v interface{}) error {
+	data, err := b64.DecodeString(part)
+	if err != nil {
+		return ErrMalformed
+	}
+
+	if err := json.Unmarshal(data, v); err != nil {
+		return ErrMalformed
+	}
+	return nil
+}
+
+// JWK represents a public JSON Web Key, as described in
+// https://tools.ietf.org/html/rfc7517
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid,omitempty"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// JWKS represents a JSON Web Key Set.
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// PublicJWK returns the JSON Web Key used to verify signatures made with the
+// private counterpart of key.
+func PublicJWK(kid string, key crypto.PublicKey) (JWK, error) {
+	alg, err := Algorithm(key)
+	if err != nil {
+		return JWK{}, err
+	}
+
+	jwk := JWK{Kid: kid, Use: "sig", Alg: alg}
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		jwk.Kty = "RSA"
+		jwk.N = b64.EncodeToString(k.N.Bytes())
+		jwk.E = b64.EncodeToString(big.NewInt(int64(k.E)).Bytes())
+	case *ecdsa.PublicKey:
+		x, y := make([]byte, ecKeyLength), make([]byte, ecKeyLength)
+		jwk.Kty = "EC"
+		jwk.Crv = "P-256"
+		jwk.X = b64.EncodeToString(k.X.FillBytes(x))
+		jwk.Y = b64.EncodeToString(k.Y.FillBytes(y))
+	}
+	return jwk, nil
+}
@@ -0,0 +1,73 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package jose
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"testing"
+)
+
+func TestSignVerify(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []crypto.Signer{rsaKey, ecKey} {
+		token, err := Sign(map[string]string{"sub": "test_user"}, "key-1", key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		payload, err := Verify(token, key.Public())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		claims := map[string]string{}
+		if err := json.Unmarshal(payload, &claims); err != nil {
+			t.Fatal(err)
+		}
+
+		if claims["sub"] != "test_user" {
+			t.Errorf("unexpected claims: %v", claims)
+		}
+
+		if _, err := Verify(token[:len(token)-4]+"AAAA", key.Public()); err == nil {
+			t.Errorf("tampered signature was verified")
+		}
+	}
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := Encrypt("nested.jwt.value", "enc-1", &key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nested, err := Decrypt(token, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if nested != "nested.jwt.value" {
+		t.Errorf("unexpected nested JWT: %s", nested)
+	}
+}
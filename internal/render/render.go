@@ -11,6 +11,7 @@ import (
 	"html/template"
 	"log"
 	"net/http"
+	"net/url"
 	"strconv"
 	"time"
 
@@ -122,3 +123,31 @@ func Unauthorized(w http.ResponseWriter, opts Options) {
 	w.WriteHeader(opts.Status)
 	w.Write([]byte(""))
 }
+
+var formPostTmpl = template.Must(template.New("form_post").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Submit This Form</title></head>
+<body onload="document.forms[0].submit()">
+<form method="post" action="{{.Action}}">
+{{range $name, $values := .Params}}{{range $values}}<input type="hidden" name="{{$name}}" value="{{.}}"/>
+{{end}}{{end}}<noscript><button type="submit">Continue</button></noscript>
+</form>
+</body>
+</html>`))
+
+// FormPost renders an HTML form that auto-submits opts.Data, expected to be
+// url.Values, to action using the POST method. In accordance with
+// http://openid.net/specs/oauth-v2-form-post-response-mode-1_0.html
+func FormPost(w http.ResponseWriter, opts Options, action string) error {
+	params, ok := opts.Data.(url.Values)
+	if !ok {
+		return errors.New("Form post data must be url.Values")
+	}
+
+	opts.Template = formPostTmpl
+	opts.Data = struct {
+		Action string
+		Params url.Values
+	}{action, params}
+	return HTML(w, opts)
+}
@@ -0,0 +1,97 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package oauth2
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/hooklift/oauth2/internal/jose"
+	"github.com/hooklift/oauth2/providers/test"
+)
+
+// TestJWTSecuredResponses tests that authorization responses are delivered
+// as signed, and optionally encrypted, JWTs.
+func TestJWTSecuredResponses(t *testing.T) {
+	signingKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ok(t, err)
+
+	cfg := setupTest()
+	provider := test.NewProvider(true)
+	cfg.provider = provider
+	SetIssuer("https://example.com")(&cfg)
+	SetSigningKeys(SigningKey{ID: "key-1", Key: signingKey})(&cfg)
+
+	values := url.Values{
+		"client_id":     {provider.Client.ID},
+		"response_type": {"code"},
+		"response_mode": {"jwt"},
+		"state":         {"state-test"},
+		"redirect_uri":  {provider.Client.RedirectURL.String()},
+		"scope":         {"read"},
+		"decision":      {"approve"},
+	}
+
+	w := authzPostTest(t, cfg, values)
+	equals(t, http.StatusFound, w.Code)
+
+	u, err := url.Parse(w.Header().Get("Location"))
+	ok(t, err)
+	equals(t, 1, len(u.Query()))
+
+	payload, err := jose.Verify(u.Query().Get("response"), &signingKey.PublicKey)
+	ok(t, err)
+
+	claims := map[string]interface{}{}
+	ok(t, json.Unmarshal(payload, &claims))
+	equals(t, "https://example.com", claims["iss"])
+	equals(t, provider.Client.ID, claims["aud"])
+	equals(t, "state-test", claims["state"])
+	assert(t, claims["code"] != "", "we were expecting an authorization code: %v", claims)
+
+	// Encrypts responses for clients with a registered encryption key.
+	encryptionKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	ok(t, err)
+	provider.Client.AuthzEncryptionKey = &encryptionKey.PublicKey
+
+	values.Set("response_mode", "fragment.jwt")
+	values.Set("decision", "deny")
+	w = authzPostTest(t, cfg, values)
+	equals(t, http.StatusFound, w.Code)
+
+	u, err = url.Parse(w.Header().Get("Location"))
+	ok(t, err)
+	fragment, err := url.ParseQuery(u.Fragment)
+	ok(t, err)
+
+	nested, err := jose.Decrypt(fragment.Get("response"), encryptionKey)
+	ok(t, err)
+	payload, err = jose.Verify(nested, &signingKey.PublicKey)
+	ok(t, err)
+
+	claims = map[string]interface{}{}
+	ok(t, json.Unmarshal(payload, &claims))
+	equals(t, "access_denied", claims["error"])
+
+	// Publishes the public key clients verify responses with.
+	req, err := http.NewRequest("GET", "https://example.com/oauth2/jwks", nil)
+	ok(t, err)
+	w = httptest.NewRecorder()
+	PublishKeys(w, req, cfg)
+	equals(t, http.StatusOK, w.Code)
+
+	jwks := jose.JWKS{}
+	ok(t, json.Unmarshal(w.Body.Bytes(), &jwks))
+	equals(t, 1, len(jwks.Keys))
+	equals(t, "key-1", jwks.Keys[0].Kid)
+	equals(t, "ES256", jwks.Keys[0].Alg)
+}
@@ -0,0 +1,73 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package oauth2
+
+import (
+	"crypto"
+	"errors"
+	"net/http"
+
+	"github.com/hooklift/oauth2/internal/jose"
+	"github.com/hooklift/oauth2/internal/render"
+)
+
+// SigningKey is a private key the authorization server signs JWTs with.
+type SigningKey struct {
+	// Key identifier, sent in the "kid" header of signed JWTs.
+	ID string
+	// Private key, either RSA or ECDSA using the P-256 curve. Keys held by
+	// hardware security modules can be used through crypto.Signer.
+	Key crypto.Signer
+}
+
+// JWKSHandlers is a map to functions where each function handles a particular HTTP
+// verb or method.
+var JWKSHandlers map[string]func(http.ResponseWriter, *http.Request, config) = map[string]func(http.ResponseWriter, *http.Request, config){
+	"GET": PublishKeys,
+}
+
+// PublishKeys sends back the public keys clients need to verify JWTs signed
+// by the authorization server, as a JSON Web Key Set.
+func PublishKeys(w http.ResponseWriter, req *http.Request, cfg config) {
+	jwks := jose.JWKS{Keys: []jose.JWK{}}
+	for _, k := range cfg.signingKeys {
+		jwk, err := jose.PublicJWK(k.ID, k.Key.Public())
+		if err != nil {
+			render.JSON(w, render.Options{
+				Status: http.StatusInternalServerError,
+				Data:   ErrServerError("", err),
+			})
+			return
+		}
+		jwks.Keys = append(jwks.Keys, jwk)
+	}
+
+	render.JSON(w, render.Options{
+		Status: http.StatusOK,
+		Data:   jwks,
+		Cache:  true,
+	})
+}
+
+// signJWT signs claims with the server key using alg or, if alg is empty,
+// with the first configured key.
+func signJWT(cfg config, alg string, claims interface{}) (string, error) {
+	return signTypedJWT(cfg, alg, "JWT", claims)
+}
+
+// signTypedJWT is like signJWT but sets the typ header to typ.
+func signTypedJWT(cfg config, alg, typ string, claims interface{}) (string, error) {
+	for _, k := range cfg.signingKeys {
+		keyAlg, err := jose.Algorithm(k.Key.Public())
+		if err != nil {
+			return "", err
+		}
+
+		if alg == "" || alg == keyAlg {
+			return jose.SignType(claims, k.ID, typ, k.Key)
+		}
+	}
+	return "", errors.New("no signing key found for algorithm " + alg)
+}
@@ -0,0 +1,401 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package oauth2
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/hooklift/oauth2/types"
+)
+
+// LineageStore keeps track of which tokens were derived from which
+// authorization codes and tokens. It allows revoking every token issued from
+// an authorization code when the code is used more than once, as recommended
+// by http://tools.ietf.org/html/rfc6749#section-4.1.2
+type LineageStore interface {
+	// SaveLineage stores or replaces a lineage record.
+	SaveLineage(record types.LineageRecord) error
+
+	// Lineage returns the lineage record of a code or token. A zero value is
+	// returned if there is none.
+	Lineage(value string) (types.LineageRecord, error)
+
+	// Derived returns the records of codes or tokens directly derived from value.
+	Derived(value string) ([]types.LineageRecord, error)
+
+	// Supersede stores record, whose SupersededAt is set, unless the stored
+	// record of the same refresh token was already superseded, in which case
+	// false is returned. The check and the update must be atomic, so
+	// concurrent requests can't both rotate the same refresh token.
+	Supersede(record types.LineageRecord) (bool, error)
+}
+
+// memoryLineage is an in-memory LineageStore.
+type memoryLineage struct {
+	sync.Mutex
+	retention time.Duration
+	lastPrune time.Time
+	records   map[string]types.LineageRecord
+	derived   map[string][]string
+}
+
+// NewMemoryLineageStore returns a LineageStore keeping records in memory for
+// the given retention period since they were last used, or longer if their
+// RetainUntil requires it. It is only suitable for single instance
+// deployments, since records are not shared between processes. Records are
+// lost on restart, so reuse of refresh tokens rotated before then is not
+// detected.
+func NewMemoryLineageStore(retention time.Duration) LineageStore {
+	return &memoryLineage{
+		retention: retention,
+		lastPrune: time.Now(),
+		records:   make(map[string]types.LineageRecord),
+		derived:   make(map[string][]string),
+	}
+}
+
+func (m *memoryLineage) SaveLineage(record types.LineageRecord) error {
+	m.Lock()
+	defer m.Unlock()
+
+	m.prune()
+	m.save(record)
+	return nil
+}
+
+func (m *memoryLineage) Supersede(record types.LineageRecord) (bool, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	m.prune()
+	if r, ok := m.records[record.Value]; ok && !r.SupersededAt.IsZero() {
+		return false, nil
+	}
+	m.save(record)
+	return true, nil
+}
+
+// unindex removes record from the values derived from its parent.
+func (m *memoryLineage) unindex(record types.LineageRecord) {
+	derived := m.derived[record.Parent]
+	for i, v := range derived {
+		if v == record.Value {
+			derived = append(derived[:i], derived[i+1:]...)
+			break
+		}
+	}
+
+	if len(derived) == 0 {
+		delete(m.derived, record.Parent)
+		return
+	}
+	m.derived[record.Parent] = derived
+}
+
+// save stores record, indexing it under its parent if it is new.
+func (m *memoryLineage) save(record types.LineageRecord) {
+	if _, ok := m.records[record.Value]; !ok && record.Parent != "" {
+		m.derived[record.Parent] = append(m.derived[record.Parent], record.Value)
+	}
+	m.records[record.Value] = record
+}
+
+func (m *memoryLineage) Lineage(value string) (types.LineageRecord, error) {
+	m.Lock()
+	defer m.Unlock()
+	return m.records[value], nil
+}
+
+func (m *memoryLineage) Derived(value string) ([]types.LineageRecord, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	var records []types.LineageRecord
+	for _, v := range m.derived[value] {
+		if r, ok := m.records[v]; ok {
+			records = append(records, r)
+		}
+	}
+	return records, nil
+}
+
+// prune forgets records unused for longer than the retention period, unless
+// they have to be retained longer, at most once a minute.
+func (m *memoryLineage) prune() {
+	now := time.Now()
+	if m.retention <= 0 || now.Sub(m.lastPrune) < time.Minute {
+		return
+	}
+	m.lastPrune = now
+
+	for k, r := range m.records {
+		lastUsed := r.CreatedAt
+		for _, t := range []time.Time{r.LastUsedAt, r.SupersededAt} {
+			if t.After(lastUsed) {
+				lastUsed = t
+			}
+		}
+
+		if now.Sub(lastUsed) > m.retention && now.After(r.RetainUntil) {
+			delete(m.records, k)
+			delete(m.derived, k)
+			m.unindex(r)
+		}
+	}
+}
+
+// link records values as derived from parent, belonging to the same token
+// family. Failures are logged since they must not prevent issuing tokens.
+func link(cfg config, parent string, cinfo types.Client, values ...string) {
+	if cfg.lineage == nil {
+		return
+	}
+
+	now := time.Now()
+	issuedAt := now
+	if parent != "" {
+		record, err := cfg.lineage.Lineage(parent)
+		if err != nil {
+			log.Printf("[ERROR] Error getting lineage of %s: %v", cinfo.ID, err)
+		}
+
+		if !record.IssuedAt.IsZero() {
+			issuedAt = record.IssuedAt
+		}
+	}
+
+	for _, v := range values {
+		if v == "" {
+			continue
+		}
+
+		err := cfg.lineage.SaveLineage(types.LineageRecord{
+			Value:       v,
+			Parent:      parent,
+			ClientID:    cinfo.ID,
+			CreatedAt:   now,
+			IssuedAt:    issuedAt,
+			RetainUntil: retainUntil(cfg, cinfo, issuedAt, now),
+		})
+		if err != nil {
+			log.Printf("[ERROR] Error saving lineage of %s: %v", cinfo.ID, err)
+		}
+	}
+}
+
+// refreshTokenLifetimes returns the lifetime and idle timeout of the client's
+// refresh tokens, zero meaning no limit.
+func refreshTokenLifetimes(cfg config, cinfo types.Client) (time.Duration, time.Duration) {
+	lifetime, idleTimeout := cfg.refreshToken.lifetime, cfg.refreshToken.idleTimeout
+	if cinfo.RefreshTokenLifetime > 0 {
+		lifetime = cinfo.RefreshTokenLifetime
+	}
+
+	if cinfo.RefreshTokenIdleTimeout > 0 {
+		idleTimeout = cinfo.RefreshTokenIdleTimeout
+	}
+	return lifetime, idleTimeout
+}
+
+// retainUntil returns until when the lineage record of a token has to be
+// kept for its refresh token lifetimes to be enforced.
+func retainUntil(cfg config, cinfo types.Client, issuedAt, lastUsed time.Time) time.Time {
+	lifetime, idleTimeout := refreshTokenLifetimes(cfg, cinfo)
+
+	var t time.Time
+	if lifetime > 0 {
+		t = issuedAt.Add(lifetime)
+	}
+
+	if idleTimeout > 0 && lastUsed.Add(idleTimeout).After(t) {
+		t = lastUsed.Add(idleTimeout)
+	}
+	return t
+}
+
+// revokeDerived revokes every token transitively derived from value,
+// returning the number of tokens revoked.
+func revokeDerived(cfg config, value string) (int, error) {
+	if cfg.lineage == nil {
+		return 0, nil
+	}
+
+	revoked := 0
+	pending := []string{value}
+	seen := map[string]bool{value: true}
+	for len(pending) > 0 {
+		records, err := cfg.lineage.Derived(pending[0])
+		if err != nil {
+			return revoked, err
+		}
+		pending = pending[1:]
+
+		for _, r := range records {
+			if seen[r.Value] {
+				continue
+			}
+			seen[r.Value] = true
+			pending = append(pending, r.Value)
+
+			if err := cfg.provider.RevokeToken(r.Value); err != nil {
+				return revoked, err
+			}
+			revoked++
+		}
+	}
+	return revoked, nil
+}
+
+// familyRoot returns the authorization code or token from which value was
+// originally derived.
+func familyRoot(cfg config, value string) (string, error) {
+	root := value
+	seen := map[string]bool{value: true}
+	for {
+		record, err := cfg.lineage.Lineage(root)
+		if err != nil {
+			return root, err
+		}
+
+		if record.Parent == "" || seen[record.Parent] {
+			return root, nil
+		}
+		seen[record.Parent] = true
+		root = record.Parent
+	}
+}
+
+// revokeFamily revokes the whole family of refresh and access tokens value
+// belongs to, returning the number of tokens revoked. The family root is only
+// revoked if it is a token, authorization codes are already used by then.
+func revokeFamily(cfg config, value string) (int, error) {
+	root, err := familyRoot(cfg, value)
+	if err != nil {
+		return 0, err
+	}
+
+	revoked, err := revokeDerived(cfg, root)
+	if err != nil {
+		return revoked, err
+	}
+
+	token, err := lookupToken(cfg, root)
+	if err != nil {
+		return revoked, err
+	}
+
+	if token.Value != root && token.RefreshToken != root {
+		return revoked, nil
+	}
+
+	if err := cfg.provider.RevokeToken(root); err != nil {
+		return revoked, err
+	}
+	return revoked + 1, nil
+}
+
+// expiredRefreshToken returns whether the refresh token exceeded its idle
+// timeout or the lifetime of the token family it belongs to. Refresh tokens
+// without lineage record are considered expired if lifetimes apply, since
+// they can't be enforced.
+func expiredRefreshToken(cfg config, cinfo types.Client, record types.LineageRecord) bool {
+	lifetime, idleTimeout := refreshTokenLifetimes(cfg, cinfo)
+	if lifetime <= 0 && idleTimeout <= 0 {
+		return false
+	}
+
+	if record.Value == "" {
+		return true
+	}
+
+	if idleTimeout > 0 {
+		lastUsed := record.CreatedAt
+		if record.LastUsedAt.After(lastUsed) {
+			lastUsed = record.LastUsedAt
+		}
+
+		if time.Since(lastUsed) > idleTimeout {
+			return true
+		}
+	}
+
+	if lifetime > 0 {
+		issuedAt := record.IssuedAt
+		if issuedAt.IsZero() {
+			issuedAt = record.CreatedAt
+		}
+
+		if time.Since(issuedAt) > lifetime {
+			return true
+		}
+	}
+	return false
+}
+
+// markSuperseded atomically marks a refresh token as rotated before new
+// tokens are issued in exchange for it, returning the marked record. It
+// returns false if a concurrent request already rotated it.
+func markSuperseded(cfg config, refreshToken string, cinfo types.Client, record types.LineageRecord) (types.LineageRecord, bool, error) {
+	now := time.Now()
+	if record.Value == "" {
+		record = types.LineageRecord{
+			Value:     refreshToken,
+			ClientID:  cinfo.ID,
+			CreatedAt: now,
+			IssuedAt:  now,
+		}
+	}
+	record.SupersededAt = now
+
+	marked, err := cfg.lineage.Supersede(record)
+	return record, marked, err
+}
+
+// unmarkSuperseded lifts the mark set by markSuperseded when the refresh token
+// ended up not being rotated, recording its last use if it was used.
+func unmarkSuperseded(cfg config, cinfo types.Client, record types.LineageRecord, used bool) {
+	record.SupersededAt = time.Time{}
+	if used {
+		record.LastUsedAt = time.Now()
+		record.RetainUntil = retainUntil(cfg, cinfo, record.IssuedAt, record.LastUsedAt)
+	}
+
+	if err := cfg.lineage.SaveLineage(record); err != nil {
+		log.Printf("[ERROR] Error saving lineage of refresh token: %v", err)
+	}
+}
+
+// supersede records the tokens issued in exchange for a refresh token marked
+// by markSuperseded. If the provider did not rotate it, the mark is lifted and
+// its last use is recorded instead.
+func supersede(cfg config, refreshToken string, cinfo types.Client, record types.LineageRecord, newToken types.Token) {
+	if cfg.lineage == nil {
+		return
+	}
+
+	if newToken.RefreshToken == refreshToken {
+		unmarkSuperseded(cfg, cinfo, record, true)
+		link(cfg, refreshToken, cinfo, newToken.Value)
+		return
+	}
+	link(cfg, refreshToken, cinfo, newToken.Value, newToken.RefreshToken)
+}
+
+// audit reports a security relevant event.
+func audit(cfg config, event types.AuditEvent) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+
+	if cfg.auditLogger != nil {
+		cfg.auditLogger(event)
+		return
+	}
+
+	log.Printf("[WARN] %s: %s Client: %s, revoked tokens: %d", event.Type,
+		event.Description, event.ClientID, event.RevokedTokens)
+}
@@ -0,0 +1,265 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package oauth2
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/hooklift/oauth2/internal/render"
+	"github.com/hooklift/oauth2/types"
+)
+
+// Name of the cookie holding the resource owner's session when the built-in
+// login is enabled.
+const sessionCookie = "oauth2_session"
+
+// LoginData defines properties used to render the login form shown by the
+// authorization endpoint when the built-in login is enabled, see SetLoginForm.
+//
+// The form is expected to be posted back to the current URL with "username",
+// "password" and "csrf_token" fields. Once the resource owner is
+// authenticated, the authorization request is resumed.
+type LoginData struct {
+	// Client the resource owner is logging in for.
+	Client types.Client
+	// Hint about the login identifier the resource owner might use, as sent
+	// by the client in the "login_hint" parameter.
+	LoginHint string
+	// CSRF token protecting the login form, it must be posted back in a
+	// "csrf_token" field.
+	CSRFToken string
+	// List of errors to display to the resource owner.
+	Errors []types.AuthzError
+}
+
+// LoginProvider is implemented by providers backing the built-in login, see
+// SetLoginForm.
+type LoginProvider interface {
+	// LoginUser authenticates the resource owner with the credentials posted
+	// through the login form. It returns their session, whose Subject must
+	// be a stable identifier that does not depend on how the username was
+	// typed. A session with an empty Subject is returned if the credentials
+	// are invalid.
+	LoginUser(username, password string) (types.Session, error)
+}
+
+// sessionClaims is the content of the encrypted session cookie.
+type sessionClaims struct {
+	Subject  string `json:"sub"`
+	AuthTime int64  `json:"auth_time"`
+	ACR      string `json:"acr,omitempty"`
+	Expires  int64  `json:"exp"`
+}
+
+// builtinLogin returns whether the library authenticates resource owners
+// itself instead of relying on the provider's sessions.
+func builtinLogin(cfg config) bool {
+	return cfg.login.form != nil
+}
+
+// sessionsAvailable returns whether resource owners' sessions can be
+// identified, either through the built-in login or the provider.
+func sessionsAvailable(cfg config) bool {
+	_, ok := cfg.provider.(SessionProvider)
+	return ok || builtinLogin(cfg)
+}
+
+// authenticated returns whether the resource owner making the request has a
+// valid session.
+func authenticated(cfg config, session types.Session) bool {
+	if builtinLogin(cfg) {
+		return session.Subject != ""
+	}
+	return cfg.provider.IsUserAuthenticated()
+}
+
+// loginRequest returns whether the request is a post of the built-in login form.
+func loginRequest(req *http.Request, cfg config) bool {
+	return builtinLogin(cfg) && req.Method == "POST" && req.PostFormValue("username") != ""
+}
+
+// renderLogin displays the built-in login form.
+func renderLogin(w http.ResponseWriter, req *http.Request, cfg config, authzData *AuthzData, params map[string]string, errs ...types.AuthzError) {
+	data := LoginData{
+		Client:    authzData.Client,
+		LoginHint: authzData.LoginHint,
+		Errors:    errs,
+	}
+
+	var err error
+	data.CSRFToken, err = csrfToken(w, req, cfg, loginParams(params))
+	if err != nil {
+		data.Errors = append(data.Errors, ErrServerError("", err))
+	}
+
+	status := http.StatusOK
+	if len(errs) > 0 {
+		status = http.StatusUnauthorized
+	}
+
+	render.HTML(w, render.Options{
+		Status:    status,
+		Data:      data,
+		Template:  cfg.login.form,
+		STSMaxAge: cfg.stsMaxAge,
+	})
+}
+
+// login authenticates the resource owner with the credentials posted through
+// the built-in login form, starting a session and resuming the authorization
+// request if they are valid. Resource owners whose login still falls short
+// of the authentication requirements of the requested scopes are sent back to
+// the client with an error, instead of being shown the login form again.
+func login(w http.ResponseWriter, req *http.Request, cfg config, authzData *AuthzData, params map[string]string) {
+	if !verifyCSRFToken(req, cfg, loginParams(params)) {
+		renderLogin(w, req, cfg, authzData, params, ErrInvalidCSRFToken)
+		return
+	}
+
+	session, err := cfg.provider.(LoginProvider).LoginUser(req.PostFormValue("username"), req.PostFormValue("password"))
+	if err != nil {
+		renderLogin(w, req, cfg, authzData, params, ErrServerError("", err))
+		return
+	}
+
+	if session.Subject == "" {
+		renderLogin(w, req, cfg, authzData, params, ErrUnathorizedUser)
+		return
+	}
+
+	session.AuthTime = time.Now()
+	if err := setSessionCookie(w, cfg, session); err != nil {
+		renderLogin(w, req, cfg, authzData, params, ErrServerError("", err))
+		return
+	}
+
+	if _, _, required := stepUpRequired(cfg, session, authzData.Scopes); required {
+		redirectErr(w, req, cfg, authzData.Client, authzData.responseMode, ErrUnmetAuthenticationRequirements(authzData.State))
+		return
+	}
+
+	http.Redirect(w, req, resumeURL(req, authzData, params).String(), http.StatusSeeOther)
+}
+
+// loginParams binds CSRF tokens to the login form, so they can't be replayed
+// to approve authorization requests.
+func loginParams(params map[string]string) map[string]string {
+	p := make(map[string]string, len(params)+1)
+	for k, v := range params {
+		p[k] = v
+	}
+	p["form"] = "login"
+	return p
+}
+
+// setSessionCookie issues the session cookie, encrypted and authenticated with
+// AES-GCM so resource owners can neither read nor forge it.
+func setSessionCookie(w http.ResponseWriter, cfg config, session types.Session) error {
+	claims, err := json.Marshal(sessionClaims{
+		Subject:  session.Subject,
+		AuthTime: session.AuthTime.Unix(),
+		ACR:      session.ACR,
+		Expires:  session.AuthTime.Add(cfg.login.lifetime).Unix(),
+	})
+	if err != nil {
+		return err
+	}
+
+	aead, err := sessionCipher(cfg)
+	if err != nil {
+		return err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    base64.RawURLEncoding.EncodeToString(aead.Seal(nonce, nonce, claims, []byte(sessionCookie))),
+		Path:     "/",
+		Expires:  session.AuthTime.Add(cfg.login.lifetime),
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+// clearSessionCookie removes the session cookie from the browser.
+func clearSessionCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Path:     "/",
+		MaxAge:   -1,
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// cookieSession returns the session stored in the session cookie. A zero
+// session is returned if there is no valid session cookie.
+func cookieSession(req *http.Request, cfg config) (types.Session, error) {
+	c, err := req.Cookie(sessionCookie)
+	if err != nil || c.Value == "" {
+		return types.Session{}, nil
+	}
+
+	sealed, err := base64.RawURLEncoding.DecodeString(c.Value)
+	if err != nil {
+		return types.Session{}, nil
+	}
+
+	aead, err := sessionCipher(cfg)
+	if err != nil {
+		return types.Session{}, err
+	}
+
+	if len(sealed) < aead.NonceSize() {
+		return types.Session{}, nil
+	}
+
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	payload, err := aead.Open(nil, nonce, ciphertext, []byte(sessionCookie))
+	if err != nil {
+		return types.Session{}, nil
+	}
+
+	var claims sessionClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return types.Session{}, nil
+	}
+
+	if time.Now().Unix() >= claims.Expires {
+		return types.Session{}, nil
+	}
+
+	return types.Session{
+		Subject:  claims.Subject,
+		AuthTime: time.Unix(claims.AuthTime, 0),
+		ACR:      claims.ACR,
+	}, nil
+}
+
+func sessionCipher(cfg config) (cipher.AEAD, error) {
+	if len(cfg.login.key) != 32 {
+		return nil, errors.New("session key must be 32 bytes long")
+	}
+
+	block, err := aes.NewCipher(cfg.login.key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,200 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package oauth2
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hooklift/oauth2/providers/test"
+	"github.com/hooklift/oauth2/types"
+)
+
+// TestBuiltinLogin tests authenticating resource owners through the built-in
+// login form and resuming their authorization request.
+func TestBuiltinLogin(t *testing.T) {
+	cfg := setupTest()
+	cfg.provider = test.NewProvider(false)
+	SetLoginForm(`
+		{{range .Errors}}<p>{{.Code}}: {{.Description}}</p>{{end}}
+		<form method="post">
+			<input type="text" name="username" value="{{.LoginHint}}"/>
+			<input type="password" name="password"/>
+			<input type="hidden" name="csrf_token" value="{{.CSRFToken}}"/>
+		</form>
+	`)(&cfg)
+	SetSessionKey(bytes.Repeat([]byte("k"), 32), time.Duration(1)*time.Hour)(&cfg)
+
+	query := url.Values{
+		"client_id":     {"test_client_id"},
+		"response_type": {"code"},
+		"redirect_uri":  {"https://example.com/oauth2/callback"},
+		"scope":         {"read"},
+		"state":         {"state-test"},
+		"login_hint":    {"test_user"},
+	}
+	authzURL := "https://example.com/oauth2/authzs?" + query.Encode()
+
+	req, err := http.NewRequest("GET", authzURL, nil)
+	ok(t, err)
+	w := httptest.NewRecorder()
+	CreateGrant(w, req, cfg)
+	equals(t, http.StatusOK, w.Code)
+	assert(t, strings.Contains(w.Body.String(), `name="username" value="test_user"`), "login form not rendered: %s", w.Body.String())
+
+	m := csrfTokenRe.FindStringSubmatch(w.Body.String())
+	assert(t, m != nil, "CSRF token was not found in login form: %s", w.Body.String())
+	cookies := w.Result().Cookies()
+
+	loginPost := func(values url.Values) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("POST", authzURL, strings.NewReader(values.Encode()))
+		ok(t, err)
+		req.Header.Set("Content-type", "application/x-www-form-urlencoded")
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+
+		w := httptest.NewRecorder()
+		CreateGrant(w, req, cfg)
+		return w
+	}
+
+	w = loginPost(url.Values{"username": {"test_user"}, "password": {"test_password"}, "csrf_token": {"forged"}})
+	equals(t, http.StatusUnauthorized, w.Code)
+	assert(t, strings.Contains(w.Body.String(), ErrInvalidCSRFToken.Description), "unexpected response: %s", w.Body.String())
+
+	w = loginPost(url.Values{"username": {"test_user"}, "password": {"wrong_password"}, "csrf_token": {m[1]}})
+	equals(t, http.StatusUnauthorized, w.Code)
+	assert(t, strings.Contains(w.Body.String(), ErrUnathorizedUser.Description), "unexpected response: %s", w.Body.String())
+
+	// Login tokens can't be used to approve authorization requests.
+	w = loginPost(url.Values{"decision": {"approve"}, "csrf_token": {m[1]}})
+	equals(t, http.StatusOK, w.Code)
+	assert(t, w.Header().Get("Location") == "", "authorization should not have been granted")
+
+	w = loginPost(url.Values{"username": {" Test_User "}, "password": {"test_password"}, "csrf_token": {m[1]}})
+	equals(t, http.StatusSeeOther, w.Code)
+
+	resume, err := url.Parse(w.Header().Get("Location"))
+	ok(t, err)
+	equals(t, "state-test", resume.Query().Get("state"))
+
+	var session *http.Cookie
+	for _, c := range w.Result().Cookies() {
+		if c.Name == sessionCookie {
+			session = c
+		}
+	}
+	assert(t, session != nil, "session cookie was not issued")
+	assert(t, !strings.Contains(session.Value, "test_user"), "session cookie should be encrypted")
+
+	// The authorization request is resumed with the session cookie.
+	req, err = http.NewRequest("GET", resume.String(), nil)
+	ok(t, err)
+	req.AddCookie(session)
+	w = httptest.NewRecorder()
+	CreateGrant(w, req, cfg)
+	equals(t, http.StatusOK, w.Code)
+	assert(t, csrfTokenRe.MatchString(w.Body.String()) && strings.Contains(w.Body.String(), "approved_scope"), "authorization form not rendered: %s", w.Body.String())
+
+	// The session subject is the one the provider resolved, not the
+	// username as typed.
+	s, err := userSession(req, cfg)
+	ok(t, err)
+	equals(t, "test_user", s.Subject)
+
+	// Tampered cookies are ignored.
+	req.Header.Del("Cookie")
+	req.AddCookie(&http.Cookie{Name: sessionCookie, Value: session.Value[:len(session.Value)-2] + "AA"})
+	s, err = userSession(req, cfg)
+	ok(t, err)
+	equals(t, "", s.Subject)
+}
+
+// TestBuiltinLoginStepUp tests that the built-in login form is shown again
+// when the session falls short of the authentication requirements of the
+// requested scopes.
+func TestBuiltinLoginStepUp(t *testing.T) {
+	cfg := setupTest()
+	provider := test.NewProvider(false)
+	provider.ACR = "pwd"
+	provider.ScopeACRs = map[string]string{"write": "mfa"}
+	provider.ScopeMaxAges = map[string]time.Duration{"read": time.Duration(5) * time.Minute}
+	cfg.provider = provider
+	SetACRLevels("pwd", "mfa")(&cfg)
+	SetLoginForm(`
+		<form method="post">
+			<input type="text" name="username"/>
+			<input type="hidden" name="csrf_token" value="{{.CSRFToken}}"/>
+		</form>
+	`)(&cfg)
+	SetSessionKey(bytes.Repeat([]byte("k"), 32), time.Duration(1)*time.Hour)(&cfg)
+
+	authzURL := func(scope string) string {
+		return "https://example.com/oauth2/authzs?" + url.Values{
+			"client_id":     {"test_client_id"},
+			"response_type": {"code"},
+			"redirect_uri":  {"https://example.com/oauth2/callback"},
+			"scope":         {scope},
+			"state":         {"state-test"},
+		}.Encode()
+	}
+
+	authzRequest := func(method, u string, values url.Values, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, u, strings.NewReader(values.Encode()))
+		ok(t, err)
+		req.Header.Set("Content-type", "application/x-www-form-urlencoded")
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+
+		w := httptest.NewRecorder()
+		CreateGrant(w, req, cfg)
+		return w
+	}
+
+	login := func(u string) *httptest.ResponseRecorder {
+		w := authzRequest("GET", u, nil)
+		m := csrfTokenRe.FindStringSubmatch(w.Body.String())
+		assert(t, m != nil, "login form not rendered: %s", w.Body.String())
+
+		return authzRequest("POST", u, url.Values{
+			"username":   {"test_user"},
+			"password":   {"test_password"},
+			"csrf_token": {m[1]},
+		}, w.Result().Cookies()...)
+	}
+
+	// A login that can't meet the required ACR is not shown again.
+	w := login(authzURL("write"))
+	equals(t, http.StatusFound, w.Code)
+	location, err := url.Parse(w.Header().Get("Location"))
+	ok(t, err)
+	equals(t, "unmet_authentication_requirements", location.Query().Get("error"))
+
+	// The ACR met by the login is kept in the session.
+	provider.ACR = "mfa"
+	w = login(authzURL("write"))
+	equals(t, http.StatusSeeOther, w.Code)
+	w = authzRequest("GET", w.Header().Get("Location"), nil, w.Result().Cookies()...)
+	equals(t, http.StatusOK, w.Code)
+	assert(t, strings.Contains(w.Body.String(), "approved_scope"), "authorization form not rendered: %s", w.Body.String())
+
+	// Resource owners who logged in too long ago are asked to log in again.
+	rec := httptest.NewRecorder()
+	ok(t, setSessionCookie(rec, cfg, types.Session{
+		Subject:  "test_user",
+		AuthTime: time.Now().Add(-time.Duration(10) * time.Minute),
+		ACR:      "mfa",
+	}))
+	w = authzRequest("GET", authzURL("read"), nil, rec.Result().Cookies()...)
+	equals(t, http.StatusOK, w.Code)
+	assert(t, strings.Contains(w.Body.String(), `name="username"`), "login form not rendered: %s", w.Body.String())
+}
@@ -0,0 +1,337 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package oauth2
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hooklift/oauth2/internal/jose"
+	"github.com/hooklift/oauth2/internal/render"
+	"github.com/hooklift/oauth2/types"
+)
+
+// EndSessionHandlers is a map to functions where each function handles a
+// particular HTTP verb or method.
+var EndSessionHandlers map[string]func(http.ResponseWriter, *http.Request, config) = map[string]func(http.ResponseWriter, *http.Request, config){
+	"GET":  EndSession,
+	"POST": EndSession,
+}
+
+// LogoutData defines properties used to render the logout form view.
+type LogoutData struct {
+	// Front-channel logout URLs of the clients the resource owner logged
+	// into, to be rendered as iframes.
+	FrontChannelURLs []string
+	// URL to send the resource owner to once the iframes are loaded, empty if
+	// the client did not ask for any.
+	RedirectURL string
+	// Whether the resource owner has to confirm the logout, which happens
+	// when the request did not come with a valid ID token hint. The form
+	// must then be posted back to the current URL with a "csrf_token" field.
+	Confirm bool
+	// CSRF token protecting the confirmation form.
+	CSRFToken string
+	// List of errors to display to the resource owner.
+	Errors []types.AuthzError
+}
+
+// Event and JWT type identifying back-channel logout tokens.
+// -- http://openid.net/specs/openid-connect-backchannel-1_0.html#LogoutToken
+const (
+	backChannelLogoutEvent = "http://schemas.openid.net/event/backchannel-logout"
+	logoutTokenType        = "logout+jwt"
+)
+
+// Logout tokens are only meant to be used right away, so they are short lived.
+// Clients are given a bounded time to process them, so a slow or unresponsive
+// client does not hold up the logout of the others.
+const (
+	logoutTokenLifetime      = time.Duration(2) * time.Minute
+	backChannelLogoutTimeout = time.Duration(5) * time.Second
+)
+
+type logoutTokenClaims struct {
+	Issuer     string                         `json:"iss"`
+	Subject    string                         `json:"sub"`
+	Audience   string                         `json:"aud"`
+	IssuedAt   int64                          `json:"iat"`
+	Expiration int64                          `json:"exp"`
+	ID         string                         `json:"jti"`
+	SessionID  string                         `json:"sid,omitempty"`
+	Events     map[string]map[string]struct{} `json:"events"`
+}
+
+// EndSession logs the resource owner out of the authorization server and of
+// every client they logged into, in accordance with
+// http://openid.net/specs/openid-connect-rpinitiated-1_0.html,
+// http://openid.net/specs/openid-connect-frontchannel-1_0.html and
+// http://openid.net/specs/openid-connect-backchannel-1_0.html
+func EndSession(w http.ResponseWriter, req *http.Request, cfg config) {
+	session, err := userSession(req, cfg)
+	if err != nil {
+		logoutErr(w, cfg, http.StatusInternalServerError, ErrServerError("", err))
+		return
+	}
+
+	state := req.FormValue("state")
+	redirectURL, e := postLogoutRedirect(req, cfg, session)
+	if e != nil {
+		logoutErr(w, cfg, http.StatusBadRequest, *e)
+		return
+	}
+
+	data := LogoutData{}
+	if redirectURL != nil {
+		u := *redirectURL
+		if state != "" {
+			query := u.Query()
+			query.Set("state", state)
+			u.RawQuery = query.Encode()
+		}
+		data.RedirectURL = u.String()
+	}
+
+	// Without an ID token hint, the request may have been forged by any site,
+	// so the resource owner has to confirm the logout.
+	// -- http://openid.net/specs/openid-connect-rpinitiated-1_0.html#RPLogout
+	params := logoutParams(req)
+	if session.Subject != "" && req.FormValue("id_token_hint") == "" &&
+		(req.Method != "POST" || !verifyCSRFToken(req, cfg, params)) {
+		data.Confirm = true
+		if req.Method == "POST" {
+			data.Errors = append(data.Errors, ErrInvalidCSRFToken)
+		}
+
+		data.CSRFToken, err = csrfToken(w, req, cfg, params)
+		if err != nil {
+			logoutErr(w, cfg, http.StatusInternalServerError, ErrServerError("", err))
+			return
+		}
+
+		render.HTML(w, render.Options{
+			Status:    http.StatusOK,
+			Data:      data,
+			Template:  cfg.logoutForm,
+			STSMaxAge: cfg.stsMaxAge,
+		})
+		return
+	}
+
+	if session.Subject != "" {
+		provider := cfg.provider.(LogoutProvider)
+		clients, err := provider.SessionClients(session)
+		if err != nil {
+			log.Printf("[ERROR] Error looking up clients to log out: %v", err)
+		}
+
+		if err := provider.EndSession(w, req, session); err != nil {
+			logoutErr(w, cfg, http.StatusInternalServerError, ErrServerError("", err))
+			return
+		}
+
+		if builtinLogin(cfg) {
+			clearSessionCookie(w)
+		}
+
+		var wg sync.WaitGroup
+		for _, c := range clients {
+			if c.BackChannelLogoutURL != nil {
+				wg.Add(1)
+				go func(c types.Client) {
+					defer wg.Done()
+					if err := backChannelLogout(cfg, c, session); err != nil {
+						log.Printf("[WARN] Error notifying %s of logout: %v", c.ID, err)
+					}
+				}(c)
+			}
+
+			if c.FrontChannelLogoutURL != nil {
+				u := *c.FrontChannelLogoutURL
+				query := u.Query()
+				query.Set("iss", cfg.issuer)
+				u.RawQuery = query.Encode()
+				data.FrontChannelURLs = append(data.FrontChannelURLs, u.String())
+			}
+		}
+		wg.Wait()
+	}
+
+	render.HTML(w, render.Options{
+		Status:    http.StatusOK,
+		Data:      data,
+		Template:  cfg.logoutForm,
+		STSMaxAge: cfg.stsMaxAge,
+	})
+}
+
+// logoutParams binds CSRF tokens to the logout confirmation form, so they
+// can't be replayed to approve authorization requests.
+func logoutParams(req *http.Request) map[string]string {
+	return map[string]string{
+		"client_id":    req.FormValue("client_id"),
+		"redirect_uri": req.FormValue("post_logout_redirect_uri"),
+		"state":        req.FormValue("state"),
+		"form":         "logout",
+	}
+}
+
+// postLogoutRedirect validates the id_token_hint and post_logout_redirect_uri
+// parameters, returning the URL the resource owner can be sent back to.
+func postLogoutRedirect(req *http.Request, cfg config, session types.Session) (*url.URL, *types.AuthzError) {
+	clientID := req.FormValue("client_id")
+	if hint := req.FormValue("id_token_hint"); hint != "" {
+		claims, err := verifyIDTokenHint(cfg, hint)
+		if err != nil {
+			e := ErrInvalidIDTokenHint
+			return nil, &e
+		}
+
+		// The hint is only accepted for the resource owner logging out, as
+		// identified to the client the hint was issued to.
+		if session.Subject != "" {
+			hintClient, err := cfg.provider.ClientInfo(claims.Audience)
+			if err != nil {
+				e := ErrServerError("", err)
+				return nil, &e
+			}
+
+			subject, err := subjectFor(cfg, hintClient, session.Subject)
+			if err != nil {
+				e := ErrServerError("", err)
+				return nil, &e
+			}
+
+			if claims.Subject != subject {
+				e := ErrInvalidIDTokenHint
+				return nil, &e
+			}
+		}
+
+		if clientID != "" && clientID != claims.Audience {
+			e := ErrClientIDMismatch
+			return nil, &e
+		}
+		clientID = claims.Audience
+	}
+
+	redirectURI := req.FormValue("post_logout_redirect_uri")
+	if redirectURI == "" {
+		return nil, nil
+	}
+
+	if clientID == "" {
+		e := ErrClientIDMissing
+		return nil, &e
+	}
+
+	cinfo, err := cfg.provider.ClientInfo(clientID)
+	if err != nil {
+		e := ErrServerError("", err)
+		return nil, &e
+	}
+
+	if cinfo.ID == "" || cinfo.PostLogoutRedirectURL == nil ||
+		cinfo.PostLogoutRedirectURL.String() != redirectURI {
+		e := ErrPostLogoutRedirectURLMismatch
+		return nil, &e
+	}
+	return cinfo.PostLogoutRedirectURL, nil
+}
+
+// verifyIDTokenHint checks that an ID token was issued by this server. Expired
+// ID tokens are accepted as hints.
+func verifyIDTokenHint(cfg config, hint string) (idTokenClaims, error) {
+	var claims idTokenClaims
+	for _, k := range cfg.signingKeys {
+		payload, err := jose.Verify(hint, k.Key.Public())
+		if err != nil {
+			continue
+		}
+
+		if err := json.Unmarshal(payload, &claims); err != nil {
+			return claims, err
+		}
+
+		if claims.Issuer != cfg.issuer {
+			return claims, errors.New("ID token was issued by " + claims.Issuer)
+		}
+		return claims, nil
+	}
+	return claims, jose.ErrSignature
+}
+
+// backChannelLogout posts a logout token to the client's back-channel logout
+// URL, giving up after backChannelLogoutTimeout.
+func backChannelLogout(cfg config, cinfo types.Client, session types.Session) error {
+	jti := make([]byte, 16)
+	if _, err := rand.Read(jti); err != nil {
+		return err
+	}
+
+	subject, err := subjectFor(cfg, cinfo, session.Subject)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	token, err := signTypedJWT(cfg, "", logoutTokenType, logoutTokenClaims{
+		Issuer:     cfg.issuer,
+		Subject:    subject,
+		Audience:   cinfo.ID,
+		IssuedAt:   now.Unix(),
+		Expiration: now.Add(logoutTokenLifetime).Unix(),
+		ID:         base64.RawURLEncoding.EncodeToString(jti),
+		SessionID:  session.SessionID,
+		Events: map[string]map[string]struct{}{
+			backChannelLogoutEvent: {},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), backChannelLogoutTimeout)
+	defer cancel()
+
+	body := url.Values{"logout_token": {token}}.Encode()
+	req, err := http.NewRequest("POST", cinfo.BackChannelLogoutURL.String(), strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	res, err := cfg.httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("back-channel logout URL responded with %s", res.Status)
+	}
+	return nil
+}
+
+func logoutErr(w http.ResponseWriter, cfg config, status int, e types.AuthzError) {
+	render.HTML(w, render.Options{
+		Status: status,
+		Data: LogoutData{
+			Errors: []types.AuthzError{e},
+		},
+		Template:  cfg.logoutForm,
+		STSMaxAge: cfg.stsMaxAge,
+	})
+}
@@ -0,0 +1,151 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package oauth2
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/hooklift/oauth2/internal/jose"
+	"github.com/hooklift/oauth2/providers/test"
+	"github.com/hooklift/oauth2/types"
+)
+
+// TestEndSession tests RP-initiated logout, notifying clients through the
+// back and front channels.
+func TestEndSession(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ok(t, err)
+
+	logoutTokens := make(chan string, 1)
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		logoutTokens <- req.PostFormValue("logout_token")
+	}))
+	defer ts.Close()
+
+	cfg := setupTest()
+	provider := test.NewProvider(true)
+	provider.Client.PostLogoutRedirectURL, _ = url.Parse("https://example.com/logged_out")
+	provider.Client.FrontChannelLogoutURL, _ = url.Parse("https://example.com/frontchannel_logout")
+	provider.Client.BackChannelLogoutURL, _ = url.Parse(ts.URL + "/backchannel_logout")
+	cfg.provider = provider
+	SetIssuer("https://example.com")(&cfg)
+	SetSigningKeys(SigningKey{ID: "key-1", Key: key})(&cfg)
+	SetHTTPClient(ts.Client())(&cfg)
+	SetLogoutForm(`
+		{{range .Errors}}<p>{{.Code}}: {{.Description}}</p>{{end}}
+		{{range .FrontChannelURLs}}<iframe src="{{.}}"></iframe>{{end}}
+		{{if .Confirm}}<form method="post"><input type="hidden" name="csrf_token" value="{{.CSRFToken}}"/></form>
+		{{else if .RedirectURL}}<a id="continue" href="{{.RedirectURL}}">Continue</a>{{end}}
+	`)(&cfg)
+
+	hint, err := idToken(cfg, provider.Client, types.Session{Subject: "test_user"}, "", "", "")
+	ok(t, err)
+
+	logoutRequest := func(values url.Values) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("GET", "https://example.com/oauth2/logout?"+values.Encode(), nil)
+		ok(t, err)
+
+		w := httptest.NewRecorder()
+		EndSession(w, req, cfg)
+		return w
+	}
+
+	w := logoutRequest(url.Values{
+		"id_token_hint":            {hint},
+		"post_logout_redirect_uri": {"https://attacker.example.com/"},
+	})
+	equals(t, http.StatusBadRequest, w.Code)
+	assert(t, provider.IsUserAuthenticated(), "session should not end on invalid requests")
+
+	w = logoutRequest(url.Values{
+		"id_token_hint":            {hint},
+		"post_logout_redirect_uri": {"https://example.com/logged_out"},
+		"state":                    {"state-test"},
+	})
+	equals(t, http.StatusOK, w.Code)
+	assert(t, !provider.IsUserAuthenticated(), "session should have ended")
+
+	body := w.Body.String()
+	assert(t, strings.Contains(body, `<iframe src="https://example.com/frontchannel_logout?iss=https%3A%2F%2Fexample.com">`), "front-channel iframe not found: %s", body)
+	assert(t, strings.Contains(body, `href="https://example.com/logged_out?state=state-test"`), "post-logout redirect not found: %s", body)
+
+	logoutToken := <-logoutTokens
+	payload, err := jose.Verify(logoutToken, &key.PublicKey)
+	ok(t, err)
+
+	// Logout tokens are explicitly typed, so they can't be confused with ID
+	// tokens.
+	h, err := base64.RawURLEncoding.DecodeString(strings.Split(logoutToken, ".")[0])
+	ok(t, err)
+	header := struct {
+		Typ string `json:"typ"`
+	}{}
+	ok(t, json.Unmarshal(h, &header))
+	equals(t, "logout+jwt", header.Typ)
+
+	claims := logoutTokenClaims{}
+	ok(t, json.Unmarshal(payload, &claims))
+	equals(t, "test_user", claims.Subject)
+	equals(t, provider.Client.ID, claims.Audience)
+	equals(t, "test_session", claims.SessionID)
+	assert(t, claims.Expiration > claims.IssuedAt && claims.Expiration-claims.IssuedAt <= 120, "unexpected expiration: %d", claims.Expiration)
+	_, found := claims.Events[backChannelLogoutEvent]
+	assert(t, found, "back-channel logout event not found: %v", claims.Events)
+}
+
+// TestEndSessionConfirmation tests that logout requests without ID token hint
+// only end the session once the resource owner confirms them.
+func TestEndSessionConfirmation(t *testing.T) {
+	cfg := setupTest()
+	provider := test.NewProvider(true)
+	cfg.provider = provider
+	SetIssuer("https://example.com")(&cfg)
+	SetLogoutForm(`
+		{{range .Errors}}<p>{{.Code}}: {{.Description}}</p>{{end}}
+		{{if .Confirm}}<form method="post"><input type="hidden" name="csrf_token" value="{{.CSRFToken}}"/></form>{{end}}
+	`)(&cfg)
+
+	logoutURL := "https://example.com/oauth2/logout?state=state-test"
+	logoutRequest := func(method string, values url.Values, cookies []*http.Cookie) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, logoutURL, strings.NewReader(values.Encode()))
+		ok(t, err)
+		req.Header.Set("Content-type", "application/x-www-form-urlencoded")
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+
+		w := httptest.NewRecorder()
+		EndSession(w, req, cfg)
+		return w
+	}
+
+	// A cross-site GET only renders the confirmation.
+	w := logoutRequest("GET", nil, nil)
+	equals(t, http.StatusOK, w.Code)
+	assert(t, provider.IsUserAuthenticated(), "session should not end without confirmation")
+
+	m := csrfTokenRe.FindStringSubmatch(w.Body.String())
+	assert(t, m != nil, "confirmation form not rendered: %s", w.Body.String())
+	cookies := w.Result().Cookies()
+
+	w = logoutRequest("POST", url.Values{"csrf_token": {"forged"}}, cookies)
+	equals(t, http.StatusOK, w.Code)
+	assert(t, provider.IsUserAuthenticated(), "session should not end with a forged CSRF token")
+	assert(t, strings.Contains(w.Body.String(), ErrInvalidCSRFToken.Code), "unexpected response: %s", w.Body.String())
+
+	w = logoutRequest("POST", url.Values{"csrf_token": {m[1]}}, cookies)
+	equals(t, http.StatusOK, w.Code)
+	assert(t, !provider.IsUserAuthenticated(), "session should have ended")
+	assert(t, !csrfTokenRe.MatchString(w.Body.String()), "confirmation should not be rendered again: %s", w.Body.String())
+}
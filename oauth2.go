@@ -8,6 +8,7 @@
 package oauth2
 
 import (
+	"crypto/rand"
 	"html/template"
 	"log"
 	"net/http"
@@ -15,7 +16,9 @@ import (
 	"strings"
 	"time"
 
+	"github.com/hooklift/oauth2/internal/jose"
 	"github.com/hooklift/oauth2/internal/render"
+	"github.com/hooklift/oauth2/tokengen"
 	"github.com/hooklift/oauth2/types"
 )
 
@@ -49,6 +52,9 @@ type Provider interface {
 	ResourceScopes(url *url.URL) (types.Scopes, error)
 
 	// GenGrant issues and stores an authorization grant code, in a persistent storage.
+	// The given grant comes with the scopes approved by the resource owner as
+	// well as the ones originally requested by the client and the PKCE code
+	// challenge, if any. All of them must be stored along with the code.
 	// The authorization code MUST expire shortly after it is issued to mitigate
 	// the risk of leaks.  A maximum authorization code lifetime of 10 minutes is
 	// RECOMMENDED. If an authorization code is used more than once, the authorization
@@ -56,31 +62,85 @@ type Provider interface {
 	// previously issued based on that authorization code.  The authorization
 	// code is bound to the client identifier and redirection URI.
 	// -- http://tools.ietf.org/html/rfc6749#section-4.1.2
-	GenGrant(client types.Client, scopes types.Scopes, expiration time.Duration) (code types.Grant, err error)
+	GenGrant(grant types.Grant, client types.Client, expiration time.Duration) (code types.Grant, err error)
 
 	// GenToken generates and stores access and refresh tokens with the given
-	// client information and authorization scope.
+	// client information and authorization scope. The grant's ACR and
+	// AuthTime are expected to be kept in the token, so step-up
+	// authentication can be enforced when it is used.
 	GenToken(grant types.Grant, client types.Client, refreshToken bool, expiration time.Duration) (token types.Token, err error)
 
 	// RevokeToken expires a specific token.
 	RevokeToken(token string) error
 
-	// RefreshToken refreshes an access token.
-	RefreshToken(refreshToken types.Token, scopes types.Scopes) (accessToken types.Token, err error)
+	// RefreshToken refreshes an access token, issuing a new one with the given
+	// scopes and expiration.
+	RefreshToken(refreshToken types.Token, scopes types.Scopes, expiration time.Duration) (accessToken types.Token, err error)
 
 	// IsUserAuthenticated checks whether or not the resource owner has a valid session
 	// with the system. If not, it redirects the user to the login URL.
 	IsUserAuthenticated() bool
 }
 
+// SessionProvider is optionally implemented by providers to identify the
+// resource owner behind a request to the authorization endpoint. Sessions
+// reporting when the resource owner authenticated allow enforcing max_age.
+type SessionProvider interface {
+	// UserSession returns the session of the resource owner making the request.
+	UserSession(req *http.Request) (types.Session, error)
+}
+
+// ConsentStore records the scopes resource owners approve for each client so
+// they are not asked again for the same authorization. It requires the
+// built-in login or the provider to implement SessionProvider.
+type ConsentStore interface {
+	// Consent returns the consent given by the resource owner to the client. A
+	// zero value is returned if there is none.
+	Consent(subject, clientID string) (types.Consent, error)
+
+	// SaveConsent stores or replaces the consent given by the resource owner
+	// to the client.
+	SaveConsent(consent types.Consent) error
+
+	// RevokeConsent forgets the consent given by the resource owner to the client.
+	RevokeConsent(subject, clientID string) error
+}
+
+// AuthorizedClientsProvider is optionally implemented by providers to let
+// resource owners review and revoke the clients they authorized. It requires
+// the built-in login or the provider to implement SessionProvider as well.
+type AuthorizedClientsProvider interface {
+	// AuthorizedClients returns the clients holding valid grants or tokens
+	// issued on behalf of the resource owner.
+	AuthorizedClients(subject string) ([]types.AuthorizedClient, error)
+
+	// RevokeClient revokes every grant and token issued to the client on
+	// behalf of the resource owner.
+	RevokeClient(subject, clientID string) error
+}
+
+// LogoutProvider is optionally implemented by providers to support OpenID
+// Connect logout through the end-session endpoint. It requires the built-in
+// login or the provider to implement SessionProvider as well.
+type LogoutProvider interface {
+	// SessionClients returns the clients the resource owner logged into
+	// during the session, so they can be notified of the logout.
+	SessionClients(session types.Session) ([]types.Client, error)
+
+	// EndSession terminates the resource owner's session with the
+	// authorization server, for instance by clearing session cookies.
+	EndSession(w http.ResponseWriter, req *http.Request, session types.Session) error
+}
+
 // http://commandcenter.blogspot.com/2014/01/self-referential-functions-and-design.html
 type option func(*config)
 
 // Config defines the configuration struct for the oauth2 provider.
 type config struct {
-	authzEndpoint string
-	tokenEndpoint string
-	loginURL      struct {
+	authzEndpoint      string
+	tokenEndpoint      string
+	revocationEndpoint string
+	loginURL           struct {
 		url           *url.URL
 		redirectParam string
 	}
@@ -89,6 +149,55 @@ type config struct {
 	provider        Provider
 	authzExpiration time.Duration
 	tokenExpiration time.Duration
+	scopeMatcher    types.ScopeMatcher
+	csrfKey         []byte
+	consent         struct {
+		store      ConsentStore
+		expiration time.Duration
+	}
+	refreshToken struct {
+		lifetime      time.Duration
+		idleTimeout   time.Duration
+		publicClients bool
+	}
+	lineage              LineageStore
+	auditLogger          func(types.AuditEvent)
+	refreshReuseInterval time.Duration
+	profile              Profile
+	issuer               string
+	signingKeys          []SigningKey
+	pairwiseSalt         []byte
+	acrLevels            []string
+	tokenHashKey         []byte
+	generators           struct {
+		code    tokengen.Generator
+		access  tokengen.Generator
+		refresh tokengen.Generator
+	}
+	sealed struct {
+		key   []byte
+		cache ReplayCache
+	}
+	stepUp func(http.ResponseWriter, *http.Request, StepUpChallenge)
+	login  struct {
+		form     *template.Template
+		key      []byte
+		lifetime time.Duration
+	}
+	// Optional endpoints
+	authorizedClientsEndpoint string
+	tokenDeleteRevocation     bool
+	jwksEndpoint              string
+	endSessionEndpoint        string
+	logoutForm                *template.Template
+	httpClient                *http.Client
+	backchannel               struct {
+		endpoint   string
+		notifier   BackchannelNotifier
+		store      BackchannelStore
+		expiration time.Duration
+		interval   time.Duration
+	}
 }
 
 // TokenEndpoint allows setting token endpoint. Defaults to "/oauth2/tokens".
@@ -127,6 +236,104 @@ func SetAuthzEndpoint(endpoint string) option {
 	}
 }
 
+// SetRevocationEndpoint allows setting token revocation endpoint. Defaults to
+// "/oauth2/revoke".
+//
+// Clients revoke access or refresh tokens by POSTing them to this endpoint in
+// a "token" form parameter, in accordance with https://tools.ietf.org/html/rfc7009
+func SetRevocationEndpoint(endpoint string) option {
+	return func(c *config) {
+		c.revocationEndpoint = endpoint
+	}
+}
+
+// SetTokenDeleteRevocation enables revoking tokens through
+// DELETE {token endpoint}/{token}. It is disabled by default since tokens end
+// up in URL paths and access logs, use the revocation endpoint instead.
+func SetTokenDeleteRevocation(enabled bool) option {
+	return func(c *config) {
+		c.tokenDeleteRevocation = enabled
+	}
+}
+
+// SetAuthorizedClientsEndpoint enables an endpoint for resource owners to list
+// the clients they authorized and to revoke them. It is disabled by default
+// and requires the provider to implement AuthorizedClientsProvider.
+//
+// GET on the endpoint lists the authorized clients while DELETE on
+// {endpoint}/{client_id} revokes every grant and token issued to the client.
+// Both require the resource owner to have a valid session.
+func SetAuthorizedClientsEndpoint(endpoint string) option {
+	return func(c *config) {
+		c.authorizedClientsEndpoint = endpoint
+	}
+}
+
+// SetEndSessionEndpoint enables the OpenID Connect end-session endpoint at
+// the given path, for instance "/oauth2/logout". It requires a logout form,
+// signing keys, an issuer and a provider implementing LogoutProvider.
+func SetEndSessionEndpoint(endpoint string) option {
+	return func(c *config) {
+		c.endSessionEndpoint = endpoint
+	}
+}
+
+// SetLogoutForm sets the page shown to the resource owner once logged out. It
+// receives LogoutData and has to render the front-channel logout iframes
+// before sending the resource owner to the post-logout redirect URL, if any.
+// It is also used to ask the resource owner to confirm logout requests
+// without ID token hint, see LogoutData.Confirm.
+func SetLogoutForm(form string) option {
+	return func(c *config) {
+		t := template.New("logoutform")
+		tpl, err := t.Parse(form)
+		if err != nil {
+			log.Fatalf("Error parsing logout form: %v", err)
+		}
+
+		c.logoutForm = tpl
+	}
+}
+
+// SetHTTPClient sets the HTTP client used to call clients, such as when
+// delivering back-channel logout tokens. Defaults to a client timing out after
+// 5 seconds.
+func SetHTTPClient(client *http.Client) option {
+	return func(c *config) {
+		c.httpClient = client
+	}
+}
+
+// SetBackchannelAuthenticationEndpoint enables the OpenID Connect
+// client-initiated backchannel authentication endpoint at the given path, for
+// instance "/oauth2/bc-authorize". Resource owners are reached on their
+// authentication device through notifier. It requires signing keys, an issuer
+// and the built-in login or a provider implementing SessionProvider.
+func SetBackchannelAuthenticationEndpoint(endpoint string, notifier BackchannelNotifier) option {
+	return func(c *config) {
+		c.backchannel.endpoint = endpoint
+		c.backchannel.notifier = notifier
+	}
+}
+
+// SetBackchannelStore sets where backchannel authentication requests are kept
+// until redeemed. Defaults to an in-memory store.
+func SetBackchannelStore(store BackchannelStore) option {
+	return func(c *config) {
+		c.backchannel.store = store
+	}
+}
+
+// SetBackchannelExpiration sets how long resource owners have to approve
+// backchannel authentication requests, along with the minimum interval
+// between polling token requests. Default to 10 minutes and 5 seconds.
+func SetBackchannelExpiration(expiration, interval time.Duration) option {
+	return func(c *config) {
+		c.backchannel.expiration = expiration
+		c.backchannel.interval = interval
+	}
+}
+
 // SetSTSMaxAge sets Strict Transport Security maximum age. Defaults to 1yr.
 func SetSTSMaxAge(maxAge time.Duration) option {
 	return func(c *config) {
@@ -147,6 +354,34 @@ func SetAuthzForm(form string) option {
 	}
 }
 
+// SetLoginForm enables the built-in login: resource owners without a session
+// are shown this form by the authorization endpoint instead of being sent to
+// the login URL. It receives LoginData, credentials are verified by the
+// provider, which has to implement LoginProvider, and sessions are kept in an
+// encrypted cookie issued by this library.
+func SetLoginForm(form string) option {
+	return func(c *config) {
+		t := template.New("loginform")
+		tpl, err := t.Parse(form)
+		if err != nil {
+			log.Fatalf("Error parsing login form: %v", err)
+		}
+
+		c.login.form = tpl
+	}
+}
+
+// SetSessionKey sets the 32 bytes key used to encrypt the session cookies
+// issued by the built-in login, along with their lifetime. The key must be
+// shared by every instance of the authorization server. Defaults to a random
+// key generated at startup and 12 hours.
+func SetSessionKey(key []byte, lifetime time.Duration) option {
+	return func(c *config) {
+		c.login.key = key
+		c.login.lifetime = lifetime
+	}
+}
+
 // SetTokenExpiration allows setting expiration time for access tokens.
 func SetTokenExpiration(e time.Duration) option {
 	return func(c *config) {
@@ -161,6 +396,202 @@ func SetAuthzExpiration(e time.Duration) option {
 	}
 }
 
+// SetScopeMatcher sets the rules used to decide whether granted scopes cover
+// requested ones. Defaults to types.DefaultScopeMatcher.
+func SetScopeMatcher(m types.ScopeMatcher) option {
+	return func(c *config) {
+		c.scopeMatcher = m
+	}
+}
+
+// SetCSRFKey sets the secret key used to sign the CSRF tokens embedded in the
+// authorization form. It must be shared by every instance of the authorization
+// server. Defaults to a random key generated at startup.
+func SetCSRFKey(key []byte) option {
+	return func(c *config) {
+		c.csrfKey = key
+	}
+}
+
+// SetConsentStore sets the store used to remember the scopes approved by
+// resource owners. Authorization requests already covered by a previous
+// consent are approved without showing the authorization form, unless the
+// client sends prompt=consent.
+func SetConsentStore(store ConsentStore) option {
+	return func(c *config) {
+		c.consent.store = store
+	}
+}
+
+// SetConsentExpiration allows setting for how long a consent is remembered.
+// Defaults to 90 days, zero means consents do not expire.
+func SetConsentExpiration(e time.Duration) option {
+	return func(c *config) {
+		c.consent.expiration = e
+	}
+}
+
+// SetLineageStore sets the store used to track which tokens were issued from
+// which authorization codes and tokens. Defaults to an in-memory store
+// retaining records for 30 days, see NewMemoryLineageStore. Refresh token
+// lifetimes are enforced through it, so refresh tokens missing from the store
+// are rejected if they apply.
+func SetLineageStore(store LineageStore) option {
+	return func(c *config) {
+		c.lineage = store
+	}
+}
+
+// SetRefreshTokenReuseInterval sets a grace period during which presenting an
+// already rotated refresh token is rejected without revoking its token family.
+// It accommodates clients racing to refresh the same token from concurrent
+// requests. Defaults to zero.
+func SetRefreshTokenReuseInterval(d time.Duration) option {
+	return func(c *config) {
+		c.refreshReuseInterval = d
+	}
+}
+
+// SetAuditLogger sets a function to receive security relevant events, such as
+// authorization codes being reused. Events are logged by default.
+func SetAuditLogger(fn func(types.AuditEvent)) option {
+	return func(c *config) {
+		c.auditLogger = fn
+	}
+}
+
+// SetRefreshTokenLifetime allows setting the maximum lifetime of the sessions
+// refresh tokens belong to, counting from the first token issued. Once
+// exceeded, refresh tokens are rejected and the client has to ask the resource
+// owner for authorization again. Defaults to zero, no limit.
+func SetRefreshTokenLifetime(e time.Duration) option {
+	return func(c *config) {
+		c.refreshToken.lifetime = e
+	}
+}
+
+// SetRefreshTokenIdleTimeout allows setting for how long refresh tokens can go
+// unused before being rejected. Defaults to zero, no limit.
+func SetRefreshTokenIdleTimeout(e time.Duration) option {
+	return func(c *config) {
+		c.refreshToken.idleTimeout = e
+	}
+}
+
+// SetPublicClientRefreshTokens allows issuing refresh tokens to public
+// clients. They can't keep refresh tokens confidential, so they don't get
+// any by default. When enabled, their refresh tokens are still rotated on every
+// use and subject to the configured lifetimes.
+func SetPublicClientRefreshTokens(enabled bool) option {
+	return func(c *config) {
+		c.refreshToken.publicClients = enabled
+	}
+}
+
+// SetProfile switches the handler into a security profile, such as OAuth21 or
+// FAPI2Baseline, enforcing all of its requirements. No profile is used by default.
+func SetProfile(p Profile) option {
+	return func(c *config) {
+		c.profile = p
+	}
+}
+
+// SetIssuer sets the authorization server's issuer identifier, a URL using
+// the HTTPS scheme with no query or fragment components. When set, it is sent
+// in the "iss" parameter of every authorization response.
+func SetIssuer(issuer string) option {
+	return func(c *config) {
+		c.issuer = issuer
+	}
+}
+
+// SetPairwiseSalt sets the secret salt used to derive pairwise subject
+// identifiers. It is required if any client uses pairwise identifiers, and
+// changing it changes every pairwise identifier.
+func SetPairwiseSalt(salt []byte) option {
+	return func(c *config) {
+		c.pairwiseSalt = salt
+	}
+}
+
+// SetACRLevels sets the authentication context class references known to
+// the server, ordered from the weakest to the strongest, so stronger
+// authentications satisfy scopes requiring weaker ones. Otherwise, scopes
+// requiring an ACR are only satisfied by that exact ACR.
+func SetACRLevels(levels ...string) option {
+	return func(c *config) {
+		c.acrLevels = levels
+	}
+}
+
+// SetStepUpHandler sets a function challenging resource owners whose session
+// does not meet the authentication requirements of the requested scopes, for
+// instance by asking for a second factor. It has to update the session and
+// send the resource owner back to the challenge's ReturnURL. Without it,
+// resource owners are sent to the login URL along with the required
+// acr_values and max_age.
+func SetStepUpHandler(fn func(http.ResponseWriter, *http.Request, StepUpChallenge)) option {
+	return func(c *config) {
+		c.stepUp = fn
+	}
+}
+
+// SetTokenHashKey enables hashing authorization codes and tokens at rest:
+// they are generated by this library and providers, which have to implement
+// TokenStorage, only get their HMAC-SHA256 keyed with key. The key must be
+// shared by every instance of the authorization server and passed to
+// AuthzHandler as well.
+func SetTokenHashKey(key []byte) option {
+	return func(c *config) {
+		c.tokenHashKey = key
+	}
+}
+
+// SetTokenGenerators sets the generators of authorization codes, access
+// tokens and refresh tokens issued when they are hashed at rest, see
+// SetTokenHashKey. Default to tokengen.AuthzCodes, tokengen.AccessTokens and
+// tokengen.RefreshTokens.
+func SetTokenGenerators(code, access, refresh tokengen.Generator) option {
+	return func(c *config) {
+		c.generators.code = code
+		c.generators.access = access
+		c.generators.refresh = refresh
+	}
+}
+
+// SetSealedCodes makes authorization codes stateless: instead of being
+// stored by the provider, grants are encrypted and authenticated with key,
+// which must be 32 bytes long and shared by every instance of the
+// authorization server, and handed to clients as the code itself. cache
+// enforces single use of codes, defaulting to NewMemoryReplayCache if nil.
+func SetSealedCodes(key []byte, cache ReplayCache) option {
+	return func(c *config) {
+		if cache == nil {
+			cache = NewMemoryReplayCache()
+		}
+		c.sealed.key = key
+		c.sealed.cache = cache
+	}
+}
+
+// SetSigningKeys sets the keys used to sign JWTs issued by the authorization
+// server, such as JWT-secured authorization responses. The first key is used
+// unless clients ask for a different algorithm. Public keys are published at
+// the JWKS endpoint.
+func SetSigningKeys(keys ...SigningKey) option {
+	return func(c *config) {
+		c.signingKeys = keys
+	}
+}
+
+// SetJWKSEndpoint allows setting the endpoint publishing the server's public
+// keys. Defaults to "/oauth2/jwks", it is only enabled if signing keys are set.
+func SetJWKSEndpoint(endpoint string) option {
+	return func(c *config) {
+		c.jwksEndpoint = endpoint
+	}
+}
+
 // SetProvider sets backend provider
 func SetProvider(p Provider) option {
 	return func(c *config) {
@@ -186,14 +617,34 @@ func SetLoginURL(u, redirectParam string) option {
 // AuthzHandler is intended to be used at the resource server side to protect and validate
 // access to its resources. In accordance with http://tools.ietf.org/html/rfc6749#section-7
 // and http://tools.ietf.org/html/rfc6750
-func AuthzHandler(next http.Handler, provider Provider) http.Handler {
+//
+// Options relevant to resource servers, such as SetScopeMatcher, can be passed
+// along.
+func AuthzHandler(next http.Handler, provider Provider, opts ...option) http.Handler {
 	if provider == nil {
 		log.Fatalln("An implementation of the oauth2.Provider interface is expected")
 	}
 
+	cfg := config{
+		provider:     provider,
+		scopeMatcher: types.DefaultScopeMatcher,
+	}
+
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
 	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 		var token string
 		auth := req.Header.Get("Authorization")
+		if cfg.profile.ForbidQueryToken && req.URL.Query().Get("access_token") != "" {
+			render.Unauthorized(w, render.Options{
+				Status: http.StatusBadRequest,
+				Data:   ErrQueryAccessToken,
+			})
+			return
+		}
+
 		if auth == "" {
 			token = req.FormValue("access_token")
 		} else {
@@ -220,7 +671,7 @@ func AuthzHandler(next http.Handler, provider Provider) http.Handler {
 		}
 
 		// Get token info from Authorizer
-		tokenInfo, err := provider.TokenInfo(token)
+		tokenInfo, err := lookupToken(cfg, storageKey(cfg, token))
 		if err != nil {
 			render.Unauthorized(w, render.Options{
 				Status: http.StatusUnauthorized,
@@ -229,7 +680,7 @@ func AuthzHandler(next http.Handler, provider Provider) http.Handler {
 			return
 		}
 
-		if tokenInfo.Status == types.TokenExpired || tokenInfo.Status == types.TokenRevoked {
+		if tokenInfo.Value == "" || tokenInfo.Status == types.TokenExpired || tokenInfo.Status == types.TokenRevoked {
 			render.Unauthorized(w, render.Options{
 				Status: http.StatusUnauthorized,
 				Data:   ErrInvalidToken,
@@ -248,15 +699,22 @@ func AuthzHandler(next http.Handler, provider Provider) http.Handler {
 		}
 
 		// Check that token's scope covers the requested resource
-		resourceScopes := scopes.Encode()
-		for _, scope := range tokenInfo.Scopes {
-			if !strings.Contains(resourceScopes, scope.ID) {
-				render.Unauthorized(w, render.Options{
-					Status: http.StatusForbidden,
-					Data:   ErrInsufficientScope,
-				})
-				return
-			}
+		if !cfg.scopeMatcher.Covers(tokenInfo.Scopes, scopes) {
+			render.Unauthorized(w, render.Options{
+				Status: http.StatusForbidden,
+				Data:   ErrInsufficientScope,
+			})
+			return
+		}
+
+		// Check that the resource owner authenticated strongly enough
+		session := types.Session{ACR: tokenInfo.ACR, AuthTime: tokenInfo.AuthTime}
+		if acr, maxAge, required := stepUpRequired(cfg, session, scopes); required {
+			render.Unauthorized(w, render.Options{
+				Status: http.StatusUnauthorized,
+				Data:   ErrInsufficientUserAuthentication(acr, maxAge),
+			})
+			return
 		}
 
 		next.ServeHTTP(w, req)
@@ -268,10 +726,22 @@ func AuthzHandler(next http.Handler, provider Provider) http.Handler {
 func Handler(next http.Handler, opts ...option) http.Handler {
 	// Default configuration options.
 	cfg := config{
-		tokenEndpoint: "/oauth2/tokens",
-		authzEndpoint: "/oauth2/authzs",
-		stsMaxAge:     time.Duration(31536000) * time.Second, // 1yr
+		tokenEndpoint:      "/oauth2/tokens",
+		authzEndpoint:      "/oauth2/authzs",
+		revocationEndpoint: "/oauth2/revoke",
+		jwksEndpoint:       "/oauth2/jwks",
+		stsMaxAge:          time.Duration(31536000) * time.Second, // 1yr
+		scopeMatcher:       types.DefaultScopeMatcher,
 	}
+	cfg.consent.expiration = time.Duration(90*24) * time.Hour
+	cfg.httpClient = &http.Client{Timeout: 5 * time.Second}
+	cfg.lineage = NewMemoryLineageStore(time.Duration(30*24) * time.Hour)
+	cfg.backchannel.expiration = time.Duration(10) * time.Minute
+	cfg.login.lifetime = time.Duration(12) * time.Hour
+	cfg.generators.code = tokengen.AuthzCodes
+	cfg.generators.access = tokengen.AccessTokens
+	cfg.generators.refresh = tokengen.RefreshTokens
+	cfg.backchannel.interval = time.Duration(5) * time.Second
 
 	// Applies user's configuration.
 	for _, opt := range opts {
@@ -286,10 +756,117 @@ func Handler(next http.Handler, opts ...option) http.Handler {
 		log.Fatalln("An implementation of the oauth2.Provider interface is expected")
 	}
 
+	if len(cfg.csrfKey) == 0 {
+		cfg.csrfKey = make([]byte, 32)
+		if _, err := rand.Read(cfg.csrfKey); err != nil {
+			log.Fatalf("Error generating CSRF key: %v", err)
+		}
+	}
+
+	if builtinLogin(cfg) && len(cfg.login.key) == 0 {
+		cfg.login.key = make([]byte, 32)
+		if _, err := rand.Read(cfg.login.key); err != nil {
+			log.Fatalf("Error generating session key: %v", err)
+		}
+	}
+
+	if _, ok := cfg.provider.(LoginProvider); builtinLogin(cfg) && !ok {
+		log.Fatalln("The built-in login requires the provider to implement oauth2.LoginProvider")
+	}
+
+	if len(cfg.login.key) != 0 && len(cfg.login.key) != 32 {
+		log.Fatalln("Session key must be 32 bytes long")
+	}
+
+	if sealedCodes(cfg) && len(cfg.sealed.key) != 32 {
+		log.Fatalln("Sealed codes key must be 32 bytes long")
+	}
+
+	if cfg.profile.IssuerParameter && cfg.issuer == "" {
+		log.Fatalf("%s profile requires an issuer identifier, see oauth2.SetIssuer", cfg.profile.Name)
+	}
+
+	if _, ok := cfg.provider.(TokenStorage); hashedStorage(cfg) && !ok {
+		log.Fatalln("Hashing tokens at rest requires the provider to implement oauth2.TokenStorage")
+	}
+
+	if cfg.lineage == nil && (cfg.refreshToken.lifetime > 0 || cfg.refreshToken.idleTimeout > 0) {
+		log.Fatalln("Refresh token lifetimes require a lineage store")
+	}
+
+	if cfg.consent.store != nil && !sessionsAvailable(cfg) {
+		log.Fatalln("A consent store requires the built-in login or the provider to implement oauth2.SessionProvider")
+	}
+
 	// Keeps a registry of path function handlers for OAuth2 requests.
 	registry := map[string]map[string]func(http.ResponseWriter, *http.Request, config){
-		cfg.authzEndpoint: AuthzHandlers,
-		cfg.tokenEndpoint: TokenHandlers,
+		cfg.authzEndpoint:      AuthzHandlers,
+		cfg.tokenEndpoint:      TokenHandlers,
+		cfg.revocationEndpoint: RevocationHandlers,
+	}
+
+	if cfg.tokenDeleteRevocation {
+		handlers := map[string]func(http.ResponseWriter, *http.Request, config){
+			"DELETE": RevokeToken,
+		}
+		for method, fn := range TokenHandlers {
+			handlers[method] = fn
+		}
+		registry[cfg.tokenEndpoint] = handlers
+	}
+
+	if len(cfg.signingKeys) > 0 {
+		for _, k := range cfg.signingKeys {
+			if _, err := jose.Algorithm(k.Key.Public()); err != nil {
+				log.Fatalf("Invalid signing key %q: %v", k.ID, err)
+			}
+		}
+		registry[cfg.jwksEndpoint] = JWKSHandlers
+	}
+
+	if cfg.endSessionEndpoint != "" {
+		if _, ok := cfg.provider.(LogoutProvider); !ok {
+			log.Fatalln("End-session endpoint requires the provider to implement oauth2.LogoutProvider")
+		}
+
+		if !sessionsAvailable(cfg) {
+			log.Fatalln("End-session endpoint requires the built-in login or the provider to implement oauth2.SessionProvider")
+		}
+
+		if cfg.logoutForm == nil || cfg.issuer == "" || len(cfg.signingKeys) == 0 {
+			log.Fatalln("End-session endpoint requires a logout form, an issuer and signing keys")
+		}
+		registry[cfg.endSessionEndpoint] = EndSessionHandlers
+	}
+
+	if cfg.backchannel.endpoint != "" {
+		if cfg.backchannel.notifier == nil {
+			log.Fatalln("Backchannel authentication endpoint requires an oauth2.BackchannelNotifier")
+		}
+
+		if !sessionsAvailable(cfg) {
+			log.Fatalln("Backchannel authentication endpoint requires the built-in login or the provider to implement oauth2.SessionProvider")
+		}
+
+		if cfg.issuer == "" || len(cfg.signingKeys) == 0 {
+			log.Fatalln("Backchannel authentication endpoint requires an issuer and signing keys")
+		}
+
+		if cfg.backchannel.store == nil {
+			cfg.backchannel.store = NewMemoryBackchannelStore()
+		}
+		registry[cfg.backchannel.endpoint] = BackchannelHandlers
+	}
+
+	if cfg.authorizedClientsEndpoint != "" {
+		if _, ok := cfg.provider.(AuthorizedClientsProvider); !ok {
+			log.Fatalln("Authorized clients endpoint requires the provider to implement oauth2.AuthorizedClientsProvider")
+		}
+
+		if !sessionsAvailable(cfg) {
+			log.Fatalln("Authorized clients endpoint requires the built-in login or the provider to implement oauth2.SessionProvider")
+		}
+		registry[cfg.authorizedClientsEndpoint] = AuthorizedClientsHandlers
 	}
 
 	// Locates and runs specific OAuth2 handler for request's method
@@ -0,0 +1,158 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package oauth2
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hooklift/oauth2/types"
+)
+
+// Response types supported by the authorization endpoint, including the
+// OpenID Connect ones described in
+// http://openid.net/specs/oauth-v2-multiple-response-types-1_0.html#Combinations
+var responseTypes = map[string]bool{
+	"code":                true,
+	"token":               true,
+	"id_token":            true,
+	"id_token token":      true,
+	"code id_token":       true,
+	"code token":          true,
+	"code id_token token": true,
+}
+
+// normalizeResponseType sorts the space-delimited values of a response type,
+// as their order does not matter.
+func normalizeResponseType(responseType string) string {
+	values := strings.Fields(responseType)
+	sort.Strings(values)
+	return strings.Join(values, " ")
+}
+
+// hasResponseType returns whether value is one of the values of responseType.
+func hasResponseType(responseType, value string) bool {
+	for _, v := range strings.Fields(responseType) {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// supportedResponseType returns whether the server is able to fulfill the
+// normalized response type. ID tokens require signing keys, an issuer and a
+// provider able to identify resource owners.
+func supportedResponseType(cfg config, responseType string) bool {
+	if !responseTypes[responseType] {
+		return false
+	}
+
+	// Access tokens are never issued by the authorization endpoint in
+	// profiles disabling the implicit flow.
+	if cfg.profile.DisableImplicit && hasResponseType(responseType, "token") {
+		return false
+	}
+
+	if hasResponseType(responseType, "id_token") {
+		return sessionsAvailable(cfg) && cfg.issuer != "" && len(cfg.signingKeys) > 0
+	}
+	return true
+}
+
+// nonceRequired returns whether the response type belongs to the implicit or
+// hybrid OpenID Connect flows, which require a nonce to mitigate replay attacks.
+// -- http://openid.net/specs/openid-connect-core-1_0.html#ImplicitAuthRequest
+func nonceRequired(responseType string) bool {
+	return hasResponseType(responseType, "id_token") ||
+		(hasResponseType(responseType, "code") && hasResponseType(responseType, "token"))
+}
+
+// openIDRequest returns whether an ID token has to be issued along with access
+// tokens from the token endpoint, which happens when the "openid" scope was
+// granted and the server is able to sign ID tokens.
+func openIDRequest(cfg config, scopes types.Scopes) bool {
+	if cfg.issuer == "" || len(cfg.signingKeys) == 0 {
+		return false
+	}
+
+	for _, s := range scopes {
+		if s.ID == "openid" {
+			return true
+		}
+	}
+	return false
+}
+
+// idTokenClaims holds the claims of an ID token, as described in
+// http://openid.net/specs/openid-connect-core-1_0.html#IDToken
+type idTokenClaims struct {
+	Issuer   string `json:"iss"`
+	Subject  string `json:"sub"`
+	Audience string `json:"aud"`
+	Expires  int64  `json:"exp"`
+	IssuedAt int64  `json:"iat"`
+	AuthTime int64  `json:"auth_time,omitempty"`
+	Nonce    string `json:"nonce,omitempty"`
+	ACR      string `json:"acr,omitempty"`
+	CodeHash string `json:"c_hash,omitempty"`
+	ATHash   string `json:"at_hash,omitempty"`
+	// Claims of ID tokens pushed to CIBA clients, see
+	// http://openid.net/specs/openid-client-initiated-backchannel-authentication-core-1_0.html#push_based_auth_req_id
+	AuthReqID string `json:"urn:openid:params:jwt:claim:auth_req_id,omitempty"`
+	RTHash    string `json:"urn:openid:params:jwt:claim:rt_hash,omitempty"`
+}
+
+// idToken issues a signed ID token for the client. The authorization code and
+// access token, if not empty, are bound to it through their hashes.
+func idToken(cfg config, cinfo types.Client, session types.Session, nonce, code, accessToken string) (string, error) {
+	claims, err := newIDTokenClaims(cfg, cinfo, session, nonce, code, accessToken)
+	if err != nil {
+		return "", err
+	}
+	return signJWT(cfg, "", claims)
+}
+
+// newIDTokenClaims returns the claims of an ID token issued for the client.
+func newIDTokenClaims(cfg config, cinfo types.Client, session types.Session, nonce, code, accessToken string) (idTokenClaims, error) {
+	subject, err := subjectFor(cfg, cinfo, session.Subject)
+	if err != nil {
+		return idTokenClaims{}, err
+	}
+
+	now := time.Now()
+	claims := idTokenClaims{
+		Issuer:   cfg.issuer,
+		Subject:  subject,
+		Audience: cinfo.ID,
+		Expires:  now.Add(tokenExpiration(cfg, cinfo)).Unix(),
+		IssuedAt: now.Unix(),
+		Nonce:    nonce,
+		ACR:      session.ACR,
+		CodeHash: halfHash(code),
+		ATHash:   halfHash(accessToken),
+	}
+
+	if !session.AuthTime.IsZero() {
+		claims.AuthTime = session.AuthTime.Unix()
+	}
+	return claims, nil
+}
+
+// halfHash returns the base64url encoding of the left-most half of the hash
+// of value, as used by c_hash and at_hash. Every supported signing algorithm
+// uses SHA-256.
+// -- http://openid.net/specs/openid-connect-core-1_0.html#HybridIDToken
+func halfHash(value string) string {
+	if value == "" {
+		return ""
+	}
+
+	sum := sha256.Sum256([]byte(value))
+	return base64.RawURLEncoding.EncodeToString(sum[:len(sum)/2])
+}
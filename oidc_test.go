@@ -0,0 +1,106 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package oauth2
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/hooklift/oauth2/internal/jose"
+	"github.com/hooklift/oauth2/providers/test"
+	"github.com/hooklift/oauth2/types"
+)
+
+// TestHybridFlow tests OpenID Connect multi-valued response types, along with
+// nonce enforcement and the hashes binding the ID token to the other values.
+func TestHybridFlow(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ok(t, err)
+
+	cfg := setupTest()
+	provider := test.NewProvider(true)
+	cfg.provider = provider
+	SetIssuer("https://example.com")(&cfg)
+	SetSigningKeys(SigningKey{ID: "key-1", Key: key})(&cfg)
+
+	values := url.Values{
+		"client_id":     {provider.Client.ID},
+		"response_type": {"token code id_token"},
+		"state":         {"state-test"},
+		"redirect_uri":  {provider.Client.RedirectURL.String()},
+		"scope":         {"openid read"},
+	}
+
+	req, err := http.NewRequest("GET", "https://example.com/oauth2/authzs?"+values.Encode(), nil)
+	ok(t, err)
+	w := httptest.NewRecorder()
+	CreateGrant(w, req, cfg)
+	equals(t, http.StatusFound, w.Code)
+
+	u, err := url.Parse(w.Header().Get("Location"))
+	ok(t, err)
+	fragment, err := url.ParseQuery(u.Fragment)
+	ok(t, err)
+	equals(t, "invalid_request", fragment.Get("error"))
+
+	values.Set("nonce", "nonce-test")
+	values.Set("decision", "approve")
+	w = authzPostTest(t, cfg, values)
+	equals(t, http.StatusFound, w.Code)
+
+	u, err = url.Parse(w.Header().Get("Location"))
+	ok(t, err)
+	equals(t, "", u.RawQuery)
+	fragment, err = url.ParseQuery(u.Fragment)
+	ok(t, err)
+
+	code := fragment.Get("code")
+	accessToken := fragment.Get("access_token")
+	assert(t, code != "", "we were expecting an authorization code: %s", u)
+	assert(t, accessToken != "", "we were expecting an access token: %s", u)
+
+	payload, err := jose.Verify(fragment.Get("id_token"), &key.PublicKey)
+	ok(t, err)
+
+	claims := idTokenClaims{}
+	ok(t, json.Unmarshal(payload, &claims))
+	equals(t, "https://example.com", claims.Issuer)
+	equals(t, "test_user", claims.Subject)
+	equals(t, provider.Client.ID, claims.Audience)
+	equals(t, "nonce-test", claims.Nonce)
+	equals(t, halfHash(code), claims.CodeHash)
+	equals(t, halfHash(accessToken), claims.ATHash)
+
+	// The token endpoint issues an ID token as well.
+	req = AuthzGrantTokenRequestTest(t, "authorization_code", code)
+	req.SetBasicAuth("testclient", "testclient")
+	w = httptest.NewRecorder()
+	IssueToken(w, req, cfg)
+	equals(t, http.StatusOK, w.Code)
+
+	token := types.Token{}
+	ok(t, json.Unmarshal(w.Body.Bytes(), &token))
+
+	payload, err = jose.Verify(token.IDToken, &key.PublicKey)
+	ok(t, err)
+
+	claims = idTokenClaims{}
+	ok(t, json.Unmarshal(payload, &claims))
+	equals(t, "test_user", claims.Subject)
+	equals(t, "nonce-test", claims.Nonce)
+	equals(t, halfHash(token.Value), claims.ATHash)
+}
+
+// TestHalfHash tests c_hash and at_hash computation using the example found
+// in http://openid.net/specs/openid-connect-core-1_0.html#code-id_tokenExample
+func TestHalfHash(t *testing.T) {
+	equals(t, "LDktKdoQak3Pk0cnXxCltA", halfHash("Qcb0Orv1zh30vL1MPRsbm-diHiMwcLyZvn1arpZv-Jxf_11jnpEX3Tgfvk"))
+}
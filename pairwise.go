@@ -0,0 +1,51 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package oauth2
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+
+	"github.com/hooklift/oauth2/types"
+)
+
+// ErrPairwiseSaltRequired is returned when a client uses pairwise subject
+// identifiers but no salt was set through SetPairwiseSalt.
+var ErrPairwiseSaltRequired = errors.New("pairwise subject identifiers require a salt")
+
+// sectorIdentifier returns the sector the client belongs to, which is the host
+// of its redirect URL unless one was registered.
+// -- http://openid.net/specs/openid-connect-core-1_0.html#PairwiseAlg
+func sectorIdentifier(cinfo types.Client) string {
+	if cinfo.SectorIdentifier != "" {
+		return cinfo.SectorIdentifier
+	}
+
+	if cinfo.RedirectURL != nil {
+		return cinfo.RedirectURL.Host
+	}
+	return ""
+}
+
+// subjectFor returns the identifier of the resource owner as seen by the
+// client. Pairwise identifiers are calculated as
+// base64url(SHA-256(sector_identifier || subject || salt)), so they are stable
+// for a given sector but can't be correlated across sectors.
+func subjectFor(cfg config, cinfo types.Client, subject string) (string, error) {
+	if cinfo.SubjectType != types.SubjectPairwise || subject == "" {
+		return subject, nil
+	}
+
+	if len(cfg.pairwiseSalt) == 0 {
+		return "", ErrPairwiseSaltRequired
+	}
+
+	h := sha256.New()
+	h.Write([]byte(sectorIdentifier(cinfo)))
+	h.Write([]byte(subject))
+	h.Write(cfg.pairwiseSalt)
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,75 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package oauth2
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"net/url"
+	"testing"
+
+	"github.com/hooklift/oauth2/internal/jose"
+	"github.com/hooklift/oauth2/types"
+)
+
+// TestPairwiseSubject tests that pairwise subject identifiers are stable
+// within a sector and different across sectors.
+func TestPairwiseSubject(t *testing.T) {
+	cfg := setupTest()
+
+	public := types.Client{ID: "public"}
+	public.RedirectURL, _ = url.Parse("https://example.com/callback")
+
+	a := types.Client{ID: "a", SubjectType: types.SubjectPairwise}
+	a.RedirectURL, _ = url.Parse("https://a.example.com/callback")
+
+	sameSector := types.Client{ID: "a2", SubjectType: types.SubjectPairwise, SectorIdentifier: "a.example.com"}
+	sameSector.RedirectURL, _ = url.Parse("https://other.example.com/callback")
+
+	b := types.Client{ID: "b", SubjectType: types.SubjectPairwise}
+	b.RedirectURL, _ = url.Parse("https://b.example.com/callback")
+
+	_, err := subjectFor(cfg, a, "test_user")
+	equals(t, ErrPairwiseSaltRequired, err)
+
+	SetPairwiseSalt([]byte("pairwise-salt"))(&cfg)
+
+	sub, err := subjectFor(cfg, public, "test_user")
+	ok(t, err)
+	equals(t, "test_user", sub)
+
+	subA, err := subjectFor(cfg, a, "test_user")
+	ok(t, err)
+	assert(t, subA != "test_user", "pairwise subject should not reveal the local identifier")
+
+	sub, err = subjectFor(cfg, sameSector, "test_user")
+	ok(t, err)
+	equals(t, subA, sub)
+
+	subB, err := subjectFor(cfg, b, "test_user")
+	ok(t, err)
+	assert(t, subA != subB, "clients from different sectors should get different subjects")
+
+	sub, err = subjectFor(cfg, a, "another_user")
+	ok(t, err)
+	assert(t, subA != sub, "resource owners should get different subjects")
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ok(t, err)
+	SetIssuer("https://example.com")(&cfg)
+	SetSigningKeys(SigningKey{ID: "key-1", Key: key})(&cfg)
+
+	token, err := idToken(cfg, a, types.Session{Subject: "test_user"}, "", "", "")
+	ok(t, err)
+
+	payload, err := jose.Verify(token, &key.PublicKey)
+	ok(t, err)
+
+	claims := idTokenClaims{}
+	ok(t, json.Unmarshal(payload, &claims))
+	equals(t, subA, claims.Subject)
+}
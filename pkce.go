@@ -0,0 +1,81 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package oauth2
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+
+	"github.com/hooklift/oauth2/types"
+)
+
+// Proof Key for Code Exchange, as described in https://tools.ietf.org/html/rfc7636
+
+// validCodeVerifier checks that v complies with
+// code-verifier = 43*128unreserved, which also applies to plain code challenges.
+// -- https://tools.ietf.org/html/rfc7636#section-4.1
+func validCodeVerifier(v string) bool {
+	if len(v) < 43 || len(v) > 128 {
+		return false
+	}
+
+	for _, c := range v {
+		switch {
+		case c >= 'A' && c <= 'Z', c >= 'a' && c <= 'z', c >= '0' && c <= '9':
+		case c == '-', c == '.', c == '_', c == '~':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// codeChallenge validates the PKCE parameters of an authorization request,
+// returning the challenge method to store along with the authorization code.
+// Public clients, and every client if the profile in use says so, are required
+// to send a code challenge.
+func codeChallenge(cfg config, cinfo types.Client, challenge, method, state string) (string, *types.AuthzError) {
+	if challenge == "" {
+		if cinfo.Public() || cfg.profile.RequirePKCE {
+			e := ErrCodeChallengeRequired(state)
+			return "", &e
+		}
+		return "", nil
+	}
+
+	// Defaults to "plain" if not present in the request.
+	// -- https://tools.ietf.org/html/rfc7636#section-4.3
+	if method == "" {
+		method = "plain"
+	}
+
+	if method != "S256" && (method != "plain" || cfg.profile.RequireS256) {
+		e := ErrUnsupportedCodeChallengeMethod(state)
+		return "", &e
+	}
+
+	if !validCodeVerifier(challenge) {
+		e := ErrInvalidCodeChallenge(state)
+		return "", &e
+	}
+	return method, nil
+}
+
+// verifyCodeVerifier checks the code verifier sent to the token endpoint
+// against the code challenge stored with the authorization code.
+// -- https://tools.ietf.org/html/rfc7636#section-4.6
+func verifyCodeVerifier(grant types.Grant, verifier string) bool {
+	if !validCodeVerifier(verifier) {
+		return false
+	}
+
+	challenge := verifier
+	if grant.CodeChallengeMethod == "S256" {
+		sum := sha256.Sum256([]byte(verifier))
+		challenge = base64.RawURLEncoding.EncodeToString(sum[:])
+	}
+	return subtle.ConstantTimeCompare([]byte(challenge), []byte(grant.CodeChallenge)) == 1
+}
@@ -0,0 +1,72 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package oauth2
+
+import (
+	"time"
+
+	"github.com/hooklift/oauth2/types"
+)
+
+// Client policies are defined by types.Client and enforced consistently by
+// the authorization and token endpoints.
+
+// allowed returns whether value is in values. Empty lists allow any value.
+func allowed(values []string, value string) bool {
+	if len(values) == 0 {
+		return true
+	}
+
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// allowedResponseType returns whether the client is allowed to use the
+// normalized response type.
+func allowedResponseType(cinfo types.Client, responseType string) bool {
+	if len(cinfo.ResponseTypes) == 0 {
+		return true
+	}
+
+	for _, v := range cinfo.ResponseTypes {
+		if normalizeResponseType(v) == responseType {
+			return true
+		}
+	}
+	return false
+}
+
+// scopesAllowed returns whether the client is allowed to request scopes.
+func scopesAllowed(cfg config, cinfo types.Client, scopes types.Scopes) bool {
+	if len(cinfo.Scopes) == 0 {
+		return true
+	}
+	return cfg.scopeMatcher.Covers(cinfo.Scopes, scopes)
+}
+
+// tokenExpiration returns the lifetime of access tokens issued to the client.
+func tokenExpiration(cfg config, cinfo types.Client) time.Duration {
+	if cinfo.AccessTokenLifetime > 0 {
+		return cinfo.AccessTokenLifetime
+	}
+	return cfg.tokenExpiration
+}
+
+// authzExpiration returns the lifetime of authorization codes issued to the client.
+func authzExpiration(cfg config, cinfo types.Client) time.Duration {
+	if cinfo.AuthzCodeLifetime > 0 {
+		return cinfo.AuthzCodeLifetime
+	}
+	return cfg.authzExpiration
+}
+
+// issueRefreshToken returns whether refresh tokens can be issued to the client.
+func issueRefreshToken(cfg config, cinfo types.Client) bool {
+	return !cinfo.Public() || cfg.refreshToken.publicClients
+}
@@ -0,0 +1,56 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package oauth2
+
+// Profile groups security requirements enforced on top of RFC 6749, so
+// deployments can opt into a whole set of them at once through SetProfile.
+// Redirect URIs are always matched exactly against the registered ones, so
+// there is no requirement to configure for it.
+type Profile struct {
+	// Profile's name, used in log messages.
+	Name string
+	// Rejects authorization requests using the implicit flow, response type "token".
+	DisableImplicit bool
+	// Rejects token requests using the resource owner password credentials grant.
+	DisablePassword bool
+	// Requires every client, not only public ones, to send a PKCE code challenge.
+	RequirePKCE bool
+	// Rejects the "plain" PKCE code challenge method.
+	RequireS256 bool
+	// Rejects access tokens sent in the URI query string to resource servers.
+	ForbidQueryToken bool
+	// Revokes refresh tokens the provider did not rotate when refreshing.
+	RequireRefreshRotation bool
+	// Requires an issuer identifier to be configured through SetIssuer, so it
+	// is added to authorization responses as described in
+	// https://tools.ietf.org/html/rfc9207
+	IssuerParameter bool
+}
+
+// OAuth21 follows the OAuth 2.1 draft and the OAuth 2.0 Security Best Current
+// Practice: https://tools.ietf.org/html/draft-ietf-oauth-v2-1 and
+// https://tools.ietf.org/html/draft-ietf-oauth-security-topics
+var OAuth21 = Profile{
+	Name:                   "OAuth 2.1",
+	DisableImplicit:        true,
+	DisablePassword:        true,
+	RequirePKCE:            true,
+	ForbidQueryToken:       true,
+	RequireRefreshRotation: true,
+	IssuerParameter:        true,
+}
+
+// FAPI2Baseline follows the FAPI 2.0 Security Profile baseline requirements
+// this package is able to enforce: https://openid.net/specs/fapi-2_0-security-profile.html
+var FAPI2Baseline = Profile{
+	Name:                   "FAPI 2.0 Baseline",
+	DisableImplicit:        true,
+	DisablePassword:        true,
+	RequirePKCE:            true,
+	RequireS256:            true,
+	ForbidQueryToken:       true,
+	RequireRefreshRotation: true,
+	IssuerParameter:        true,
+}
@@ -0,0 +1,115 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package oauth2
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/hooklift/oauth2/providers/test"
+	"github.com/hooklift/oauth2/types"
+)
+
+// TestOAuth21Profile tests that the OAuth 2.1 profile rejects the flows it
+// disables and adds the issuer to authorization responses.
+func TestOAuth21Profile(t *testing.T) {
+	cfg := setupTest()
+	provider := test.NewProvider(true)
+	cfg.provider = provider
+	SetProfile(OAuth21)(&cfg)
+	SetIssuer("https://example.com")(&cfg)
+
+	authzRequest := func(values url.Values) url.Values {
+		req, err := http.NewRequest("GET", "https://example.com/oauth2/authzs?"+values.Encode(), nil)
+		ok(t, err)
+
+		w := httptest.NewRecorder()
+		CreateGrant(w, req, cfg)
+		equals(t, http.StatusFound, w.Code)
+
+		u, err := url.Parse(w.Header().Get("Location"))
+		ok(t, err)
+		if u.Fragment != "" {
+			query, err := url.ParseQuery(u.Fragment)
+			ok(t, err)
+			return query
+		}
+		return u.Query()
+	}
+
+	values := url.Values{
+		"client_id":     {provider.Client.ID},
+		"response_type": {"token"},
+		"state":         {"state-test"},
+		"redirect_uri":  {provider.Client.RedirectURL.String()},
+		"scope":         {"read"},
+	}
+
+	query := authzRequest(values)
+	equals(t, "unsupported_response_type", query.Get("error"))
+	equals(t, "https://example.com", query.Get("iss"))
+
+	// Confidential clients are also required to use PKCE.
+	values.Set("response_type", "code")
+	query = authzRequest(values)
+	equals(t, "invalid_request", query.Get("error"))
+
+	values.Set("code_challenge", "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk")
+	values.Set("decision", "approve")
+	w := authzPostTest(t, cfg, values)
+	equals(t, http.StatusFound, w.Code)
+
+	u, err := url.Parse(w.Header().Get("Location"))
+	ok(t, err)
+	assert(t, u.Query().Get("code") != "", "we were expecting an authorization code: %s", u)
+	equals(t, "https://example.com", u.Query().Get("iss"))
+
+	buffer := bytes.NewBufferString(url.Values{
+		"grant_type": {"password"},
+		"username":   {"test_user"},
+		"password":   {"test_password"},
+	}.Encode())
+	req, err := http.NewRequest("POST", "https://example.com/oauth2/tokens", buffer)
+	ok(t, err)
+	req.Header.Set("Content-type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth("testclient", "testclient")
+
+	w = httptest.NewRecorder()
+	IssueToken(w, req, cfg)
+	equals(t, http.StatusBadRequest, w.Code)
+
+	appErr := types.AuthzError{}
+	err = json.Unmarshal(w.Body.Bytes(), &appErr)
+	ok(t, err)
+	equals(t, "unsupported_grant_type", appErr.Code)
+}
+
+// TestQueryAccessToken tests that profiles can forbid resource servers from
+// accepting access tokens in the URI query string.
+func TestQueryAccessToken(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.Handle("/protected_resource", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("success!"))
+	}))
+
+	provider, token := getAccessTokenTest(t)
+	ts := httptest.NewServer(AuthzHandler(mux, provider, SetProfile(OAuth21)))
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL + "/protected_resource?access_token=" + token.Value)
+	ok(t, err)
+	equals(t, http.StatusBadRequest, res.StatusCode)
+
+	req, err := http.NewRequest("GET", ts.URL+"/protected_resource", nil)
+	ok(t, err)
+	req.Header.Set("Authorization", "Bearer "+token.Value)
+	res, err = http.DefaultClient.Do(req)
+	ok(t, err)
+	equals(t, http.StatusOK, res.StatusCode)
+}
@@ -4,13 +4,14 @@
 package test
 
 import (
+	"net/http"
 	"net/url"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/hooklift/oauth2/tokengen"
 	"github.com/hooklift/oauth2/types"
-	"github.com/satori/go.uuid"
 )
 
 type Provider struct {
@@ -18,6 +19,12 @@ type Provider struct {
 	Grants              map[string]types.Grant
 	AccessTokens        map[string]types.Token
 	RefreshTokens       map[string]types.Token
+	Consents            map[string]types.Consent
+	AuthTime            time.Time
+	ACR                 string
+	ScopeACRs           map[string]string
+	ScopeMaxAges        map[string]time.Duration
+	KeepRefreshTokens   bool
 	isUserAuthenticated bool
 }
 
@@ -26,6 +33,7 @@ func NewProvider(isUserAuthenticated bool) *Provider {
 		Grants:        make(map[string]types.Grant),
 		AccessTokens:  make(map[string]types.Token),
 		RefreshTokens: make(map[string]types.Token),
+		Consents:      make(map[string]types.Consent),
 	}
 
 	p.isUserAuthenticated = isUserAuthenticated
@@ -44,13 +52,16 @@ func (p *Provider) ClientInfo(clientID string) (types.Client, error) {
 	return p.Client, nil
 }
 
-func (p *Provider) GenGrant(client types.Client, scopes types.Scopes, expiration time.Duration) (types.Grant, error) {
-	a := types.Grant{
-		Code:        uuid.NewV4().String(),
-		ClientID:    client.ID,
-		RedirectURL: client.RedirectURL,
-		Scopes:      scopes,
+func (p *Provider) GenGrant(grant types.Grant, client types.Client, expiration time.Duration) (types.Grant, error) {
+	code, err := tokengen.AuthzCodes.Generate()
+	if err != nil {
+		return types.Grant{}, err
 	}
+
+	a := grant
+	a.Code = code
+	a.ClientID = client.ID
+	a.RedirectURL = client.RedirectURL
 	a.ExpiresIn = time.Now().Add(expiration)
 
 	p.Grants[a.Code] = a
@@ -64,22 +75,33 @@ func (p *Provider) ScopesInfo(scopes string) (types.Scopes, error) {
 		scope = append(scope, types.Scope{
 			ID:          v,
 			Description: "test scope",
+			ACR:         p.ScopeACRs[v],
+			MaxAge:      p.ScopeMaxAges[v],
 		})
 	}
 	return scope, nil
 }
 
 func (p *Provider) GenToken(grant types.Grant, client types.Client, refreshToken bool, expiration time.Duration) (types.Token, error) {
+	value, err := tokengen.AccessTokens.Generate()
+	if err != nil {
+		return types.Token{}, err
+	}
+
 	t := types.Token{
-		Value:    uuid.NewV4().String(),
+		Value:    value,
 		Type:     "bearer",
 		Scopes:   grant.Scopes,
 		ClientID: client.ID,
+		ACR:      grant.ACR,
+		AuthTime: grant.AuthTime,
 	}
 
 	t.ExpiresIn = strconv.FormatFloat(expiration.Seconds(), 'f', -1, 64)
 	if refreshToken {
-		t.RefreshToken = uuid.NewV4().String()
+		if t.RefreshToken, err = tokengen.RefreshTokens.Generate(); err != nil {
+			return types.Token{}, err
+		}
 		p.RefreshTokens[t.RefreshToken] = t
 	}
 
@@ -92,29 +114,126 @@ func (p *Provider) GenToken(grant types.Grant, client types.Client, refreshToken
 	return t, nil
 }
 
+func (p *Provider) SaveGrant(grant types.Grant) error {
+	p.Grants[grant.Code] = grant
+	return nil
+}
+
+func (p *Provider) SaveToken(grant types.Grant, token types.Token) error {
+	if token.RefreshToken != "" {
+		p.RefreshTokens[token.RefreshToken] = token
+	}
+
+	if v, ok := p.Grants[grant.Code]; ok {
+		v.Status = types.GrantUsed
+		p.Grants[grant.Code] = v
+	}
+
+	p.AccessTokens[token.Value] = token
+	return nil
+}
+
 func (p *Provider) RevokeToken(token string) error {
 	delete(p.AccessTokens, token)
 	delete(p.RefreshTokens, token)
 	return nil
 }
 
-func (p *Provider) RefreshToken(refreshToken types.Token, scopes types.Scopes) (types.Token, error) {
-	// Revokes existing refresh token
-	delete(p.RefreshTokens, refreshToken.Value)
-
+func (p *Provider) RefreshToken(refreshToken types.Token, scopes types.Scopes, expiration time.Duration) (types.Token, error) {
 	grant := types.Grant{
-		Scopes: scopes,
+		Scopes:   scopes,
+		ACR:      refreshToken.ACR,
+		AuthTime: refreshToken.AuthTime,
 	}
-
-	return p.GenToken(grant, types.Client{
+	client := types.Client{
 		ID: refreshToken.ClientID,
-	}, true, time.Duration(10)*time.Minute)
+	}
+
+	if p.KeepRefreshTokens {
+		t, err := p.GenToken(grant, client, false, expiration)
+		if err != nil {
+			return types.Token{}, err
+		}
+
+		t.RefreshToken = refreshToken.RefreshToken
+		p.RefreshTokens[t.RefreshToken] = t
+		p.AccessTokens[t.Value] = t
+		return t, nil
+	}
+
+	// Revokes existing refresh token
+	delete(p.RefreshTokens, refreshToken.RefreshToken)
+
+	return p.GenToken(grant, client, true, expiration)
 }
 
 func (p *Provider) IsUserAuthenticated() bool {
 	return p.isUserAuthenticated
 }
 
+func (p *Provider) UserSession(req *http.Request) (types.Session, error) {
+	if !p.isUserAuthenticated {
+		return types.Session{}, nil
+	}
+	return types.Session{
+		Subject:   "test_user",
+		AuthTime:  p.AuthTime,
+		ACR:       p.ACR,
+		SessionID: "test_session",
+	}, nil
+}
+
+func (p *Provider) Consent(subject, clientID string) (types.Consent, error) {
+	return p.Consents[subject+":"+clientID], nil
+}
+
+func (p *Provider) SaveConsent(consent types.Consent) error {
+	p.Consents[consent.Subject+":"+consent.ClientID] = consent
+	return nil
+}
+
+func (p *Provider) RevokeConsent(subject, clientID string) error {
+	delete(p.Consents, subject+":"+clientID)
+	return nil
+}
+
+func (p *Provider) AuthorizedClients(subject string) ([]types.AuthorizedClient, error) {
+	var clients []types.AuthorizedClient
+	for _, c := range p.Consents {
+		if c.Subject != subject {
+			continue
+		}
+
+		clients = append(clients, types.AuthorizedClient{
+			Client: p.Client,
+			Scopes: c.Scopes,
+		})
+	}
+	return clients, nil
+}
+
+func (p *Provider) RevokeClient(subject, clientID string) error {
+	for k, v := range p.AccessTokens {
+		if v.ClientID == clientID {
+			delete(p.AccessTokens, k)
+		}
+	}
+
+	for k, v := range p.RefreshTokens {
+		if v.ClientID == clientID {
+			delete(p.RefreshTokens, k)
+		}
+	}
+
+	for k, v := range p.Grants {
+		if v.ClientID == clientID {
+			v.Status = types.GrantRevoked
+			p.Grants[k] = v
+		}
+	}
+	return nil
+}
+
 func (p *Provider) AuthenticateClient(username, password string) (types.Client, error) {
 	if username == "boo" {
 		c := types.Client{
@@ -140,13 +259,35 @@ func (p *Provider) TokenInfo(code string) (types.Token, error) {
 }
 
 func (p *Provider) AuthenticateUser(username, password string) bool {
-	return true
+	return password != "wrong_password"
+}
+
+// LoginUser identifies resource owners by their username, regardless of case
+// and surrounding whitespace.
+func (p *Provider) LoginUser(username, password string) (types.Session, error) {
+	if !p.AuthenticateUser(username, password) {
+		return types.Session{}, nil
+	}
+
+	return types.Session{
+		Subject: strings.ToLower(strings.TrimSpace(username)),
+		ACR:     p.ACR,
+	}, nil
 }
 
 func (p *Provider) ResourceScopes(url *url.URL) (types.Scopes, error) {
 	return types.Scopes{
-		types.Scope{ID: "identity"},
-		types.Scope{ID: "read"},
-		types.Scope{ID: "write"},
+		types.Scope{ID: "identity", ACR: p.ScopeACRs["identity"]},
+		types.Scope{ID: "read", ACR: p.ScopeACRs["read"]},
+		types.Scope{ID: "write", ACR: p.ScopeACRs["write"]},
 	}, nil
 }
+
+func (p *Provider) SessionClients(session types.Session) ([]types.Client, error) {
+	return []types.Client{p.Client}, nil
+}
+
+func (p *Provider) EndSession(w http.ResponseWriter, req *http.Request, session types.Session) error {
+	p.isUserAuthenticated = false
+	return nil
+}
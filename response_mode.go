@@ -0,0 +1,167 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package oauth2
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/hooklift/oauth2/internal/jose"
+	"github.com/hooklift/oauth2/internal/render"
+	"github.com/hooklift/oauth2/types"
+)
+
+// Response modes, as described in
+// http://openid.net/specs/oauth-v2-multiple-response-types-1_0.html#ResponseModes,
+// http://openid.net/specs/oauth-v2-form-post-response-mode-1_0.html and
+// https://openid.net/specs/oauth-v2-jarm.html#section-2.3
+const (
+	responseModeQuery    = "query"
+	responseModeFragment = "fragment"
+	responseModeFormPost = "form_post"
+	responseModeJWT      = "jwt"
+	jwtSuffix            = ".jwt"
+)
+
+// Lifetime of JWT-secured authorization responses, they are meant to be
+// processed right away by the client.
+const jarmExpiration = 10 * time.Minute
+
+// responseMode returns the response mode requested by the client or, if none
+// was requested, the default one for the response type.
+func responseMode(responseType, mode string) string {
+	if mode != "" && mode != responseModeJWT {
+		return mode
+	}
+
+	// Responses carrying tokens default to the fragment, so they don't reach
+	// the client's server.
+	base := responseModeQuery
+	if hasResponseType(responseType, "token") || hasResponseType(responseType, "id_token") {
+		base = responseModeFragment
+	}
+
+	if mode == responseModeJWT {
+		return base + jwtSuffix
+	}
+	return base
+}
+
+// validResponseMode returns whether mode is known and can be used with the
+// response type. Tokens must never be encoded in the query string, and
+// JWT-secured responses require an issuer and signing keys.
+func validResponseMode(cfg config, responseType, mode string) bool {
+	if mode == responseModeJWT || strings.HasSuffix(mode, jwtSuffix) {
+		if cfg.issuer == "" || len(cfg.signingKeys) == 0 {
+			return false
+		}
+		mode = strings.TrimSuffix(mode, jwtSuffix)
+	}
+
+	switch mode {
+	case "", responseModeJWT, responseModeFragment, responseModeFormPost:
+		return true
+	case responseModeQuery:
+		return !hasResponseType(responseType, "token") && !hasResponseType(responseType, "id_token")
+	}
+	return false
+}
+
+// respond delivers authorization response parameters to the client's
+// redirection URI using the given response mode. The issuer identifier is
+// always included if configured, so clients talking to several authorization
+// servers can defend themselves against mix-up attacks.
+// -- https://tools.ietf.org/html/rfc9207
+func respond(w http.ResponseWriter, req *http.Request, cfg config, cinfo types.Client, mode string, params url.Values) {
+	if cfg.issuer != "" {
+		params.Set("iss", cfg.issuer)
+	}
+
+	if strings.HasSuffix(mode, jwtSuffix) {
+		response, err := jarm(cfg, cinfo, params)
+		if err != nil {
+			log.Printf("[ERROR] Error securing authorization response: %v", err)
+			render.HTML(w, render.Options{
+				Status: http.StatusInternalServerError,
+				Data: AuthzData{
+					Errors: []types.AuthzError{
+						ErrServerError("", err),
+					}},
+				Template:  cfg.authzForm,
+				STSMaxAge: cfg.stsMaxAge,
+			})
+			return
+		}
+
+		params = url.Values{"response": {response}}
+		mode = strings.TrimSuffix(mode, jwtSuffix)
+	}
+
+	u := *cinfo.RedirectURL
+	switch mode {
+	case responseModeFormPost:
+		err := render.FormPost(w, render.Options{
+			Status:    http.StatusOK,
+			Data:      params,
+			STSMaxAge: cfg.stsMaxAge,
+		}, u.String())
+		if err != nil {
+			log.Printf("[ERROR] Error rendering form post response: %v", err)
+			render.HTML(w, render.Options{
+				Status: http.StatusInternalServerError,
+				Data: AuthzData{
+					Errors: []types.AuthzError{
+						ErrServerError("", err),
+					}},
+				Template:  cfg.authzForm,
+				STSMaxAge: cfg.stsMaxAge,
+			})
+		}
+		return
+	case responseModeFragment:
+		u.RawFragment = params.Encode()
+		u.Fragment, _ = url.PathUnescape(u.RawFragment)
+	default:
+		query := u.Query()
+		for k, v := range params {
+			query[k] = v
+		}
+		u.RawQuery = query.Encode()
+	}
+
+	http.Redirect(w, req, u.String(), http.StatusFound)
+}
+
+// redirectErr sends an authorization error back to the client through its
+// redirection URI.
+func redirectErr(w http.ResponseWriter, req *http.Request, cfg config, cinfo types.Client, mode string, e types.AuthzError) {
+	respond(w, req, cfg, cinfo, mode, errParams(e))
+}
+
+// jarm returns the authorization response parameters as a single JWT, signed
+// with the server's key and encrypted for the client if it registered a key.
+// -- https://openid.net/specs/oauth-v2-jarm.html#section-2.1
+func jarm(cfg config, cinfo types.Client, params url.Values) (string, error) {
+	claims := map[string]interface{}{
+		"aud": cinfo.ID,
+		"exp": time.Now().Add(jarmExpiration).Unix(),
+	}
+	for k := range params {
+		claims[k] = params.Get(k)
+	}
+
+	response, err := signJWT(cfg, cinfo.AuthzSignedResponseAlg, claims)
+	if err != nil {
+		return "", err
+	}
+
+	if cinfo.AuthzEncryptionKey == nil {
+		return response, nil
+	}
+	return jose.Encrypt(response, cinfo.AuthzEncryptionKeyID, cinfo.AuthzEncryptionKey)
+}
@@ -0,0 +1,115 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package oauth2
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/hooklift/oauth2/internal/render"
+	"github.com/hooklift/oauth2/types"
+)
+
+// RevocationHandlers is a map to functions where each function handles a
+// particular HTTP verb or method.
+var RevocationHandlers map[string]func(http.ResponseWriter, *http.Request, config) = map[string]func(http.ResponseWriter, *http.Request, config){
+	"POST": Revoke,
+}
+
+// Revoke implements https://tools.ietf.org/html/rfc7009
+//
+// The token_type_hint parameter is accepted but not needed since access and
+// refresh tokens are both looked up through Provider.TokenInfo. Revoking a
+// refresh token also revokes the access tokens issued along with it or by
+// refreshing it, as far as the lineage store tracks them.
+func Revoke(w http.ResponseWriter, req *http.Request, cfg config) {
+	// Failed client authentication is answered as the token endpoint does.
+	// -- https://tools.ietf.org/html/rfc7009#section-2.2.1
+	// -- https://tools.ietf.org/html/rfc6749#section-5.2
+	cinfo, ok := authenticateClient(req, cfg)
+	if !ok {
+		invalidClient(w, req)
+		return
+	}
+
+	token := req.PostFormValue("token")
+	if token == "" {
+		render.JSON(w, render.Options{
+			Status: http.StatusBadRequest,
+			Data:   ErrTokenRequired,
+		})
+		return
+	}
+
+	revokeToken(w, cfg, cinfo, token)
+}
+
+// revokeToken revokes token on behalf of the authenticated client.
+func revokeToken(w http.ResponseWriter, cfg config, cinfo types.Client, token string) {
+	provider := cfg.provider
+	token = storageKey(cfg, token)
+	tokenInfo, err := lookupToken(cfg, token)
+	if err != nil {
+		log.Printf("[ERROR] Error getting token info: %+v", err)
+		render.JSON(w, render.Options{
+			Status: http.StatusServiceUnavailable,
+		})
+		return
+	}
+
+	// Invalid tokens do not cause an error response since the client cannot
+	// handle such an error in a reasonable way.
+	// -- https://tools.ietf.org/html/rfc7009#section-2.2
+	if tokenInfo.Value == "" && tokenInfo.RefreshToken == "" {
+		render.JSON(w, render.Options{
+			Status: http.StatusOK,
+		})
+		return
+	}
+
+	if tokenInfo.ClientID != cinfo.ID {
+		render.JSON(w, render.Options{
+			Status: http.StatusBadRequest,
+			Data:   ErrClientIDMismatch,
+		})
+		return
+	}
+
+	revoke := []string{token}
+	// If the token passed to the request is a refresh token and the
+	// authorization server supports the revocation of access tokens, then the
+	// authorization server SHOULD also invalidate all access tokens based on
+	// the same authorization grant.
+	// -- https://tools.ietf.org/html/rfc7009#section-2.1
+	if tokenInfo.RefreshToken == token && tokenInfo.Value != "" && tokenInfo.Value != token {
+		revoke = append(revoke, tokenInfo.Value)
+	}
+
+	for _, t := range revoke {
+		if err := provider.RevokeToken(t); err != nil {
+			log.Printf("[ERROR] Error revoking token: %+v", err)
+			render.JSON(w, render.Options{
+				Status: http.StatusServiceUnavailable,
+			})
+			return
+		}
+	}
+
+	// Access tokens issued by refreshing the token without rotating it are
+	// based on the same grant too.
+	if tokenInfo.RefreshToken == token {
+		if _, err := revokeDerived(cfg, token); err != nil {
+			log.Printf("[ERROR] Error revoking tokens issued from refresh token: %+v", err)
+			render.JSON(w, render.Options{
+				Status: http.StatusServiceUnavailable,
+			})
+			return
+		}
+	}
+
+	render.JSON(w, render.Options{
+		Status: http.StatusOK,
+	})
+}
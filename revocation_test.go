@@ -0,0 +1,132 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package oauth2
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/hooklift/oauth2/providers/test"
+	"github.com/hooklift/oauth2/types"
+)
+
+func revocationRequestTest(t *testing.T, values url.Values) *http.Request {
+	buffer := bytes.NewBufferString(values.Encode())
+	req, err := http.NewRequest("POST", "https://example.com/oauth2/revoke", buffer)
+	ok(t, err)
+	req.Header.Set("Content-type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth("testclient", "testclient")
+	return req
+}
+
+// TestRevocation tests that revoking a refresh token also revokes its access
+// token, in accordance with https://tools.ietf.org/html/rfc7009#section-2.1
+func TestRevocation(t *testing.T) {
+	cfg, authzCode := getTestAuthzCode(t)
+	provider := cfg.provider.(*test.Provider)
+
+	req := AuthzGrantTokenRequestTest(t, "authorization_code", authzCode)
+	req.SetBasicAuth("testclient", "testclient")
+
+	w := httptest.NewRecorder()
+	IssueToken(w, req, cfg)
+
+	token := types.Token{}
+	err := json.Unmarshal(w.Body.Bytes(), &token)
+	ok(t, err)
+
+	w = httptest.NewRecorder()
+	Revoke(w, revocationRequestTest(t, url.Values{
+		"token":           {token.RefreshToken},
+		"token_type_hint": {"refresh_token"},
+	}), cfg)
+	equals(t, http.StatusOK, w.Code)
+
+	_, found := provider.RefreshTokens[token.RefreshToken]
+	equals(t, false, found)
+	_, found = provider.AccessTokens[token.Value]
+	equals(t, false, found)
+}
+
+// TestRevocationRefreshedTokens tests that revoking a refresh token also
+// revokes the access tokens issued by refreshing it.
+func TestRevocationRefreshedTokens(t *testing.T) {
+	cfg, authzCode := getTestAuthzCode(t)
+	provider := cfg.provider.(*test.Provider)
+	provider.KeepRefreshTokens = true
+
+	req := AuthzGrantTokenRequestTest(t, "authorization_code", authzCode)
+	req.SetBasicAuth("testclient", "testclient")
+
+	w := httptest.NewRecorder()
+	IssueToken(w, req, cfg)
+	equals(t, http.StatusOK, w.Code)
+
+	token := types.Token{}
+	ok(t, json.Unmarshal(w.Body.Bytes(), &token))
+
+	var refreshed []types.Token
+	for i := 0; i < 2; i++ {
+		w = refreshTokenRequestTest(t, cfg, token.RefreshToken)
+		equals(t, http.StatusOK, w.Code)
+
+		t2 := types.Token{}
+		ok(t, json.Unmarshal(w.Body.Bytes(), &t2))
+		equals(t, token.RefreshToken, t2.RefreshToken)
+		refreshed = append(refreshed, t2)
+	}
+
+	w = httptest.NewRecorder()
+	Revoke(w, revocationRequestTest(t, url.Values{
+		"token": {token.RefreshToken},
+	}), cfg)
+	equals(t, http.StatusOK, w.Code)
+
+	for _, t2 := range refreshed {
+		_, found := provider.AccessTokens[t2.Value]
+		assert(t, !found, "access token issued by refreshing should have been revoked: %s", t2.Value)
+	}
+}
+
+// TestRevocationUnknownToken tests that invalid tokens do not cause an error
+// response. https://tools.ietf.org/html/rfc7009#section-2.2
+func TestRevocationUnknownToken(t *testing.T) {
+	cfg := setupTest()
+	cfg.provider = test.NewProvider(true)
+
+	w := httptest.NewRecorder()
+	Revoke(w, revocationRequestTest(t, url.Values{
+		"token":           {"unknown"},
+		"token_type_hint": {"something_else"},
+	}), cfg)
+	equals(t, http.StatusOK, w.Code)
+
+	w = httptest.NewRecorder()
+	Revoke(w, revocationRequestTest(t, url.Values{}), cfg)
+	equals(t, http.StatusBadRequest, w.Code)
+}
+
+// TestRevocationClientAuthentication tests that unauthenticated clients get
+// an invalid_client error, in accordance with
+// https://tools.ietf.org/html/rfc7009#section-2.2.1
+func TestRevocationClientAuthentication(t *testing.T) {
+	cfg := setupTest()
+	cfg.provider = test.NewProvider(true)
+
+	req := revocationRequestTest(t, url.Values{"token": {"unknown"}})
+	req.Header.Del("Authorization")
+
+	w := httptest.NewRecorder()
+	Revoke(w, req, cfg)
+	equals(t, http.StatusUnauthorized, w.Code)
+
+	e := types.AuthzError{}
+	ok(t, json.Unmarshal(w.Body.Bytes(), &e))
+	equals(t, ErrInvalidClient.Code, e.Code)
+}
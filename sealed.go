@@ -0,0 +1,231 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package oauth2
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/hooklift/oauth2/tokengen"
+	"github.com/hooklift/oauth2/types"
+)
+
+// sealedCodeAD is the additional data authenticated along with sealed
+// authorization codes, so they can't be confused with other encrypted values.
+const sealedCodeAD = "oauth2_code"
+
+// ErrInvalidSealedCode is returned when a sealed authorization code was not
+// issued by this server or was tampered with.
+var ErrInvalidSealedCode = errors.New("authorization code is invalid")
+
+// ReplayCache enforces single use of sealed authorization codes, see
+// SetSealedCodes. It only has to remember codes until they expire.
+type ReplayCache interface {
+	// Use records that the code identified by id was redeemed, returning
+	// false if it already was. The entry can be dropped after expiresAt.
+	Use(id string, expiresAt time.Time) (bool, error)
+}
+
+// memoryReplayCache is an in-memory ReplayCache.
+type memoryReplayCache struct {
+	sync.Mutex
+	used map[string]time.Time
+}
+
+// NewMemoryReplayCache returns a ReplayCache keeping redeemed codes in memory.
+// It is only suitable for single instance deployments, since codes redeemed
+// on one instance could be replayed on another.
+func NewMemoryReplayCache() ReplayCache {
+	return &memoryReplayCache{
+		used: make(map[string]time.Time),
+	}
+}
+
+func (m *memoryReplayCache) Use(id string, expiresAt time.Time) (bool, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	now := time.Now()
+	for k, exp := range m.used {
+		if exp.Before(now) {
+			delete(m.used, k)
+		}
+	}
+
+	if _, ok := m.used[id]; ok {
+		return false, nil
+	}
+	m.used[id] = expiresAt
+	return true, nil
+}
+
+// sealedGrant is the payload of sealed authorization codes.
+type sealedGrant struct {
+	ID                  string `json:"jti"`
+	ClientID            string `json:"client_id"`
+	RedirectURL         string `json:"redirect_uri,omitempty"`
+	Scope               string `json:"scope,omitempty"`
+	RequestedScope      string `json:"requested_scope,omitempty"`
+	CodeChallenge       string `json:"code_challenge,omitempty"`
+	CodeChallengeMethod string `json:"code_challenge_method,omitempty"`
+	Subject             string `json:"sub,omitempty"`
+	Nonce               string `json:"nonce,omitempty"`
+	AuthTime            int64  `json:"auth_time,omitempty"`
+	ACR                 string `json:"acr,omitempty"`
+	Expires             int64  `json:"exp"`
+}
+
+// sealedCodes returns whether authorization codes are sealed instead of
+// stored by the provider.
+func sealedCodes(cfg config) bool {
+	return len(cfg.sealed.key) > 0
+}
+
+func sealedCodeCipher(cfg config) (cipher.AEAD, error) {
+	if len(cfg.sealed.key) != 32 {
+		return nil, errors.New("sealed codes key must be 32 bytes long")
+	}
+
+	block, err := aes.NewCipher(cfg.sealed.key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealGrant returns grant with its Code set to the grant itself, encrypted
+// and authenticated with the sealed codes key.
+func sealGrant(cfg config, grant types.Grant, cinfo types.Client, expiration time.Duration) (types.Grant, error) {
+	id, err := tokengen.Generator{Entropy: 16}.Generate()
+	if err != nil {
+		return grant, err
+	}
+
+	grant.ClientID = cinfo.ID
+	grant.RedirectURL = cinfo.RedirectURL
+	grant.ExpiresIn = time.Now().Add(expiration)
+
+	payload := sealedGrant{
+		ID:                  id,
+		ClientID:            grant.ClientID,
+		Scope:               grant.Scopes.Encode(),
+		RequestedScope:      grant.RequestedScopes.Encode(),
+		CodeChallenge:       grant.CodeChallenge,
+		CodeChallengeMethod: grant.CodeChallengeMethod,
+		Subject:             grant.Subject,
+		Nonce:               grant.Nonce,
+		ACR:                 grant.ACR,
+		Expires:             grant.ExpiresIn.Unix(),
+	}
+
+	if grant.RedirectURL != nil {
+		payload.RedirectURL = grant.RedirectURL.String()
+	}
+
+	if !grant.AuthTime.IsZero() {
+		payload.AuthTime = grant.AuthTime.Unix()
+	}
+
+	plaintext, err := json.Marshal(payload)
+	if err != nil {
+		return grant, err
+	}
+
+	aead, err := sealedCodeCipher(cfg)
+	if err != nil {
+		return grant, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return grant, err
+	}
+
+	grant.Code = base64.RawURLEncoding.EncodeToString(aead.Seal(nonce, nonce, plaintext, []byte(sealedCodeAD)))
+	return grant, nil
+}
+
+// openGrant decrypts a sealed authorization code. The returned grant's Code is
+// the identifier of the sealed code, which is what tokens issued from it are
+// linked to. Single use is not recorded until redeemSealedGrant is called.
+func openGrant(cfg config, code string) (types.Grant, error) {
+	sealed, err := base64.RawURLEncoding.DecodeString(code)
+	if err != nil {
+		return types.Grant{}, ErrInvalidSealedCode
+	}
+
+	aead, err := sealedCodeCipher(cfg)
+	if err != nil {
+		return types.Grant{}, err
+	}
+
+	if len(sealed) < aead.NonceSize() {
+		return types.Grant{}, ErrInvalidSealedCode
+	}
+
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, []byte(sealedCodeAD))
+	if err != nil {
+		return types.Grant{}, ErrInvalidSealedCode
+	}
+
+	var payload sealedGrant
+	if err := json.Unmarshal(plaintext, &payload); err != nil || payload.ID == "" {
+		return types.Grant{}, ErrInvalidSealedCode
+	}
+
+	grant := types.Grant{
+		Code:                payload.ID,
+		ClientID:            payload.ClientID,
+		ExpiresIn:           time.Unix(payload.Expires, 0),
+		CodeChallenge:       payload.CodeChallenge,
+		CodeChallengeMethod: payload.CodeChallengeMethod,
+		Subject:             payload.Subject,
+		Nonce:               payload.Nonce,
+		ACR:                 payload.ACR,
+	}
+
+	if payload.AuthTime != 0 {
+		grant.AuthTime = time.Unix(payload.AuthTime, 0)
+	}
+
+	if payload.RedirectURL != "" {
+		if grant.RedirectURL, err = url.Parse(payload.RedirectURL); err != nil {
+			return types.Grant{}, ErrInvalidSealedCode
+		}
+	}
+
+	if payload.Scope != "" {
+		if grant.Scopes, err = cfg.provider.ScopesInfo(payload.Scope); err != nil {
+			return types.Grant{}, err
+		}
+	}
+
+	if payload.RequestedScope != "" {
+		if grant.RequestedScopes, err = cfg.provider.ScopesInfo(payload.RequestedScope); err != nil {
+			return types.Grant{}, err
+		}
+	}
+
+	if !time.Now().Before(grant.ExpiresIn) {
+		grant.Status = types.GrantExpired
+	}
+	return grant, nil
+}
+
+// redeemSealedGrant records the redemption of a sealed authorization code in
+// the replay cache, returning false if it was already redeemed. It must only
+// be called once the client has proven it owns the code, so failed attempts
+// don't burn it.
+func redeemSealedGrant(cfg config, grant types.Grant) (bool, error) {
+	return cfg.sealed.cache.Use(grant.Code, grant.ExpiresIn)
+}
@@ -0,0 +1,126 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package oauth2
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hooklift/oauth2/providers/test"
+	"github.com/hooklift/oauth2/types"
+)
+
+// TestSealedCodes tests that sealed authorization codes are redeemed without
+// being stored by the provider, and only once.
+func TestSealedCodes(t *testing.T) {
+	cfg := setupTest()
+	provider := test.NewProvider(true)
+	cfg.provider = provider
+	SetSealedCodes(bytes.Repeat([]byte("s"), 32), nil)(&cfg)
+
+	w := authzPostTest(t, cfg, url.Values{
+		"client_id":     {provider.Client.ID},
+		"response_type": {"code"},
+		"state":         {"state-test"},
+		"redirect_uri":  {provider.Client.RedirectURL.String()},
+		"scope":         {"read write identity"},
+		"decision":      {"approve"},
+	})
+	equals(t, http.StatusFound, w.Code)
+	equals(t, 0, len(provider.Grants))
+
+	u, err := url.Parse(w.Header().Get("Location"))
+	ok(t, err)
+	code := u.Query().Get("code")
+	assert(t, code != "", "code was not issued: %s", u)
+
+	redeem := func(code string) *httptest.ResponseRecorder {
+		req := AuthzGrantTokenRequestTest(t, "authorization_code", code)
+		req.SetBasicAuth("test_client_id", "test_client_id")
+		w := httptest.NewRecorder()
+		IssueToken(w, req, cfg)
+		return w
+	}
+
+	w = redeem(code)
+	equals(t, http.StatusOK, w.Code)
+
+	token := types.Token{}
+	ok(t, json.Unmarshal(w.Body.Bytes(), &token))
+	stored, found := provider.AccessTokens[token.Value]
+	assert(t, found, "access token was not issued: %s", w.Body.String())
+	equals(t, "read write identity", stored.Scopes.Encode())
+
+	// Replaying the code is rejected and revokes tokens issued from it.
+	w = redeem(code)
+	equals(t, http.StatusBadRequest, w.Code)
+	_, found = provider.AccessTokens[token.Value]
+	assert(t, !found, "token issued from a replayed code should have been revoked")
+
+	// Tampered codes are rejected.
+	tampered := []byte(code)
+	tampered[len(tampered)/2] ^= 1
+	w = redeem(string(tampered))
+	equals(t, http.StatusBadRequest, w.Code)
+
+	// Expired codes are rejected.
+	grant, err := sealGrant(cfg, types.Grant{}, provider.Client, -time.Second)
+	ok(t, err)
+	w = redeem(grant.Code)
+	equals(t, http.StatusBadRequest, w.Code)
+}
+
+// TestSealedCodesFailedRedemption tests that sealed authorization codes are
+// not burnt by redemption attempts failing the client or PKCE checks.
+func TestSealedCodesFailedRedemption(t *testing.T) {
+	cfg := setupTest()
+	provider := test.NewProvider(true)
+	cfg.provider = provider
+	SetSealedCodes(bytes.Repeat([]byte("s"), 32), nil)(&cfg)
+
+	verifier := strings.Repeat("v", 43)
+	grant, err := sealGrant(cfg, types.Grant{
+		CodeChallenge:       verifier,
+		CodeChallengeMethod: "plain",
+	}, provider.Client, time.Duration(1)*time.Minute)
+	ok(t, err)
+
+	redeem := func(clientID, verifier string) *httptest.ResponseRecorder {
+		values := url.Values{
+			"grant_type":    {"authorization_code"},
+			"code":          {grant.Code},
+			"redirect_uri":  {"https://example.com/oauth2/callback"},
+			"code_verifier": {verifier},
+		}
+		req, err := http.NewRequest("POST", "https://example.com/oauth2/tokens", strings.NewReader(values.Encode()))
+		ok(t, err)
+		req.Header.Set("Content-type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth(clientID, clientID)
+
+		w := httptest.NewRecorder()
+		IssueToken(w, req, cfg)
+		return w
+	}
+
+	w := redeem("boo", verifier)
+	equals(t, http.StatusBadRequest, w.Code)
+
+	w = redeem("test_client_id", strings.Repeat("x", 43))
+	equals(t, http.StatusBadRequest, w.Code)
+	equals(t, 0, len(provider.AccessTokens))
+
+	w = redeem("test_client_id", verifier)
+	equals(t, http.StatusOK, w.Code)
+
+	w = redeem("test_client_id", verifier)
+	equals(t, http.StatusBadRequest, w.Code)
+	equals(t, 0, len(provider.AccessTokens))
+}
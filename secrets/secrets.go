@@ -0,0 +1,314 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package secrets hashes and verifies client secrets, so providers never need
+// to store them in plaintext. Clients can have several secrets valid at the
+// same time, allowing them to be rotated without downtime.
+package secrets
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hooklift/oauth2/types"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// Algorithm identifies a password hashing algorithm.
+type Algorithm string
+
+const (
+	// Argon2id, recommended for new deployments.
+	// -- https://tools.ietf.org/html/rfc9106
+	Argon2id Algorithm = "argon2id"
+	// Bcrypt with the default cost.
+	Bcrypt Algorithm = "bcrypt"
+	// PBKDF2 with HMAC-SHA256, for deployments requiring FIPS-approved algorithms.
+	// -- https://tools.ietf.org/html/rfc8018#section-5.2
+	PBKDF2 Algorithm = "pbkdf2-sha256"
+)
+
+// Hashing parameters, following the OWASP password storage recommendations.
+const (
+	argon2Time    = 2
+	argon2Memory  = 19 * 1024
+	argon2Threads = 1
+	pbkdf2Iter    = 600000
+	saltLen       = 16
+	keyLen        = 32
+
+	// Upper bounds of the parameters read from hashes, so a crafted or
+	// corrupted hash can't make Verify allocate too much memory, in KiB, or
+	// run for too long.
+	maxArgon2Memory = 1 << 20
+	maxArgon2Time   = 16
+	maxPBKDF2Iter   = 10 * pbkdf2Iter
+)
+
+var (
+	// ErrUnsupportedAlgorithm is returned when hashing with, or verifying a
+	// hash produced by, an unknown algorithm.
+	ErrUnsupportedAlgorithm = errors.New("secrets: unsupported hashing algorithm")
+	// ErrMalformedHash is returned when a hash can't be parsed.
+	ErrMalformedHash = errors.New("secrets: malformed hash")
+	// ErrInvalidCredentials is returned when a client can't be authenticated.
+	ErrInvalidCredentials = errors.New("secrets: invalid client credentials")
+)
+
+// Generate returns a new random client secret.
+func Generate() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// Hash hashes secret with a random salt, returning it encoded along with the
+// algorithm and its parameters, such as
+// "$argon2id$v=19$m=19456,t=2,p=1$<salt>$<hash>".
+func Hash(secret string, alg Algorithm) (string, error) {
+	if alg == Bcrypt {
+		h, err := bcrypt.GenerateFromPassword([]byte(secret), bcrypt.DefaultCost)
+		return string(h), err
+	}
+
+	salt := make([]byte, saltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	enc := base64.RawStdEncoding
+	switch alg {
+	case Argon2id:
+		key := argon2.IDKey([]byte(secret), salt, argon2Time, argon2Memory, argon2Threads, keyLen)
+		return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version,
+			argon2Memory, argon2Time, argon2Threads, enc.EncodeToString(salt), enc.EncodeToString(key)), nil
+	case PBKDF2:
+		key := pbkdf2.Key([]byte(secret), salt, pbkdf2Iter, keyLen, sha256.New)
+		return fmt.Sprintf("$pbkdf2-sha256$i=%d$%s$%s", pbkdf2Iter,
+			enc.EncodeToString(salt), enc.EncodeToString(key)), nil
+	}
+	return "", ErrUnsupportedAlgorithm
+}
+
+// Verify checks secret against a hash produced by Hash, in constant time.
+func Verify(secret, hash string) (bool, error) {
+	if strings.HasPrefix(hash, "$2a$") || strings.HasPrefix(hash, "$2b$") || strings.HasPrefix(hash, "$2y$") {
+		err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(secret))
+		if err == bcrypt.ErrMismatchedHashAndPassword {
+			return false, nil
+		}
+		return err == nil, err
+	}
+
+	parts := strings.Split(hash, "$")
+	enc := base64.RawStdEncoding
+	var key, expected []byte
+	switch {
+	case len(parts) == 6 && parts[1] == string(Argon2id):
+		var version int
+		var memory, passes uint32
+		var threads uint8
+		if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+			return false, ErrMalformedHash
+		}
+
+		if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &passes, &threads); err != nil {
+			return false, ErrMalformedHash
+		}
+
+		if passes < 1 || passes > maxArgon2Time || threads < 1 || memory > maxArgon2Memory {
+			return false, ErrMalformedHash
+		}
+
+		salt, err := enc.DecodeString(parts[4])
+		if err != nil {
+			return false, ErrMalformedHash
+		}
+
+		if expected, err = enc.DecodeString(parts[5]); err != nil || len(expected) == 0 {
+			return false, ErrMalformedHash
+		}
+		key = argon2.IDKey([]byte(secret), salt, passes, memory, threads, uint32(len(expected)))
+	case len(parts) == 5 && parts[1] == string(PBKDF2):
+		var iter int
+		if _, err := fmt.Sscanf(parts[2], "i=%d", &iter); err != nil || iter <= 0 || iter > maxPBKDF2Iter {
+			return false, ErrMalformedHash
+		}
+
+		salt, err := enc.DecodeString(parts[3])
+		if err != nil {
+			return false, ErrMalformedHash
+		}
+
+		if expected, err = enc.DecodeString(parts[4]); err != nil || len(expected) == 0 {
+			return false, ErrMalformedHash
+		}
+		key = pbkdf2.Key([]byte(secret), salt, iter, len(expected), sha256.New)
+	default:
+		return false, ErrUnsupportedAlgorithm
+	}
+
+	return subtle.ConstantTimeCompare(key, expected) == 1, nil
+}
+
+// Secret is a hashed client secret.
+type Secret struct {
+	// Secret hashed using Hash.
+	Hash string `db:"hash" json:"hash"`
+	// When the secret was created.
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+	// When the secret stops being valid. Secrets never expire if zero.
+	ExpiresAt time.Time `db:"expires_at" json:"expires_at"`
+}
+
+// Expired returns whether the secret is no longer valid.
+func (s Secret) Expired() bool {
+	return !s.ExpiresAt.IsZero() && !time.Now().Before(s.ExpiresAt)
+}
+
+// New generates a client secret, returning it in plaintext, to be handed to
+// the client once, along with its hashed version to be stored. A zero
+// lifetime creates a secret that never expires.
+func New(alg Algorithm, lifetime time.Duration) (string, Secret, error) {
+	plaintext, err := Generate()
+	if err != nil {
+		return "", Secret{}, err
+	}
+
+	hash, err := Hash(plaintext, alg)
+	if err != nil {
+		return "", Secret{}, err
+	}
+
+	s := Secret{Hash: hash, CreatedAt: time.Now()}
+	if lifetime > 0 {
+		s.ExpiresAt = s.CreatedAt.Add(lifetime)
+	}
+	return plaintext, s, nil
+}
+
+// Rotate adds a new secret to secrets, keeping the current ones valid for
+// grace so clients have time to switch over. Expired secrets are dropped.
+func Rotate(secrets []Secret, alg Algorithm, lifetime, grace time.Duration) (string, []Secret, error) {
+	plaintext, secret, err := New(alg, lifetime)
+	if err != nil {
+		return "", secrets, err
+	}
+
+	deadline := time.Now().Add(grace)
+	rotated := make([]Secret, 0, len(secrets)+1)
+	for _, s := range secrets {
+		if s.Expired() {
+			continue
+		}
+
+		if s.ExpiresAt.IsZero() || s.ExpiresAt.After(deadline) {
+			s.ExpiresAt = deadline
+		}
+		rotated = append(rotated, s)
+	}
+	return plaintext, append(rotated, secret), nil
+}
+
+// VerifyAny checks secret against every valid secret of a client.
+func VerifyAny(secret string, secrets []Secret) bool {
+	for _, s := range secrets {
+		if s.Expired() {
+			continue
+		}
+
+		if ok, err := Verify(secret, s.Hash); err == nil && ok {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientStore is implemented by storage backends keeping registered clients
+// along with their hashed secrets.
+type ClientStore interface {
+	// ClientInfo returns the registered client. A zero value is returned if
+	// there is none.
+	ClientInfo(clientID string) (types.Client, error)
+
+	// ClientSecrets returns the hashed secrets of the client.
+	ClientSecrets(clientID string) ([]Secret, error)
+}
+
+// Authenticator authenticates clients against the secrets kept in a
+// ClientStore. Providers can embed it to implement
+// oauth2.Provider.AuthenticateClient.
+type Authenticator struct {
+	Store ClientStore
+	// Algorithm the secrets are hashed with. Secrets sent for unknown
+	// clients are hashed with it too, so they take as long to be rejected.
+	Algorithm Algorithm
+}
+
+// NewAuthenticator returns an Authenticator for store, whose secrets are
+// hashed with alg.
+func NewAuthenticator(store ClientStore, alg Algorithm) *Authenticator {
+	return &Authenticator{Store: store, Algorithm: alg}
+}
+
+// AuthenticateClient returns the client identified by clientID if secret is
+// one of its valid secrets.
+func (a *Authenticator) AuthenticateClient(clientID, secret string) (types.Client, error) {
+	cinfo, err := a.Store.ClientInfo(clientID)
+	if err != nil {
+		return types.Client{}, err
+	}
+
+	if cinfo.ID == "" || cinfo.ID != clientID || cinfo.Public() {
+		// Hashes the secret anyway, so unknown clients can't be told apart
+		// by how long it takes to reject them.
+		dummyVerify(secret, a.Algorithm)
+		return types.Client{}, ErrInvalidCredentials
+	}
+
+	hashes, err := a.Store.ClientSecrets(clientID)
+	if err != nil {
+		return types.Client{}, err
+	}
+
+	if !VerifyAny(secret, hashes) {
+		return types.Client{}, ErrInvalidCredentials
+	}
+	return cinfo, nil
+}
+
+var dummyHashes = struct {
+	sync.Mutex
+	hashes map[Algorithm]string
+}{hashes: make(map[Algorithm]string)}
+
+// dummyVerify verifies secret against a throwaway hash produced with alg,
+// taking about as long as verifying a real one. Argon2id is used if alg is
+// empty.
+func dummyVerify(secret string, alg Algorithm) {
+	if alg == "" {
+		alg = Argon2id
+	}
+
+	dummyHashes.Lock()
+	hash, ok := dummyHashes.hashes[alg]
+	if !ok {
+		hash, _ = Hash("", alg)
+		dummyHashes.hashes[alg] = hash
+	}
+	dummyHashes.Unlock()
+
+	Verify(secret, hash)
+}
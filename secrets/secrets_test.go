@@ -0,0 +1,103 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package secrets
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hooklift/oauth2/types"
+)
+
+func TestHashVerify(t *testing.T) {
+	for _, alg := range []Algorithm{Argon2id, Bcrypt, PBKDF2} {
+		hash, err := Hash("s3cr3t", alg)
+		if err != nil {
+			t.Fatalf("%s: %v", alg, err)
+		}
+
+		if strings.Contains(hash, "s3cr3t") {
+			t.Errorf("%s: hash contains the secret: %s", alg, hash)
+		}
+
+		if ok, err := Verify("s3cr3t", hash); err != nil || !ok {
+			t.Errorf("%s: valid secret was rejected: %v", alg, err)
+		}
+
+		if ok, err := Verify("wrong", hash); err != nil || ok {
+			t.Errorf("%s: invalid secret was accepted: %v", alg, err)
+		}
+	}
+
+	if _, err := Hash("s3cr3t", "md5"); err != ErrUnsupportedAlgorithm {
+		t.Errorf("expected %v, got %v", ErrUnsupportedAlgorithm, err)
+	}
+
+	for _, params := range []string{"m=1,t=1,p=1$!!$!!", "m=19456,t=0,p=1$c2FsdA$a2V5", "m=19456,t=2,p=0$c2FsdA$a2V5", "m=4294967295,t=2,p=1$c2FsdA$a2V5", "m=19456,t=4294967295,p=1$c2FsdA$a2V5"} {
+		if _, err := Verify("s3cr3t", "$argon2id$v=19$"+params); err != ErrMalformedHash {
+			t.Errorf("%s: expected %v, got %v", params, ErrMalformedHash, err)
+		}
+	}
+
+	if _, err := Verify("s3cr3t", "$pbkdf2-sha256$i=2147483647$c2FsdA$a2V5"); err != ErrMalformedHash {
+		t.Errorf("expected %v, got %v", ErrMalformedHash, err)
+	}
+}
+
+type testStore struct {
+	secrets []Secret
+}
+
+func (s *testStore) ClientInfo(clientID string) (types.Client, error) {
+	if clientID != "test_client_id" {
+		return types.Client{}, nil
+	}
+	return types.Client{ID: clientID}, nil
+}
+
+func (s *testStore) ClientSecrets(clientID string) ([]Secret, error) {
+	return s.secrets, nil
+}
+
+func TestRotation(t *testing.T) {
+	store := new(testStore)
+	auth := NewAuthenticator(store, PBKDF2)
+
+	old, secret, err := New(PBKDF2, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.secrets = []Secret{secret}
+
+	if _, err := auth.AuthenticateClient("test_client_id", old); err != nil {
+		t.Fatalf("valid secret was rejected: %v", err)
+	}
+
+	current, rotated, err := Rotate(store.secrets, PBKDF2, 0, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.secrets = rotated
+
+	for _, s := range []string{old, current} {
+		if _, err := auth.AuthenticateClient("test_client_id", s); err != nil {
+			t.Errorf("secret should be valid during rotation: %v", err)
+		}
+	}
+
+	store.secrets[0].ExpiresAt = time.Now().Add(-time.Second)
+	if _, err := auth.AuthenticateClient("test_client_id", old); err != ErrInvalidCredentials {
+		t.Errorf("expired secret should be rejected, got %v", err)
+	}
+
+	if _, err := auth.AuthenticateClient("unknown", current); err != ErrInvalidCredentials {
+		t.Errorf("unknown client should be rejected, got %v", err)
+	}
+
+	if !strings.HasPrefix(dummyHashes.hashes[PBKDF2], "$pbkdf2-sha256$") {
+		t.Error("secrets of unknown clients should be hashed with the configured algorithm")
+	}
+}
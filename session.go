@@ -0,0 +1,147 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package oauth2
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hooklift/oauth2/types"
+)
+
+// userSession returns the session of the resource owner making the request.
+// A zero session is returned if the provider does not implement SessionProvider
+// and the built-in login is disabled.
+func userSession(req *http.Request, cfg config) (types.Session, error) {
+	if builtinLogin(cfg) {
+		return cookieSession(req, cfg)
+	}
+
+	sp, ok := cfg.provider.(SessionProvider)
+	if !ok {
+		return types.Session{}, nil
+	}
+	return sp.UserSession(req)
+}
+
+// Values of the OpenID Connect prompt parameter.
+// -- http://openid.net/specs/openid-connect-core-1_0.html#AuthRequest
+var promptValues = map[string]bool{
+	"none":           true,
+	"login":          true,
+	"consent":        true,
+	"select_account": true,
+}
+
+// validPrompt returns whether prompt only has known values and does not
+// combine "none" with any other value.
+func validPrompt(prompt string) bool {
+	values := strings.Fields(prompt)
+	for _, v := range values {
+		if !promptValues[v] {
+			return false
+		}
+	}
+	return !hasPrompt(prompt, "none") || len(values) == 1
+}
+
+// parseMaxAge parses the max_age parameter, returning whether it was sent.
+func parseMaxAge(maxAge string) (time.Duration, bool, error) {
+	if maxAge == "" {
+		return 0, false, nil
+	}
+
+	seconds, err := strconv.ParseUint(maxAge, 10, 32)
+	if err != nil {
+		return 0, false, err
+	}
+	return time.Duration(seconds) * time.Second, true, nil
+}
+
+// authenticationRequired returns whether the resource owner has to
+// authenticate, either because there is no session, because the client asked
+// for it, or because the last authentication is older than max_age.
+func authenticationRequired(authenticated bool, session types.Session, authzData *AuthzData) bool {
+	if !authenticated || hasPrompt(authzData.prompt, "login") || hasPrompt(authzData.prompt, "select_account") {
+		return true
+	}
+
+	if !authzData.maxAgeSet {
+		return false
+	}
+	return session.AuthTime.IsZero() || time.Since(session.AuthTime) > authzData.maxAge
+}
+
+// authTimeUnknown returns whether max_age can't be honored because the
+// resource owner's session does not report when they authenticated. Sending
+// them to log in again would not help, as the authentication time would still
+// be unknown when they came back.
+func authTimeUnknown(authenticated bool, session types.Session, authzData *AuthzData) bool {
+	return authenticated && authzData.maxAgeSet && authzData.maxAge > 0 && session.AuthTime.IsZero()
+}
+
+// resumeURL returns the URL resuming the authorization request once the
+// resource owner authenticated. Parameters forcing re-authentication are
+// removed so the request does not loop once they authenticated again. A
+// positive max_age is kept, so the new authentication time is checked against
+// it, whereas max_age=0 is handled like prompt=login.
+func resumeURL(req *http.Request, authzData *AuthzData, params map[string]string) *url.URL {
+	back := *req.URL
+	query := back.Query()
+	for k, v := range params {
+		if v != "" && query.Get(k) == "" {
+			query.Set(k, v)
+		}
+	}
+
+	var prompt []string
+	for _, v := range strings.Fields(authzData.prompt) {
+		if v != "login" && v != "select_account" {
+			prompt = append(prompt, v)
+		}
+	}
+
+	query.Del("prompt")
+	if len(prompt) > 0 {
+		query.Set("prompt", strings.Join(prompt, " "))
+	}
+	if authzData.maxAgeSet && authzData.maxAge == 0 {
+		query.Del("max_age")
+	}
+	back.RawQuery = query.Encode()
+	return &back
+}
+
+// loginRedirect sends the resource owner to the login URL, forwarding the
+// authentication parameters sent by the client.
+func loginRedirect(w http.ResponseWriter, req *http.Request, cfg config, authzData *AuthzData, params map[string]string) {
+	back := resumeURL(req, authzData, params)
+
+	u := *cfg.loginURL.url
+	loginQuery := u.Query()
+	loginQuery.Set(cfg.loginURL.redirectParam, back.String())
+
+	if authzData.prompt != "" {
+		loginQuery.Set("prompt", authzData.prompt)
+	}
+
+	if authzData.maxAgeSet {
+		loginQuery.Set("max_age", strconv.FormatFloat(authzData.maxAge.Seconds(), 'f', -1, 64))
+	}
+
+	if authzData.LoginHint != "" {
+		loginQuery.Set("login_hint", authzData.LoginHint)
+	}
+
+	if len(authzData.ACRValues) > 0 {
+		loginQuery.Set("acr_values", strings.Join(authzData.ACRValues, " "))
+	}
+	u.RawQuery = loginQuery.Encode()
+
+	http.Redirect(w, req, u.String(), http.StatusFound)
+}
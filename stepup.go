@@ -0,0 +1,134 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package oauth2
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/hooklift/oauth2/types"
+)
+
+// StepUpChallenge describes the authentication the resource owner has to go
+// through before the authorization request can continue, see SetStepUpHandler.
+type StepUpChallenge struct {
+	// Resource owner's current session.
+	Session types.Session
+	// Client requesting authorization.
+	Client types.Client
+	// Authentication context class reference required by the requested scopes.
+	ACR string
+	// Maximum time since the resource owner last authenticated. Ignored if zero.
+	MaxAge time.Duration
+	// URL resuming the authorization request once the resource owner
+	// authenticated.
+	ReturnURL string
+}
+
+// acrLevel returns the position of acr in the configured levels, -1 if unknown.
+func acrLevel(cfg config, acr string) int {
+	for i, l := range cfg.acrLevels {
+		if l == acr {
+			return i
+		}
+	}
+	return -1
+}
+
+// acrSatisfies returns whether an authentication with the given context class
+// reference meets the required one. ACRs missing from the configured levels
+// can't be ranked, so they are only met by an exact match.
+func acrSatisfies(cfg config, acr, required string) bool {
+	if required == "" || acr == required {
+		return true
+	}
+
+	level, requiredLevel := acrLevel(cfg, acr), acrLevel(cfg, required)
+	return level >= 0 && requiredLevel >= 0 && level >= requiredLevel
+}
+
+// requiredAuthentication returns the strongest ACR and the shortest maximum
+// authentication age required by scopes. ACRs missing from the configured
+// levels take precedence over known ones, since they can't be ranked below
+// them.
+func requiredAuthentication(cfg config, scopes types.Scopes) (string, time.Duration) {
+	var acr string
+	var maxAge time.Duration
+	for _, s := range scopes {
+		if s.ACR != "" && (acr == "" || acrStronger(cfg, s.ACR, acr)) {
+			acr = s.ACR
+		}
+
+		if s.MaxAge > 0 && (maxAge == 0 || s.MaxAge < maxAge) {
+			maxAge = s.MaxAge
+		}
+	}
+	return acr, maxAge
+}
+
+// acrStronger returns whether acr has to be preferred over other when
+// challenging the resource owner.
+func acrStronger(cfg config, acr, other string) bool {
+	level, otherLevel := acrLevel(cfg, acr), acrLevel(cfg, other)
+	if otherLevel < 0 {
+		return false
+	}
+	return level < 0 || level > otherLevel
+}
+
+// stepUpRequired returns whether the session falls short of the
+// authentication requirements of scopes, along with those requirements. Every
+// scope's ACR has to be met, so scopes requiring ACRs that can't be ranked
+// against each other are never granted.
+func stepUpRequired(cfg config, session types.Session, scopes types.Scopes) (string, time.Duration, bool) {
+	acr, maxAge := requiredAuthentication(cfg, scopes)
+	for _, s := range scopes {
+		if !acrSatisfies(cfg, session.ACR, s.ACR) {
+			return acr, maxAge, true
+		}
+	}
+
+	if maxAge > 0 && (session.AuthTime.IsZero() || time.Since(session.AuthTime) > maxAge) {
+		return acr, maxAge, true
+	}
+	return acr, maxAge, false
+}
+
+// stepUp asks the resource owner for a stronger or more recent authentication,
+// through the step-up handler if there is one, or else the built-in login form
+// or the login URL.
+func stepUp(w http.ResponseWriter, req *http.Request, cfg config, authzData *AuthzData, params map[string]string, session types.Session, acr string, maxAge time.Duration) {
+	if cfg.stepUp != nil {
+		cfg.stepUp(w, req, StepUpChallenge{
+			Session:   session,
+			Client:    authzData.Client,
+			ACR:       acr,
+			MaxAge:    maxAge,
+			ReturnURL: resumeURL(req, authzData, params).String(),
+		})
+		return
+	}
+
+	if builtinLogin(cfg) {
+		renderLogin(w, req, cfg, authzData, params)
+		return
+	}
+
+	if cfg.loginURL.url == nil {
+		redirectErr(w, req, cfg, authzData.Client, authzData.responseMode, ErrUnmetAuthenticationRequirements(authzData.State))
+		return
+	}
+
+	data := *authzData
+	if acr != "" {
+		data.ACRValues = []string{acr}
+	}
+
+	if maxAge > 0 && (!data.maxAgeSet || maxAge < data.maxAge) {
+		data.maxAge = maxAge
+		data.maxAgeSet = true
+	}
+	loginRedirect(w, req, cfg, &data, params)
+}
@@ -0,0 +1,153 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package oauth2
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hooklift/oauth2/providers/test"
+	"github.com/hooklift/oauth2/types"
+)
+
+// TestStepUpAuthorization tests that resource owners are asked to
+// authenticate with a stronger method when requested scopes require it.
+func TestStepUpAuthorization(t *testing.T) {
+	cfg := setupTest()
+	provider := test.NewProvider(true)
+	provider.ACR = "pwd"
+	provider.AuthTime = time.Now()
+	provider.ScopeACRs = map[string]string{"write": "mfa"}
+	cfg.provider = provider
+	SetACRLevels("pwd", "mfa")(&cfg)
+
+	authzRequest := func(values url.Values) *httptest.ResponseRecorder {
+		query := url.Values{
+			"client_id":     {"test_client_id"},
+			"response_type": {"code"},
+			"redirect_uri":  {"https://example.com/oauth2/callback"},
+			"state":         {"state-test"},
+		}
+		for k, v := range values {
+			query[k] = v
+		}
+
+		req, err := http.NewRequest("GET", "https://example.com/oauth2/authzs?"+query.Encode(), nil)
+		ok(t, err)
+
+		w := httptest.NewRecorder()
+		CreateGrant(w, req, cfg)
+		return w
+	}
+
+	w := authzRequest(url.Values{"scope": {"read"}})
+	equals(t, http.StatusOK, w.Code)
+
+	w = authzRequest(url.Values{"scope": {"read write"}})
+	equals(t, http.StatusFound, w.Code)
+	u, err := url.Parse(w.Header().Get("Location"))
+	ok(t, err)
+	equals(t, "api.hooklift.io", u.Host)
+	equals(t, "mfa", u.Query().Get("acr_values"))
+
+	w = authzRequest(url.Values{"scope": {"read write"}, "prompt": {"none"}})
+	equals(t, http.StatusFound, w.Code)
+	u, err = url.Parse(w.Header().Get("Location"))
+	ok(t, err)
+	equals(t, "login_required", u.Query().Get("error"))
+
+	var challenge StepUpChallenge
+	SetStepUpHandler(func(w http.ResponseWriter, req *http.Request, c StepUpChallenge) {
+		challenge = c
+		w.WriteHeader(http.StatusUnauthorized)
+	})(&cfg)
+
+	w = authzRequest(url.Values{"scope": {"read write"}})
+	equals(t, http.StatusUnauthorized, w.Code)
+	equals(t, "mfa", challenge.ACR)
+	equals(t, "test_user", challenge.Session.Subject)
+	assert(t, strings.Contains(challenge.ReturnURL, "state=state-test"), "unexpected return URL: %s", challenge.ReturnURL)
+
+	provider.ACR = "mfa"
+	w = authzRequest(url.Values{"scope": {"read write"}})
+	equals(t, http.StatusOK, w.Code)
+}
+
+// TestInsufficientUserAuthentication tests that resource servers reject
+// tokens issued after a weaker authentication than required, in accordance
+// with https://tools.ietf.org/html/rfc9470
+func TestInsufficientUserAuthentication(t *testing.T) {
+	provider := test.NewProvider(true)
+	provider.ScopeACRs = map[string]string{"write": "mfa"}
+	scopes := types.Scopes{{ID: "identity"}, {ID: "read"}, {ID: "write"}}
+	provider.AccessTokens["weak"] = types.Token{Value: "weak", Scopes: scopes, ACR: "pwd"}
+	provider.AccessTokens["strong"] = types.Token{Value: "strong", Scopes: scopes, ACR: "hwk"}
+
+	mux := http.NewServeMux()
+	mux.Handle("/protected_resource", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("success!"))
+	}))
+	handler := AuthzHandler(mux, provider, SetACRLevels("pwd", "mfa", "hwk"))
+
+	resourceRequest := func(token string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("GET", "https://example.com/protected_resource", nil)
+		ok(t, err)
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	w := resourceRequest("weak")
+	equals(t, http.StatusUnauthorized, w.Code)
+	challenge := w.Header().Get("WWW-Authenticate")
+	assert(t, strings.Contains(challenge, `error="insufficient_user_authentication"`), "unexpected challenge: %s", challenge)
+	assert(t, strings.Contains(challenge, `acr_values="mfa"`), "unexpected challenge: %s", challenge)
+
+	w = resourceRequest("strong")
+	equals(t, http.StatusOK, w.Code)
+
+	e := ErrInsufficientUserAuthentication("", time.Duration(5)*time.Minute)
+	assert(t, strings.HasSuffix(e.Error(), `,max_age="300"`), "unexpected challenge: %s", e.Error())
+}
+
+// TestUnknownACRs tests that ACRs missing from the configured levels are only
+// met by an exact match and are never ranked below known ones.
+func TestUnknownACRs(t *testing.T) {
+	cfg := setupTest()
+	SetACRLevels("pwd", "mfa")(&cfg)
+
+	assert(t, acrSatisfies(cfg, "mfa", "pwd"), "mfa should satisfy pwd")
+	assert(t, acrSatisfies(cfg, "hwk", "hwk"), "an unknown ACR should satisfy itself")
+	assert(t, !acrSatisfies(cfg, "hwk", "pwd"), "an unknown ACR should not satisfy a known one")
+	assert(t, !acrSatisfies(cfg, "pwd", "hwk"), "a known ACR should not satisfy an unknown one")
+	assert(t, !acrSatisfies(cfg, "mfa", "hwk"), "a known ACR should not satisfy an unknown one")
+	assert(t, !acrSatisfies(cfg, "", "hwk"), "no ACR should not satisfy an unknown one")
+
+	acr, _ := requiredAuthentication(cfg, types.Scopes{{ID: "a", ACR: "hwk"}, {ID: "b", ACR: "pwd"}})
+	equals(t, "hwk", acr)
+	acr, _ = requiredAuthentication(cfg, types.Scopes{{ID: "a", ACR: "pwd"}, {ID: "b", ACR: "hwk"}})
+	equals(t, "hwk", acr)
+
+	// Misconfigured scopes requiring ACRs that can't be ranked against each
+	// other are never met.
+	scopes := types.Scopes{{ID: "a", ACR: "hwk"}, {ID: "b", ACR: "pwd"}}
+	for _, acr := range []string{"pwd", "mfa", "hwk"} {
+		_, _, required := stepUpRequired(cfg, types.Session{ACR: acr, AuthTime: time.Now()}, scopes)
+		assert(t, required, "%s should not satisfy scopes requiring hwk and pwd", acr)
+	}
+
+	_, _, required := stepUpRequired(cfg, types.Session{ACR: "hwk"}, types.Scopes{{ID: "a", ACR: "hwk"}})
+	assert(t, !required, "hwk should satisfy a scope requiring hwk")
+
+	// Without levels, only exact matches satisfy a requirement.
+	cfg.acrLevels = nil
+	assert(t, !acrSatisfies(cfg, "mfa", "pwd"), "mfa should not satisfy pwd without levels")
+}
@@ -0,0 +1,184 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package oauth2
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hooklift/oauth2/tokengen"
+	"github.com/hooklift/oauth2/types"
+)
+
+// TokenStorage is implemented by providers keeping authorization codes and
+// tokens hashed at rest, see SetTokenHashKey. Codes and tokens are generated
+// by this library, which only hands providers their keyed hashes, so a
+// database dump does not leak usable credentials. Hashes are also what
+// GrantInfo, TokenInfo and RevokeToken receive.
+//
+// Hashes have the form "selector.hash". The selector carries no secret, so
+// providers may look codes and tokens up by it alone and let this library
+// compare the hash in constant time.
+type TokenStorage interface {
+	// SaveGrant stores an authorization grant, whose Code is hashed.
+	SaveGrant(grant types.Grant) error
+
+	// SaveToken stores an access token, along with its refresh token if any,
+	// both hashed. grant is the authorization grant the token was issued
+	// from, whose code has to be marked as used if there is one.
+	SaveToken(grant types.Grant, token types.Token) error
+}
+
+// hashedStorage returns whether codes and tokens are hashed at rest.
+func hashedStorage(cfg config) bool {
+	return len(cfg.tokenHashKey) > 0
+}
+
+// storageKey returns the value providers store for a code or token: an
+// HMAC-SHA256 of it keyed with the server secret, preceded by its selector.
+// Values are returned unchanged if hashing is disabled.
+func storageKey(cfg config, value string) string {
+	if !hashedStorage(cfg) || value == "" {
+		return value
+	}
+
+	mac := hmac.New(sha256.New, cfg.tokenHashKey)
+	mac.Write([]byte(value))
+	sum := base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+
+	if i := strings.IndexByte(value, '.'); i > 0 {
+		return value[:i] + "." + sum
+	}
+	return sum
+}
+
+// storedToken returns token as stored by the provider.
+func storedToken(cfg config, token types.Token) types.Token {
+	token.Value = storageKey(cfg, token.Value)
+	token.RefreshToken = storageKey(cfg, token.RefreshToken)
+	return token
+}
+
+// newSecretValue returns a random value in the "selector.verifier" format.
+func newSecretValue(g tokengen.Generator) (string, error) {
+	if g.Selector == 0 {
+		g.Selector = 12
+	}
+	return g.Generate()
+}
+
+// genGrant issues an authorization code, returning the grant with the code to
+// hand to the client.
+func genGrant(cfg config, grant types.Grant, cinfo types.Client, expiration time.Duration) (types.Grant, error) {
+	if sealedCodes(cfg) {
+		return sealGrant(cfg, grant, cinfo, expiration)
+	}
+
+	if !hashedStorage(cfg) {
+		return cfg.provider.GenGrant(grant, cinfo, expiration)
+	}
+
+	code, err := newSecretValue(cfg.generators.code)
+	if err != nil {
+		return grant, err
+	}
+
+	grant.Code = storageKey(cfg, code)
+	grant.ClientID = cinfo.ID
+	grant.RedirectURL = cinfo.RedirectURL
+	grant.ExpiresIn = time.Now().Add(expiration)
+
+	if err := cfg.provider.(TokenStorage).SaveGrant(grant); err != nil {
+		return grant, err
+	}
+
+	grant.Code = code
+	return grant, nil
+}
+
+// genToken issues an access token, and optionally a refresh token, returning
+// them as they have to be handed to the client.
+func genToken(cfg config, grant types.Grant, cinfo types.Client, refreshToken bool, expiration time.Duration) (types.Token, error) {
+	if !hashedStorage(cfg) {
+		return cfg.provider.GenToken(grant, cinfo, refreshToken, expiration)
+	}
+
+	value, err := newSecretValue(cfg.generators.access)
+	if err != nil {
+		return types.Token{}, err
+	}
+
+	token := types.Token{
+		ClientID:  cinfo.ID,
+		Value:     value,
+		Type:      "bearer",
+		ExpiresIn: strconv.FormatFloat(expiration.Seconds(), 'f', -1, 64),
+		Scopes:    grant.Scopes,
+		ACR:       grant.ACR,
+		AuthTime:  grant.AuthTime,
+	}
+
+	if refreshToken {
+		if token.RefreshToken, err = newSecretValue(cfg.generators.refresh); err != nil {
+			return types.Token{}, err
+		}
+	}
+
+	if err := cfg.provider.(TokenStorage).SaveToken(grant, storedToken(cfg, token)); err != nil {
+		return types.Token{}, err
+	}
+	return token, nil
+}
+
+// refreshAccessToken issues new tokens in exchange for the refresh token
+// stored as code.
+func refreshAccessToken(cfg config, code string, refreshToken types.Token, cinfo types.Client, scopes types.Scopes, expiration time.Duration) (types.Token, error) {
+	if !hashedStorage(cfg) {
+		return cfg.provider.RefreshToken(refreshToken, scopes, expiration)
+	}
+
+	if err := cfg.provider.RevokeToken(code); err != nil {
+		return types.Token{}, err
+	}
+
+	return genToken(cfg, types.Grant{
+		Scopes:   scopes,
+		ACR:      refreshToken.ACR,
+		AuthTime: refreshToken.AuthTime,
+	}, cinfo, true, expiration)
+}
+
+// lookupGrant looks up an authorization grant by its stored code, returning a
+// zero grant if the provider found one whose hash does not match.
+func lookupGrant(cfg config, code string) (types.Grant, error) {
+	grant, err := cfg.provider.GrantInfo(code)
+	if err != nil || !hashedStorage(cfg) {
+		return grant, err
+	}
+
+	if !hmac.Equal([]byte(grant.Code), []byte(code)) {
+		return types.Grant{}, nil
+	}
+	return grant, nil
+}
+
+// lookupToken looks up a token by its stored value, returning a zero token if
+// the provider found one whose hash does not match.
+func lookupToken(cfg config, value string) (types.Token, error) {
+	token, err := cfg.provider.TokenInfo(value)
+	if err != nil || !hashedStorage(cfg) {
+		return token, err
+	}
+
+	if !hmac.Equal([]byte(token.Value), []byte(value)) &&
+		!hmac.Equal([]byte(token.RefreshToken), []byte(value)) {
+		return types.Token{}, nil
+	}
+	return token, nil
+}
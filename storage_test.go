@@ -0,0 +1,115 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package oauth2
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hooklift/oauth2/providers/test"
+	"github.com/hooklift/oauth2/types"
+)
+
+// TestHashedStorage tests that providers only get keyed hashes of codes and
+// tokens, while clients use them as usual.
+func TestHashedStorage(t *testing.T) {
+	key := bytes.Repeat([]byte("h"), 32)
+	cfg := setupTest()
+	provider := test.NewProvider(true)
+	cfg.provider = provider
+	SetTokenHashKey(key)(&cfg)
+
+	w := authzPostTest(t, cfg, url.Values{
+		"client_id":     {provider.Client.ID},
+		"response_type": {"code"},
+		"state":         {"state-test"},
+		"redirect_uri":  {provider.Client.RedirectURL.String()},
+		"scope":         {"read write identity"},
+		"decision":      {"approve"},
+	})
+	equals(t, http.StatusFound, w.Code)
+
+	u, err := url.Parse(w.Header().Get("Location"))
+	ok(t, err)
+	code := u.Query().Get("code")
+	assert(t, strings.Count(code, ".") == 1, "code should have the selector.verifier format: %s", code)
+
+	_, found := provider.Grants[code]
+	assert(t, !found, "code should not be stored in plaintext")
+	_, found = provider.Grants[storageKey(cfg, code)]
+	assert(t, found, "hashed code was not stored")
+
+	// Expired codes are rejected even if the provider does not check it.
+	hashed := storageKey(cfg, code)
+	grant := provider.Grants[hashed]
+	expired := grant
+	expired.ExpiresIn = time.Now().Add(-time.Second)
+	provider.Grants[hashed] = expired
+
+	req := AuthzGrantTokenRequestTest(t, "authorization_code", code)
+	req.SetBasicAuth("test_client_id", "test_client_id")
+	w = httptest.NewRecorder()
+	IssueToken(w, req, cfg)
+	equals(t, http.StatusBadRequest, w.Code)
+	assert(t, strings.Contains(w.Body.String(), ErrInvalidGrant.Code), "unexpected response: %s", w.Body.String())
+	provider.Grants[hashed] = grant
+
+	req = AuthzGrantTokenRequestTest(t, "authorization_code", code)
+	req.SetBasicAuth("test_client_id", "test_client_id")
+	w = httptest.NewRecorder()
+	IssueToken(w, req, cfg)
+	equals(t, http.StatusOK, w.Code)
+
+	token := types.Token{}
+	ok(t, json.Unmarshal(w.Body.Bytes(), &token))
+	assert(t, token.Value != "" && token.RefreshToken != "", "tokens were not issued: %s", w.Body.String())
+
+	for _, v := range []string{token.Value, token.RefreshToken} {
+		_, inAccess := provider.AccessTokens[v]
+		_, inRefresh := provider.RefreshTokens[v]
+		assert(t, !inAccess && !inRefresh, "tokens should not be stored in plaintext")
+	}
+	stored := provider.AccessTokens[storageKey(cfg, token.Value)]
+	equals(t, storageKey(cfg, token.RefreshToken), stored.RefreshToken)
+
+	mux := http.NewServeMux()
+	mux.Handle("/protected_resource", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("success!"))
+	}))
+
+	resourceRequest := func(handler http.Handler, token string) int {
+		req, err := http.NewRequest("GET", "https://example.com/protected_resource", nil)
+		ok(t, err)
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	equals(t, http.StatusOK, resourceRequest(AuthzHandler(mux, provider, SetTokenHashKey(key)), token.Value))
+	// A leaked hash can't be used as a token.
+	equals(t, http.StatusUnauthorized, resourceRequest(AuthzHandler(mux, provider, SetTokenHashKey(key)), storageKey(cfg, token.Value)))
+	// Tokens found by selector are rejected if the rest does not match.
+	forged := token.Value[:strings.Index(token.Value, ".")] + ".forged"
+	provider.AccessTokens[storageKey(cfg, forged)] = stored
+	equals(t, http.StatusUnauthorized, resourceRequest(AuthzHandler(mux, provider, SetTokenHashKey(key)), forged))
+
+	w = refreshTokenRequestTest(t, cfg, token.RefreshToken)
+	equals(t, http.StatusOK, w.Code)
+
+	refreshed := types.Token{}
+	ok(t, json.Unmarshal(w.Body.Bytes(), &refreshed))
+	assert(t, refreshed.RefreshToken != token.RefreshToken, "refresh token should have been rotated")
+	_, found = provider.RefreshTokens[storageKey(cfg, token.RefreshToken)]
+	assert(t, !found, "rotated refresh token should have been revoked")
+	equals(t, http.StatusOK, resourceRequest(AuthzHandler(mux, provider, SetTokenHashKey(key)), refreshed.Value))
+}
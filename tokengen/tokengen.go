@@ -0,0 +1,164 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package tokengen generates authorization codes and tokens from a
+// cryptographically secure source. Values can carry a prefix, so secret
+// scanners can find them in code or logs, and a checksum, so leaked values
+// can be recognized offline without a database lookup.
+package tokengen
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"strings"
+)
+
+// Encoding defines how random bytes are turned into text.
+type Encoding int
+
+const (
+	// Base64URL uses the URL and filename safe alphabet, without padding.
+	Base64URL Encoding = iota
+	// Base32 uses the standard alphabet in lowercase, without padding. It is
+	// case-insensitive, which makes values easier to read out or type.
+	Base32
+)
+
+// Minimum number of random bytes, in accordance with
+// http://tools.ietf.org/html/rfc6749#section-10.10 and
+// https://tools.ietf.org/html/rfc6819#section-5.1.4.2.2
+const minEntropy = 16
+
+// Number of random bytes used if Generator.Entropy is zero.
+const defaultEntropy = 32
+
+var (
+	// ErrInsufficientEntropy is returned by generators configured with less
+	// than 128 bits of entropy.
+	ErrInsufficientEntropy = errors.New("tokengen: entropy must be at least 16 bytes")
+	// ErrUnsupportedEncoding is returned by generators configured with an
+	// unknown encoding.
+	ErrUnsupportedEncoding = errors.New("tokengen: unsupported encoding")
+	// ErrInvalidSelector is returned by generators configured with a negative
+	// selector length.
+	ErrInvalidSelector = errors.New("tokengen: selector length can't be negative")
+)
+
+var base32Encoding = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+
+// Generator generates random values.
+type Generator struct {
+	// Prefix prepended to every value, such as "hl_at_".
+	Prefix string
+	// Number of random bytes. Defaults to 32.
+	Entropy int
+	// Encoding of random bytes and checksums.
+	Encoding Encoding
+	// Whether values end with a CRC-32 checksum of the rest of the value.
+	Checksum bool
+	// Number of random bytes used as a selector, separated from the rest of
+	// the value by a dot. Selectors are not secret and let values be looked up
+	// by them, leaving the rest to be compared in constant time. No selector is
+	// added if zero.
+	Selector int
+}
+
+// Generators used for authorization codes, access tokens and refresh tokens.
+var (
+	AuthzCodes    = Generator{Prefix: "hl_ac_", Checksum: true}
+	AccessTokens  = Generator{Prefix: "hl_at_", Checksum: true}
+	RefreshTokens = Generator{Prefix: "hl_rt_", Checksum: true}
+)
+
+func (g Generator) encode(b []byte) (string, error) {
+	switch g.Encoding {
+	case Base64URL:
+		return base64.RawURLEncoding.EncodeToString(b), nil
+	case Base32:
+		return base32Encoding.EncodeToString(b), nil
+	}
+	return "", ErrUnsupportedEncoding
+}
+
+// Generate returns a new random value.
+func (g Generator) Generate() (string, error) {
+	entropy := g.Entropy
+	if entropy == 0 {
+		entropy = defaultEntropy
+	}
+
+	if entropy < minEntropy {
+		return "", ErrInsufficientEntropy
+	}
+
+	if g.Selector < 0 {
+		return "", ErrInvalidSelector
+	}
+
+	b := make([]byte, g.Selector+entropy)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	value := g.Prefix
+	if g.Selector > 0 {
+		selector, err := g.encode(b[:g.Selector])
+		if err != nil {
+			return "", err
+		}
+		value += selector + "."
+	}
+
+	random, err := g.encode(b[g.Selector:])
+	if err != nil {
+		return "", err
+	}
+	value += random
+
+	if g.Checksum {
+		sum, err := g.checksum(value)
+		if err != nil {
+			return "", err
+		}
+		value += sum
+	}
+	return value, nil
+}
+
+func (g Generator) checksum(value string) (string, error) {
+	sum := make([]byte, 4)
+	binary.BigEndian.PutUint32(sum, crc32.ChecksumIEEE([]byte(value)))
+	return g.encode(sum)
+}
+
+// Valid returns whether value looks like it was issued by this generator:
+// it has the generator's prefix and, if enabled, a valid checksum. It does
+// not tell whether the value is still valid, only whether it is worth
+// looking up, such as when scanning for leaked tokens.
+func (g Generator) Valid(value string) bool {
+	if !strings.HasPrefix(value, g.Prefix) {
+		return false
+	}
+
+	if !g.Checksum {
+		return len(value) > len(g.Prefix)
+	}
+
+	sumLen := 6
+	if g.Encoding == Base32 {
+		sumLen = 7
+	}
+
+	if len(value) <= len(g.Prefix)+sumLen {
+		return false
+	}
+
+	body, sum := value[:len(value)-sumLen], value[len(value)-sumLen:]
+	expected, err := g.checksum(body)
+	return err == nil && expected == sum
+}
@@ -0,0 +1,78 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package tokengen
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGenerate(t *testing.T) {
+	generators := []Generator{
+		AccessTokens,
+		{Prefix: "hl_rt_", Encoding: Base32, Checksum: true},
+		{Entropy: 16},
+		{Prefix: "hl_ac_", Checksum: true, Selector: 12},
+	}
+
+	for _, g := range generators {
+		a, err := g.Generate()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		b, err := g.Generate()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if a == b {
+			t.Errorf("generated the same value twice: %s", a)
+		}
+
+		if !strings.HasPrefix(a, g.Prefix) {
+			t.Errorf("value does not have prefix %q: %s", g.Prefix, a)
+		}
+
+		if (g.Selector > 0) != strings.Contains(a, ".") {
+			t.Errorf("unexpected selector in %s", a)
+		}
+
+		if !g.Valid(a) {
+			t.Errorf("generated value is not valid: %s", a)
+		}
+
+		if g.Checksum {
+			tampered := a[:len(a)-8] + strings.Repeat("a", 8)
+			if g.Valid(tampered) {
+				t.Errorf("tampered value should not be valid: %s", tampered)
+			}
+		}
+	}
+
+	if v := mustGenerate(t, Generator{Encoding: Base32}); strings.ToLower(v) != v {
+		t.Errorf("base32 values should be lowercase: %s", v)
+	}
+
+	if _, err := (Generator{Entropy: 8}).Generate(); err != ErrInsufficientEntropy {
+		t.Errorf("expected %v, got %v", ErrInsufficientEntropy, err)
+	}
+
+	if _, err := (Generator{Selector: -1}).Generate(); err != ErrInvalidSelector {
+		t.Errorf("expected %v, got %v", ErrInvalidSelector, err)
+	}
+
+	if AccessTokens.Valid("hl_rt_" + mustGenerate(t, Generator{})) {
+		t.Error("values with another prefix should not be valid")
+	}
+}
+
+func mustGenerate(t *testing.T, g Generator) string {
+	v, err := g.Generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
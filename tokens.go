@@ -9,6 +9,7 @@ import (
 	"net/http"
 	"path"
 	"strings"
+	"time"
 
 	"github.com/hooklift/oauth2/internal/render"
 	"github.com/hooklift/oauth2/types"
@@ -17,16 +18,13 @@ import (
 // TokenHandlers is a map to functions where each function handles a particular HTTP
 // verb or method.
 var TokenHandlers map[string]func(http.ResponseWriter, *http.Request, config) = map[string]func(http.ResponseWriter, *http.Request, config){
-	"POST":   IssueToken,
-	"DELETE": RevokeToken,
+	"POST": IssueToken,
 }
 
 // IssueToken handles all requests going to tokens endpoint.
 func IssueToken(w http.ResponseWriter, req *http.Request, cfg config) {
-	provider := cfg.provider
-	username, password, ok := req.BasicAuth()
-	cinfo, err := provider.AuthenticateClient(username, password)
-	if !ok || err != nil {
+	cinfo, ok := authenticateClient(req, cfg)
+	if !ok {
 		render.JSON(w, render.Options{
 			Status: http.StatusBadRequest,
 			Data:   ErrUnauthorizedClient,
@@ -35,6 +33,30 @@ func IssueToken(w http.ResponseWriter, req *http.Request, cfg config) {
 	}
 
 	grantType := req.FormValue("grant_type")
+	if grantType == "password" && cfg.profile.DisablePassword {
+		render.JSON(w, render.Options{
+			Status: http.StatusBadRequest,
+			Data:   ErrUnsupportedGrantType,
+		})
+		return
+	}
+
+	if (grantType == "client_credentials" || grantType == cibaGrantType) && cinfo.Public() {
+		render.JSON(w, render.Options{
+			Status: http.StatusBadRequest,
+			Data:   ErrPublicClientGrantType,
+		})
+		return
+	}
+
+	if grantType != "" && !allowed(cinfo.GrantTypes, grantType) {
+		render.JSON(w, render.Options{
+			Status: http.StatusBadRequest,
+			Data:   ErrUnauthorizedGrantType,
+		})
+		return
+	}
+
 	switch grantType {
 	case "authorization_code":
 		authCodeGrant2(w, req, cfg, cinfo)
@@ -44,6 +66,8 @@ func IssueToken(w http.ResponseWriter, req *http.Request, cfg config) {
 		resourceOwnerCredentialsGrant(w, req, cfg, cinfo)
 	case "refresh_token":
 		refreshToken(w, req, cfg, cinfo)
+	case cibaGrantType:
+		backchannelGrant(w, req, cfg, cinfo)
 	default:
 		render.JSON(w, render.Options{
 			Status: http.StatusBadRequest,
@@ -58,10 +82,9 @@ func IssueToken(w http.ResponseWriter, req *http.Request, cfg config) {
 // http://tools.ietf.org/html/rfc6749#section-5.2
 //
 // Implementation notes:
-//  * Ignores client_id as we are always requiring the client to authenticate
+//  * Ignores client_id as clients are already identified by authenticateClient
 //  * Ignores redirect_uri as we force a static and pre-registered redirect URI for the client
 func authCodeGrant2(w http.ResponseWriter, req *http.Request, cfg config, cinfo types.Client) {
-	provider := cfg.provider
 	code := req.FormValue("code")
 	if code == "" {
 		err := ErrUnauthorizedClient
@@ -73,7 +96,16 @@ func authCodeGrant2(w http.ResponseWriter, req *http.Request, cfg config, cinfo
 		return
 	}
 
-	grant, err := provider.GrantInfo(code)
+	var grant types.Grant
+	var err error
+	if sealedCodes(cfg) {
+		grant, err = openGrant(cfg, code)
+		code = grant.Code
+	} else {
+		code = storageKey(cfg, code)
+		grant, err = lookupGrant(cfg, code)
+	}
+
 	if err != nil {
 		e := ErrInvalidGrant
 		e.Description = err.Error()
@@ -85,6 +117,20 @@ func authCodeGrant2(w http.ResponseWriter, req *http.Request, cfg config, cinfo
 		return
 	}
 
+	// Expired codes are rejected here rather than trusting the provider to
+	// report them as such, since it only stores what it was given.
+	if grant.Status == "" && !grant.ExpiresIn.IsZero() && !time.Now().Before(grant.ExpiresIn) {
+		grant.Status = types.GrantExpired
+	}
+
+	// If an authorization code is used more than once, the authorization
+	// server MUST deny the request and SHOULD revoke (when possible) all tokens
+	// previously issued based on that authorization code.
+	// -- http://tools.ietf.org/html/rfc6749#section-4.1.2
+	if grant.Status == types.GrantUsed {
+		authzCodeReused(cfg, cinfo, code)
+	}
+
 	if grant.Status == types.GrantRevoked ||
 		grant.Status == types.GrantExpired ||
 		grant.Status == types.GrantUsed {
@@ -122,7 +168,44 @@ func authCodeGrant2(w http.ResponseWriter, req *http.Request, cfg config, cinfo
 		return
 	}
 
-	token, err := provider.GenToken(grant, cinfo, true, cfg.tokenExpiration)
+	// Public clients are required to use PKCE, confidential ones only have to
+	// send a code verifier if they sent a code challenge.
+	// -- https://tools.ietf.org/html/rfc7636#section-4.5
+	if (grant.CodeChallenge != "" || cinfo.Public()) &&
+		!verifyCodeVerifier(grant, req.FormValue("code_verifier")) {
+		render.JSON(w, render.Options{
+			Status: http.StatusBadRequest,
+			Data:   ErrInvalidCodeVerifier,
+		})
+		return
+	}
+
+	// Sealed codes are only marked as redeemed once the client proved it owns
+	// them, otherwise anyone holding a code could burn it.
+	if sealedCodes(cfg) {
+		first, err := redeemSealedGrant(cfg, grant)
+		if err != nil {
+			render.JSON(w, render.Options{
+				Status: http.StatusInternalServerError,
+				Data:   ErrServerError("", err),
+			})
+			return
+		}
+
+		if !first {
+			authzCodeReused(cfg, cinfo, code)
+
+			e := ErrInvalidGrant
+			e.Description = "Grant code was revoked, expired or already used."
+			render.JSON(w, render.Options{
+				Status: http.StatusBadRequest,
+				Data:   e,
+			})
+			return
+		}
+	}
+
+	token, err := genToken(cfg, grant, cinfo, issueRefreshToken(cfg, cinfo), tokenExpiration(cfg, cinfo))
 	if err != nil {
 		render.JSON(w, render.Options{
 			Status: http.StatusInternalServerError,
@@ -130,6 +213,27 @@ func authCodeGrant2(w http.ResponseWriter, req *http.Request, cfg config, cinfo
 		})
 		return
 	}
+	grantedScope(&token, grant.RequestedScopes)
+
+	// http://openid.net/specs/openid-connect-core-1_0.html#TokenResponse
+	if openIDRequest(cfg, grant.Scopes) {
+		session := types.Session{
+			Subject:  grant.Subject,
+			AuthTime: grant.AuthTime,
+			ACR:      grant.ACR,
+		}
+		token.IDToken, err = idToken(cfg, cinfo, session, grant.Nonce, "", token.Value)
+		if err != nil {
+			render.JSON(w, render.Options{
+				Status: http.StatusInternalServerError,
+				Data:   ErrServerError("", err),
+			})
+			return
+		}
+	}
+	stored := storedToken(cfg, token)
+	link(cfg, "", cinfo, code)
+	link(cfg, code, cinfo, stored.Value, stored.RefreshToken)
 
 	render.JSON(w, render.Options{
 		Status: http.StatusOK,
@@ -137,6 +241,22 @@ func authCodeGrant2(w http.ResponseWriter, req *http.Request, cfg config, cinfo
 	})
 }
 
+// authzCodeReused revokes the tokens issued from an authorization code that
+// was presented more than once.
+func authzCodeReused(cfg config, cinfo types.Client, code string) {
+	revoked, err := revokeDerived(cfg, code)
+	if err != nil {
+		log.Printf("[ERROR] Error revoking tokens issued from reused authorization code: %v", err)
+	}
+
+	audit(cfg, types.AuditEvent{
+		Type:          types.EventAuthzCodeReused,
+		ClientID:      cinfo.ID,
+		Description:   "Authorization code was presented more than once, tokens issued from it were revoked.",
+		RevokedTokens: revoked,
+	})
+}
+
 // Implements http://tools.ietf.org/html/rfc6749#section-4.3
 func resourceOwnerCredentialsGrant(w http.ResponseWriter, req *http.Request, cfg config, cinfo types.Client) {
 	provider := cfg.provider
@@ -149,6 +269,10 @@ func resourceOwnerCredentialsGrant(w http.ResponseWriter, req *http.Request, cfg
 	}
 
 	scope := req.FormValue("scope")
+	if scope == "" {
+		scope = cinfo.DefaultScopes.Encode()
+	}
+
 	var scopes types.Scopes
 	if scope != "" {
 		var err error
@@ -162,10 +286,18 @@ func resourceOwnerCredentialsGrant(w http.ResponseWriter, req *http.Request, cfg
 		}
 	}
 
+	if !scopesAllowed(cfg, cinfo, scopes) {
+		render.JSON(w, render.Options{
+			Status: http.StatusBadRequest,
+			Data:   ErrScopeNotAllowed,
+		})
+		return
+	}
+
 	noAuthzGrant := types.Grant{
 		Scopes: scopes,
 	}
-	token, err := provider.GenToken(noAuthzGrant, cinfo, true, cfg.tokenExpiration)
+	token, err := genToken(cfg, noAuthzGrant, cinfo, issueRefreshToken(cfg, cinfo), tokenExpiration(cfg, cinfo))
 	if err != nil {
 		render.JSON(w, render.Options{
 			Status: http.StatusInternalServerError,
@@ -173,6 +305,10 @@ func resourceOwnerCredentialsGrant(w http.ResponseWriter, req *http.Request, cfg
 		})
 		return
 	}
+	grantedScope(&token, requestedScopes(scope))
+	stored := storedToken(cfg, token)
+	link(cfg, "", cinfo, stored.RefreshToken)
+	link(cfg, stored.RefreshToken, cinfo, stored.Value)
 
 	render.JSON(w, render.Options{
 		Status: http.StatusOK,
@@ -184,6 +320,10 @@ func resourceOwnerCredentialsGrant(w http.ResponseWriter, req *http.Request, cfg
 func clientCredentialsGrant(w http.ResponseWriter, req *http.Request, cfg config, cinfo types.Client) {
 	provider := cfg.provider
 	scope := req.FormValue("scope")
+	if scope == "" {
+		scope = cinfo.DefaultScopes.Encode()
+	}
+
 	var scopes types.Scopes
 	if scope != "" {
 		var err error
@@ -197,10 +337,18 @@ func clientCredentialsGrant(w http.ResponseWriter, req *http.Request, cfg config
 		}
 	}
 
+	if !scopesAllowed(cfg, cinfo, scopes) {
+		render.JSON(w, render.Options{
+			Status: http.StatusBadRequest,
+			Data:   ErrScopeNotAllowed,
+		})
+		return
+	}
+
 	noAuthzGrant := types.Grant{
 		Scopes: scopes,
 	}
-	token, err := provider.GenToken(noAuthzGrant, cinfo, false, cfg.tokenExpiration)
+	token, err := genToken(cfg, noAuthzGrant, cinfo, false, tokenExpiration(cfg, cinfo))
 	if err != nil {
 		render.JSON(w, render.Options{
 			Status: http.StatusInternalServerError,
@@ -208,6 +356,7 @@ func clientCredentialsGrant(w http.ResponseWriter, req *http.Request, cfg config
 		})
 		return
 	}
+	grantedScope(&token, requestedScopes(scope))
 
 	render.JSON(w, render.Options{
 		Status: http.StatusOK,
@@ -218,8 +367,22 @@ func clientCredentialsGrant(w http.ResponseWriter, req *http.Request, cfg config
 // Implements http://tools.ietf.org/html/rfc6749#section-6
 func refreshToken(w http.ResponseWriter, req *http.Request, cfg config, cinfo types.Client) {
 	provider := cfg.provider
-	code := req.FormValue("refresh_token")
-	token, err := provider.TokenInfo(code)
+	code := storageKey(cfg, req.FormValue("refresh_token"))
+
+	var record types.LineageRecord
+	if cfg.lineage != nil {
+		var err error
+		record, err = cfg.lineage.Lineage(code)
+		if err != nil {
+			render.JSON(w, render.Options{
+				Status: http.StatusInternalServerError,
+				Data:   ErrServerError("", err),
+			})
+			return
+		}
+	}
+
+	token, err := lookupToken(cfg, code)
 	if err != nil {
 		render.JSON(w, render.Options{
 			Status: http.StatusInternalServerError,
@@ -228,6 +391,52 @@ func refreshToken(w http.ResponseWriter, req *http.Request, cfg config, cinfo ty
 		return
 	}
 
+	// Only the client the refresh token was issued to can use it, or get it
+	// and its token family revoked. Once this holds, cinfo is also the client
+	// whose refresh token lifetimes apply.
+	if !refreshTokenOwner(cinfo, record, token) {
+		e := ErrInvalidGrant
+		e.Description = "Refresh token was not issued to the authenticated client."
+		render.JSON(w, render.Options{
+			Status: http.StatusBadRequest,
+			Data:   e,
+		})
+		return
+	}
+
+	// Refresh tokens are rotated on every use, so presenting one that was
+	// already rotated means it leaked. The whole token family is revoked
+	// unless it happens within the grace window allowed for concurrent requests.
+	// -- https://tools.ietf.org/html/draft-ietf-oauth-security-topics#section-4.14.2
+	if !record.SupersededAt.IsZero() {
+		refreshTokenReused(w, cfg, cinfo, code, record)
+		return
+	}
+
+	if expiredRefreshToken(cfg, cinfo, record) {
+		if err := provider.RevokeToken(code); err != nil {
+			log.Printf("[ERROR] Error revoking expired refresh token: %v", err)
+		}
+
+		e := ErrInvalidGrant
+		e.Description = "Refresh token expired."
+		render.JSON(w, render.Options{
+			Status: http.StatusBadRequest,
+			Data:   e,
+		})
+		return
+	}
+
+	if token.Status == types.TokenExpired || token.Status == types.TokenRevoked {
+		e := ErrInvalidGrant
+		e.Description = "Refresh token expired or was revoked."
+		render.JSON(w, render.Options{
+			Status: http.StatusBadRequest,
+			Data:   e,
+		})
+		return
+	}
+
 	scope := req.FormValue("scope")
 	var scopes types.Scopes
 	if scope != "" {
@@ -244,16 +453,12 @@ func refreshToken(w http.ResponseWriter, req *http.Request, cfg config, cinfo ty
 		// The requested scope MUST NOT include any scope not originally granted
 		// by the resource owner, and if omitted is treated as equal to the scope
 		// originally granted by the resource owner.
-		tscopes := token.Scopes.Encode()
-		for _, s := range scopes {
-			// TODO(c4milo): make more robust
-			if !strings.Contains(tscopes, s.ID) {
-				render.JSON(w, render.Options{
-					Status: http.StatusBadRequest,
-					Data:   ErrInvalidScope,
-				})
-				return
-			}
+		if !cfg.scopeMatcher.Covers(token.Scopes, scopes) {
+			render.JSON(w, render.Options{
+				Status: http.StatusBadRequest,
+				Data:   ErrInvalidScope,
+			})
+			return
 		}
 	}
 
@@ -261,22 +466,68 @@ func refreshToken(w http.ResponseWriter, req *http.Request, cfg config, cinfo ty
 		scopes = token.Scopes
 	}
 
-	if token.ClientID != cinfo.ID {
+	if !scopesAllowed(cfg, cinfo, scopes) {
 		render.JSON(w, render.Options{
 			Status: http.StatusBadRequest,
-			Data:   ErrClientIDMismatch,
+			Data:   ErrScopeNotAllowed,
 		})
 		return
 	}
 
-	newToken, err := provider.RefreshToken(token, scopes)
+	// The refresh token is marked as rotated before issuing new tokens, so
+	// that only one of several concurrent requests presenting it succeeds.
+	if cfg.lineage != nil {
+		var marked bool
+		record, marked, err = markSuperseded(cfg, code, cinfo, record)
+		if err != nil {
+			render.JSON(w, render.Options{
+				Status: http.StatusInternalServerError,
+				Data:   ErrServerError("", err),
+			})
+			return
+		}
+
+		if !marked {
+			if record, err = cfg.lineage.Lineage(code); err != nil {
+				log.Printf("[ERROR] Error getting lineage of refresh token: %v", err)
+			}
+			refreshTokenReused(w, cfg, cinfo, code, record)
+			return
+		}
+	}
+
+	newToken, err := refreshAccessToken(cfg, code, token, cinfo, scopes, tokenExpiration(cfg, cinfo))
 	if err != nil {
+		if cfg.lineage != nil {
+			unmarkSuperseded(cfg, cinfo, record, false)
+		}
+
 		render.JSON(w, render.Options{
 			Status: http.StatusInternalServerError,
 			Data:   ErrServerError("", err),
 		})
 		return
 	}
+	stored := storedToken(cfg, newToken)
+	supersede(cfg, code, cinfo, record, stored)
+
+	// Rotated refresh tokens are revoked in case the provider did not do it,
+	// so they can't be used again once their lineage record is gone.
+	if !hashedStorage(cfg) && stored.RefreshToken != "" && stored.RefreshToken != code {
+		if err := provider.RevokeToken(code); err != nil {
+			log.Printf("[ERROR] Error revoking rotated refresh token: %v", err)
+		}
+	}
+
+	// Refresh tokens the provider did not rotate can't be told apart from
+	// stolen ones if reused, so they are revoked right away.
+	// -- https://tools.ietf.org/html/draft-ietf-oauth-v2-1#section-4.3.1
+	if cfg.profile.RequireRefreshRotation && (stored.RefreshToken == "" || stored.RefreshToken == code) {
+		if err := provider.RevokeToken(code); err != nil {
+			log.Printf("[ERROR] Error revoking refresh token that was not rotated: %v", err)
+		}
+		newToken.RefreshToken = ""
+	}
 
 	render.JSON(w, render.Options{
 		Status: http.StatusOK,
@@ -284,52 +535,77 @@ func refreshToken(w http.ResponseWriter, req *http.Request, cfg config, cinfo ty
 	})
 }
 
-// Implements https://tools.ietf.org/html/rfc7009
-// It does not take into account token_type_hint as the common use case is to
-// have access and refresh tokens uniquely identified throughout the system. That said,
-// unsupported_token_type error responses are not produced by this implementation either.
-func RevokeToken(w http.ResponseWriter, req *http.Request, cfg config) {
-	provider := cfg.provider
-	username, password, ok := req.BasicAuth()
-	cinfo, err := provider.AuthenticateClient(username, password)
-	if !ok || err != nil {
-		// TODO(c4milo): verify other implementations to see if they reply
-		// with 401 instead of 400. Spec is sort of contradictory in this regard.
-		render.JSON(w, render.Options{
-			Status: http.StatusBadRequest,
-			Data:   ErrUnauthorizedClient,
+// refreshTokenReused rejects a refresh token presented after being rotated,
+// revoking its whole token family unless it happens within the grace window
+// allowed for concurrent requests.
+func refreshTokenReused(w http.ResponseWriter, cfg config, cinfo types.Client, code string, record types.LineageRecord) {
+	if time.Since(record.SupersededAt) > cfg.refreshReuseInterval {
+		revoked, err := revokeFamily(cfg, code)
+		if err != nil {
+			log.Printf("[ERROR] Error revoking refresh token family: %v", err)
+		}
+
+		audit(cfg, types.AuditEvent{
+			Type:          types.EventRefreshTokenReused,
+			ClientID:      cinfo.ID,
+			Description:   "Refresh token was presented after being rotated, its token family was revoked.",
+			RevokedTokens: revoked,
 		})
-		return
 	}
 
-	token := path.Base(req.URL.Path)
-	tokenInfo, err := provider.TokenInfo(token)
-	if err != nil {
-		log.Printf("[ERROR] Error getting token info: %+v", err)
-		render.JSON(w, render.Options{
-			Status: http.StatusServiceUnavailable,
-		})
-		return
+	e := ErrInvalidGrant
+	e.Description = "Refresh token was already used."
+	render.JSON(w, render.Options{
+		Status: http.StatusBadRequest,
+		Data:   e,
+	})
+}
+
+// refreshTokenOwner returns whether the refresh token was issued to cinfo,
+// according to both its lineage record and the token itself. Superseded
+// tokens may only be known through their lineage record.
+func refreshTokenOwner(cinfo types.Client, record types.LineageRecord, token types.Token) bool {
+	if record.ClientID == "" && token.ClientID == "" {
+		return false
 	}
 
-	if tokenInfo.ClientID != cinfo.ID {
-		render.JSON(w, render.Options{
-			Status: http.StatusBadRequest,
-			Data:   ErrClientIDMismatch,
-		})
+	return (record.ClientID == "" || record.ClientID == cinfo.ID) &&
+		(token.ClientID == "" || token.ClientID == cinfo.ID)
+}
+
+// grantedScope sets the scope of the token response when it differs from the
+// requested one, in accordance with http://tools.ietf.org/html/rfc6749#section-5.1
+func grantedScope(token *types.Token, requested types.Scopes) {
+	if len(requested) == 0 || token.Scopes.Equal(requested) {
 		return
 	}
+	token.Scope = token.Scopes.Encode()
+}
 
-	err = provider.RevokeToken(token)
-	if err != nil {
-		log.Printf("[ERROR] Error revoking token: %+v", err)
+// requestedScopes returns the scopes sent by the client in the scope parameter.
+func requestedScopes(scope string) types.Scopes {
+	var scopes types.Scopes
+	for _, id := range strings.Fields(scope) {
+		scopes = append(scopes, types.Scope{ID: id})
+	}
+	return scopes
+}
+
+// RevokeToken revokes the token found at the end of the URL path,
+// as in DELETE /oauth2/tokens/{token}. It predates the revocation endpoint
+// and is only enabled through SetTokenDeleteRevocation since it leaks tokens
+// into access logs. Prefer Revoke.
+func RevokeToken(w http.ResponseWriter, req *http.Request, cfg config) {
+	provider := cfg.provider
+	username, password, ok := req.BasicAuth()
+	cinfo, err := provider.AuthenticateClient(username, password)
+	if !ok || err != nil {
 		render.JSON(w, render.Options{
-			Status: http.StatusServiceUnavailable,
+			Status: http.StatusBadRequest,
+			Data:   ErrUnauthorizedClient,
 		})
 		return
 	}
 
-	render.JSON(w, render.Options{
-		Status: http.StatusOK,
-	})
+	revokeToken(w, cfg, cinfo, path.Base(req.URL.Path))
 }
@@ -6,11 +6,15 @@ package oauth2
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/hooklift/oauth2/providers/test"
 	"github.com/hooklift/oauth2/types"
@@ -219,7 +223,7 @@ func TestAuthzCodeOwnership(t *testing.T) {
 	err := json.Unmarshal(w.Body.Bytes(), &authzErr)
 	ok(t, err)
 	equals(t, "invalid_grant", authzErr.Code)
-	equals(t, "Grant code was generated for a different redirect URI.", authzErr.Description)
+	equals(t, "Grant code was generated for a different client ID.", authzErr.Description)
 }
 
 // TestRevokeToken tests happy path for revoking refresh and access tokens.
@@ -247,3 +251,509 @@ func TestRevokeToken(t *testing.T) {
 	RevokeToken(w2, r2, cfg)
 	equals(t, http.StatusOK, w2.Code)
 }
+
+// TestRefreshTokenScope tests that refreshing a token can't widen its scope by
+// matching scope identifiers partially.
+func TestRefreshTokenScope(t *testing.T) {
+	cfg := setupTest()
+	provider := test.NewProvider(true)
+	cfg.provider = provider
+
+	noAuthzGrant := types.Grant{
+		Scopes: types.Scopes{
+			types.Scope{ID: "read:public"},
+		},
+	}
+	accessToken, err := provider.GenToken(noAuthzGrant, types.Client{
+		ID: "test_client_id",
+	}, true, cfg.tokenExpiration)
+	ok(t, err)
+
+	queryStr := url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {accessToken.RefreshToken},
+		"scope":         {"read"},
+	}
+
+	buffer := bytes.NewBufferString(queryStr.Encode())
+	req, err := http.NewRequest("POST", "https://example.com/oauth2/tokens", buffer)
+	ok(t, err)
+	req.Header.Set("Content-type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth("testclient", "testclient")
+
+	w := httptest.NewRecorder()
+	IssueToken(w, req, cfg)
+	equals(t, http.StatusBadRequest, w.Code)
+
+	appErr := types.AuthzError{}
+	err = json.Unmarshal(w.Body.Bytes(), &appErr)
+	ok(t, err)
+	equals(t, "invalid_scope", appErr.Code)
+}
+
+// refreshTokenRequestTest sends a refresh token request, returning the response.
+func refreshTokenRequestTest(t *testing.T, cfg config, refreshToken string) *httptest.ResponseRecorder {
+	queryStr := url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {refreshToken},
+	}
+
+	buffer := bytes.NewBufferString(queryStr.Encode())
+	req, err := http.NewRequest("POST", "https://example.com/oauth2/tokens", buffer)
+	ok(t, err)
+	req.Header.Set("Content-type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth("testclient", "testclient")
+
+	w := httptest.NewRecorder()
+	IssueToken(w, req, cfg)
+	return w
+}
+
+// TestRefreshTokenReuse tests that presenting a rotated refresh token revokes
+// its whole token family.
+func TestRefreshTokenReuse(t *testing.T) {
+	provider, token := getAccessTokenTest(t)
+	cfg := setupTest()
+	cfg.provider = provider
+
+	var events []types.AuditEvent
+	SetAuditLogger(func(e types.AuditEvent) {
+		events = append(events, e)
+	})(&cfg)
+
+	w := refreshTokenRequestTest(t, cfg, token.RefreshToken)
+	equals(t, http.StatusOK, w.Code)
+
+	token2 := types.Token{}
+	err := json.Unmarshal(w.Body.Bytes(), &token2)
+	ok(t, err)
+
+	// Rotated refresh tokens are revoked, so they stay unusable once their
+	// lineage record is gone.
+	_, found := provider.(*test.Provider).RefreshTokens[token.RefreshToken]
+	assert(t, !found, "rotated refresh token should have been revoked")
+
+	// Within the grace window, the token family is left alone.
+	SetRefreshTokenReuseInterval(time.Minute)(&cfg)
+	w = refreshTokenRequestTest(t, cfg, token.RefreshToken)
+	equals(t, http.StatusBadRequest, w.Code)
+	equals(t, 0, len(events))
+
+	SetRefreshTokenReuseInterval(0)(&cfg)
+	w = refreshTokenRequestTest(t, cfg, token.RefreshToken)
+	equals(t, http.StatusBadRequest, w.Code)
+
+	appErr := types.AuthzError{}
+	err = json.Unmarshal(w.Body.Bytes(), &appErr)
+	ok(t, err)
+	equals(t, "invalid_grant", appErr.Code)
+
+	equals(t, 1, len(events))
+	equals(t, types.EventRefreshTokenReused, events[0].Type)
+	equals(t, 2, events[0].RevokedTokens)
+
+	p := provider.(*test.Provider)
+	_, found = p.RefreshTokens[token2.RefreshToken]
+	equals(t, false, found)
+	_, found = p.AccessTokens[token2.Value]
+	equals(t, false, found)
+}
+
+// TestRefreshTokenOtherClient tests that clients can neither use nor revoke
+// refresh tokens issued to other clients.
+func TestRefreshTokenOtherClient(t *testing.T) {
+	provider, token := getAccessTokenTest(t)
+	p := provider.(*test.Provider)
+	cfg := setupTest()
+	cfg.provider = provider
+	SetRefreshTokenLifetime(time.Nanosecond)(&cfg)
+
+	var events []types.AuditEvent
+	SetAuditLogger(func(e types.AuditEvent) {
+		events = append(events, e)
+	})(&cfg)
+
+	otherClientRequest := func(refreshToken string) *httptest.ResponseRecorder {
+		values := url.Values{
+			"grant_type":    {"refresh_token"},
+			"refresh_token": {refreshToken},
+		}
+		req, err := http.NewRequest("POST", "https://example.com/oauth2/tokens", bytes.NewBufferString(values.Encode()))
+		ok(t, err)
+		req.Header.Set("Content-type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth("boo", "boo")
+
+		w := httptest.NewRecorder()
+		IssueToken(w, req, cfg)
+		return w
+	}
+
+	// Refresh token lifetimes of the other client don't apply.
+	w := otherClientRequest(token.RefreshToken)
+	equals(t, http.StatusBadRequest, w.Code)
+	_, found := p.RefreshTokens[token.RefreshToken]
+	assert(t, found, "refresh token should not have been revoked")
+
+	SetRefreshTokenLifetime(0)(&cfg)
+	w = refreshTokenRequestTest(t, cfg, token.RefreshToken)
+	equals(t, http.StatusOK, w.Code)
+
+	token2 := types.Token{}
+	ok(t, json.Unmarshal(w.Body.Bytes(), &token2))
+
+	// Presenting a rotated refresh token of another client does not revoke
+	// its token family.
+	w = otherClientRequest(token.RefreshToken)
+	equals(t, http.StatusBadRequest, w.Code)
+
+	appErr := types.AuthzError{}
+	ok(t, json.Unmarshal(w.Body.Bytes(), &appErr))
+	equals(t, "invalid_grant", appErr.Code)
+	equals(t, 0, len(events))
+
+	_, found = p.RefreshTokens[token2.RefreshToken]
+	assert(t, found, "token family should not have been revoked")
+	_, found = p.AccessTokens[token2.Value]
+	assert(t, found, "token family should not have been revoked")
+}
+
+// TestConcurrentRefreshTokenRotation tests that a refresh token can only be
+// rotated once, even by concurrent requests.
+func TestConcurrentRefreshTokenRotation(t *testing.T) {
+	cfg := setupTest()
+	cinfo := types.Client{ID: "test_client_id"}
+	record := types.LineageRecord{Value: "refresh", ClientID: cinfo.ID, CreatedAt: time.Now()}
+	ok(t, cfg.lineage.SaveLineage(record))
+
+	results := make(chan bool, 10)
+	for i := 0; i < cap(results); i++ {
+		go func() {
+			_, marked, err := markSuperseded(cfg, "refresh", cinfo, record)
+			ok(t, err)
+			results <- marked
+		}()
+	}
+
+	rotations := 0
+	for i := 0; i < cap(results); i++ {
+		if <-results {
+			rotations++
+		}
+	}
+	equals(t, 1, rotations)
+
+	// Refresh tokens the provider did not rotate can be used again.
+	marked, _, err := markSuperseded(cfg, "other", cinfo, types.LineageRecord{})
+	ok(t, err)
+	supersede(cfg, "other", cinfo, marked, types.Token{Value: "access", RefreshToken: "other"})
+	_, again, err := markSuperseded(cfg, "other", cinfo, marked)
+	ok(t, err)
+	assert(t, again, "refresh token that was not rotated should be usable again")
+}
+
+// TestRevokeFamilyFromCode tests that revoking a token family started from an
+// authorization code only revokes and counts its tokens.
+func TestRevokeFamilyFromCode(t *testing.T) {
+	cfg, authzCode := getTestAuthzCode(t)
+	var events []types.AuditEvent
+	SetAuditLogger(func(e types.AuditEvent) {
+		events = append(events, e)
+	})(&cfg)
+
+	req := AuthzGrantTokenRequestTest(t, "authorization_code", authzCode)
+	req.SetBasicAuth("testclient", "testclient")
+	w := httptest.NewRecorder()
+	IssueToken(w, req, cfg)
+	equals(t, http.StatusOK, w.Code)
+
+	token := types.Token{}
+	ok(t, json.Unmarshal(w.Body.Bytes(), &token))
+
+	w = refreshTokenRequestTest(t, cfg, token.RefreshToken)
+	equals(t, http.StatusOK, w.Code)
+	w = refreshTokenRequestTest(t, cfg, token.RefreshToken)
+	equals(t, http.StatusBadRequest, w.Code)
+
+	// Two access tokens and two refresh tokens, not the code.
+	equals(t, 1, len(events))
+	equals(t, 4, events[0].RevokedTokens)
+}
+
+// TestLineagePrune tests that pruned records are no longer listed as derived
+// from their parent.
+func TestLineagePrune(t *testing.T) {
+	store := NewMemoryLineageStore(time.Hour).(*memoryLineage)
+	old := time.Now().Add(-2 * time.Hour)
+	ok(t, store.SaveLineage(types.LineageRecord{Value: "code", CreatedAt: time.Now()}))
+	ok(t, store.SaveLineage(types.LineageRecord{Value: "stale", Parent: "code", CreatedAt: old}))
+	ok(t, store.SaveLineage(types.LineageRecord{Value: "fresh", Parent: "code", CreatedAt: time.Now()}))
+
+	store.lastPrune = old
+	store.prune()
+
+	equals(t, []string{"fresh"}, store.derived["code"])
+	records, err := store.Derived("code")
+	ok(t, err)
+	equals(t, 1, len(records))
+}
+
+// TestRefreshTokenLifetimes tests that refresh tokens are rejected once they
+// exceed their idle timeout or the lifetime of their session.
+func TestRefreshTokenLifetimes(t *testing.T) {
+	cfg, authzCode := getTestAuthzCode(t)
+
+	req := AuthzGrantTokenRequestTest(t, "authorization_code", authzCode)
+	req.SetBasicAuth("testclient", "testclient")
+	w := httptest.NewRecorder()
+	IssueToken(w, req, cfg)
+
+	token := types.Token{}
+	err := json.Unmarshal(w.Body.Bytes(), &token)
+	ok(t, err)
+
+	// Makes the refresh token look like it was issued two hours ago.
+	record, err := cfg.lineage.Lineage(token.RefreshToken)
+	ok(t, err)
+	record.CreatedAt = time.Now().Add(-2 * time.Hour)
+	ok(t, cfg.lineage.SaveLineage(record))
+
+	SetRefreshTokenIdleTimeout(time.Hour)(&cfg)
+	w = refreshTokenRequestTest(t, cfg, token.RefreshToken)
+	equals(t, http.StatusBadRequest, w.Code)
+
+	appErr := types.AuthzError{}
+	err = json.Unmarshal(w.Body.Bytes(), &appErr)
+	ok(t, err)
+	equals(t, "invalid_grant", appErr.Code)
+	equals(t, "Refresh token expired.", appErr.Description)
+
+	// A fresh refresh token is still rejected if its session is too old.
+	cfg, authzCode = getTestAuthzCode(t)
+	req = AuthzGrantTokenRequestTest(t, "authorization_code", authzCode)
+	req.SetBasicAuth("testclient", "testclient")
+	w = httptest.NewRecorder()
+	IssueToken(w, req, cfg)
+
+	err = json.Unmarshal(w.Body.Bytes(), &token)
+	ok(t, err)
+
+	SetRefreshTokenIdleTimeout(time.Hour)(&cfg)
+	SetRefreshTokenLifetime(24 * time.Hour)(&cfg)
+	w = refreshTokenRequestTest(t, cfg, token.RefreshToken)
+	equals(t, http.StatusOK, w.Code)
+	err = json.Unmarshal(w.Body.Bytes(), &token)
+	ok(t, err)
+
+	// Rotated refresh tokens carry when their token family was started.
+	record, err = cfg.lineage.Lineage(token.RefreshToken)
+	ok(t, err)
+	record.IssuedAt = time.Now().Add(-48 * time.Hour)
+	ok(t, cfg.lineage.SaveLineage(record))
+
+	w = refreshTokenRequestTest(t, cfg, token.RefreshToken)
+	equals(t, http.StatusBadRequest, w.Code)
+}
+
+// TestRefreshTokenLifetimeRetention tests that lineage records are kept for
+// as long as refresh token lifetimes require, and that refresh tokens without
+// a record are rejected when lifetimes apply.
+func TestRefreshTokenLifetimeRetention(t *testing.T) {
+	cfg, authzCode := getTestAuthzCode(t)
+	store := NewMemoryLineageStore(time.Hour).(*memoryLineage)
+	SetLineageStore(store)(&cfg)
+	SetRefreshTokenLifetime(7 * 24 * time.Hour)(&cfg)
+
+	req := AuthzGrantTokenRequestTest(t, "authorization_code", authzCode)
+	req.SetBasicAuth("testclient", "testclient")
+	w := httptest.NewRecorder()
+	IssueToken(w, req, cfg)
+	equals(t, http.StatusOK, w.Code)
+
+	token := types.Token{}
+	ok(t, json.Unmarshal(w.Body.Bytes(), &token))
+
+	// Makes the token family older than the store's retention, yet within
+	// the refresh token lifetime.
+	for _, v := range []string{authzCode, token.Value, token.RefreshToken} {
+		record, err := store.Lineage(v)
+		ok(t, err)
+		record.CreatedAt = time.Now().Add(-48 * time.Hour)
+		record.IssuedAt = record.CreatedAt
+		ok(t, store.SaveLineage(record))
+	}
+	store.lastPrune = time.Now().Add(-time.Hour)
+	store.prune()
+
+	record, err := store.Lineage(token.RefreshToken)
+	ok(t, err)
+	equals(t, token.RefreshToken, record.Value)
+
+	w = refreshTokenRequestTest(t, cfg, token.RefreshToken)
+	equals(t, http.StatusOK, w.Code)
+	ok(t, json.Unmarshal(w.Body.Bytes(), &token))
+
+	// The lifetime is still counted from the start of the token family.
+	record, err = store.Lineage(token.RefreshToken)
+	ok(t, err)
+	assert(t, time.Since(record.IssuedAt) > 47*time.Hour, "rotated token should keep its family issue time: %v", record.IssuedAt)
+
+	// Refresh tokens missing from the store can't have their lifetimes
+	// enforced, so they are rejected.
+	SetLineageStore(NewMemoryLineageStore(time.Hour))(&cfg)
+	w = refreshTokenRequestTest(t, cfg, token.RefreshToken)
+	equals(t, http.StatusBadRequest, w.Code)
+}
+
+// TestClientPolicy tests that per-client grant types, scopes and lifetimes
+// are enforced by the token endpoint.
+func TestClientPolicy(t *testing.T) {
+	cfg := setupTest()
+	provider := test.NewProvider(true)
+	provider.Client.GrantTypes = []string{"client_credentials"}
+	provider.Client.Scopes = types.Scopes{{ID: "read"}}
+	provider.Client.DefaultScopes = types.Scopes{{ID: "read"}}
+	provider.Client.AccessTokenLifetime = time.Minute
+	cfg.provider = provider
+
+	tokenRequest := func(values url.Values) *httptest.ResponseRecorder {
+		buffer := bytes.NewBufferString(values.Encode())
+		req, err := http.NewRequest("POST", "https://example.com/oauth2/tokens", buffer)
+		ok(t, err)
+		req.Header.Set("Content-type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth("testclient", "testclient")
+
+		w := httptest.NewRecorder()
+		IssueToken(w, req, cfg)
+		return w
+	}
+
+	w := tokenRequest(url.Values{
+		"grant_type": {"password"},
+		"username":   {"test_user"},
+		"password":   {"test_password"},
+	})
+	equals(t, http.StatusBadRequest, w.Code)
+
+	appErr := types.AuthzError{}
+	err := json.Unmarshal(w.Body.Bytes(), &appErr)
+	ok(t, err)
+	equals(t, "unauthorized_client", appErr.Code)
+
+	// Default scopes are used if the client does not send any.
+	w = tokenRequest(url.Values{"grant_type": {"client_credentials"}})
+	equals(t, http.StatusOK, w.Code)
+
+	token := types.Token{}
+	err = json.Unmarshal(w.Body.Bytes(), &token)
+	ok(t, err)
+	equals(t, "60", token.ExpiresIn)
+	equals(t, "read", provider.AccessTokens[token.Value].Scopes.Encode())
+
+	w = tokenRequest(url.Values{
+		"grant_type": {"client_credentials"},
+		"scope":      {"read write"},
+	})
+	equals(t, http.StatusBadRequest, w.Code)
+
+	appErr = types.AuthzError{}
+	err = json.Unmarshal(w.Body.Bytes(), &appErr)
+	ok(t, err)
+	equals(t, "invalid_scope", appErr.Code)
+}
+
+// TestPublicClientPKCE tests that public clients redeem authorization codes
+// with only their client ID, as long as they use PKCE.
+func TestPublicClientPKCE(t *testing.T) {
+	cfg := setupTest()
+	provider := test.NewProvider(true)
+	provider.Client.Type = types.ClientPublic
+	cfg.provider = provider
+
+	values := url.Values{
+		"client_id":     {provider.Client.ID},
+		"response_type": {"code"},
+		"state":         {"state-test"},
+		"redirect_uri":  {provider.Client.RedirectURL.String()},
+		"scope":         {"read"},
+	}
+
+	req, err := http.NewRequest("GET", "https://example.com/oauth2/authzs?"+values.Encode(), nil)
+	ok(t, err)
+	w := httptest.NewRecorder()
+	CreateGrant(w, req, cfg)
+	equals(t, http.StatusFound, w.Code)
+
+	u, err := url.Parse(w.Header().Get("Location"))
+	ok(t, err)
+	equals(t, "invalid_request", u.Query().Get("error"))
+
+	verifier := "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	sum := sha256.Sum256([]byte(verifier))
+	values.Set("code_challenge", base64.RawURLEncoding.EncodeToString(sum[:]))
+	values.Set("code_challenge_method", "S256")
+	values.Set("decision", "approve")
+
+	w = authzPostTest(t, cfg, values)
+	equals(t, http.StatusFound, w.Code)
+
+	u, err = url.Parse(w.Header().Get("Location"))
+	ok(t, err)
+	code := u.Query().Get("code")
+	assert(t, code != "", "we were expecting an authorization code: %s", u)
+
+	tokenRequest := func(values url.Values) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("POST", "https://example.com/oauth2/tokens", bytes.NewBufferString(values.Encode()))
+		ok(t, err)
+		req.Header.Set("Content-type", "application/x-www-form-urlencoded")
+
+		w := httptest.NewRecorder()
+		IssueToken(w, req, cfg)
+		return w
+	}
+
+	w = tokenRequest(url.Values{
+		"grant_type":    {"authorization_code"},
+		"client_id":     {provider.Client.ID},
+		"code":          {code},
+		"code_verifier": {strings.Repeat("a", 43)},
+	})
+	equals(t, http.StatusBadRequest, w.Code)
+
+	appErr := types.AuthzError{}
+	err = json.Unmarshal(w.Body.Bytes(), &appErr)
+	ok(t, err)
+	equals(t, "invalid_grant", appErr.Code)
+
+	w = tokenRequest(url.Values{
+		"grant_type":    {"authorization_code"},
+		"client_id":     {provider.Client.ID},
+		"code":          {code},
+		"code_verifier": {verifier},
+	})
+	equals(t, http.StatusOK, w.Code)
+
+	token := types.Token{}
+	err = json.Unmarshal(w.Body.Bytes(), &token)
+	ok(t, err)
+	assert(t, token.Value != "", "we were expecting an access token.")
+	equals(t, "", token.RefreshToken)
+
+	w = tokenRequest(url.Values{
+		"grant_type": {"client_credentials"},
+		"client_id":  {provider.Client.ID},
+	})
+	equals(t, http.StatusBadRequest, w.Code)
+
+	appErr = types.AuthzError{}
+	err = json.Unmarshal(w.Body.Bytes(), &appErr)
+	ok(t, err)
+	equals(t, "unauthorized_client", appErr.Code)
+
+	// Confidential clients can't authenticate with just their client ID.
+	provider.Client.Type = types.ClientConfidential
+	w = tokenRequest(url.Values{
+		"grant_type": {"client_credentials"},
+		"client_id":  {provider.Client.ID},
+	})
+	equals(t, http.StatusBadRequest, w.Code)
+}
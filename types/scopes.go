@@ -0,0 +1,178 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package types
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ScopeMatcher decides whether granted scopes cover requested ones. Scope
+// identifiers are made of segments joined by Separator, for example
+// "repo:read". A segment equal to Wildcard matches exactly one segment or, when
+// it is the last segment, one or more trailing segments. So "repo:*" covers
+// "repo:read" and "repo:hooks:write" but not "repo" itself.
+//
+// Implies maps the last segment of a scope to the last segments it implicitly
+// grants. With {"write": {"read"}}, "repo:write" also covers "repo:read".
+// Implications are transitive.
+type ScopeMatcher struct {
+	// Segment separator, defaults to ":".
+	Separator string
+	// Wildcard segment, defaults to "*".
+	Wildcard string
+	// Implications between last segments.
+	Implies map[string][]string
+}
+
+// DefaultScopeMatcher uses ":" as separator, "*" as wildcard and does not
+// define any implications.
+var DefaultScopeMatcher = ScopeMatcher{
+	Separator: ":",
+	Wildcard:  "*",
+}
+
+func (m ScopeMatcher) separator() string {
+	if m.Separator == "" {
+		return ":"
+	}
+	return m.Separator
+}
+
+func (m ScopeMatcher) wildcard() string {
+	if m.Wildcard == "" {
+		return "*"
+	}
+	return m.Wildcard
+}
+
+// Validate checks that scope complies with
+// http://tools.ietf.org/html/rfc6749#section-3.3 and with the segment grammar
+// of this matcher: segments can't be empty and wildcards must be whole segments.
+func (m ScopeMatcher) Validate(scope string) error {
+	if scope == "" {
+		return fmt.Errorf("scope can't be empty")
+	}
+
+	// scope-token = 1*( %x21 / %x23-5B / %x5D-7E )
+	for _, c := range scope {
+		if c < 0x21 || c == 0x22 || c == 0x5C || c > 0x7E {
+			return fmt.Errorf("scope %q contains invalid character %q", scope, c)
+		}
+	}
+
+	wildcard := m.wildcard()
+	for _, segment := range strings.Split(scope, m.separator()) {
+		if segment == "" {
+			return fmt.Errorf("scope %q contains an empty segment", scope)
+		}
+
+		if segment != wildcard && strings.Contains(segment, wildcard) {
+			return fmt.Errorf("scope %q uses a wildcard within a segment", scope)
+		}
+	}
+	return nil
+}
+
+// Parse splits a space-delimited list of scopes, as sent in the scope request
+// parameter, validating each one of them.
+func (m ScopeMatcher) Parse(scopes string) (Scopes, error) {
+	var s Scopes
+	for _, id := range strings.Fields(scopes) {
+		if err := m.Validate(id); err != nil {
+			return nil, err
+		}
+		s = append(s, Scope{ID: id})
+	}
+	return s, nil
+}
+
+// Match returns whether the granted scope covers the requested one.
+func (m ScopeMatcher) Match(granted, requested string) bool {
+	sep := m.separator()
+	r := strings.Split(requested, sep)
+	for _, g := range m.implied(granted) {
+		if m.match(strings.Split(g, sep), r) {
+			return true
+		}
+	}
+	return false
+}
+
+// Covers returns whether every requested scope is covered by at least one of
+// the granted scopes.
+func (m ScopeMatcher) Covers(granted, requested Scopes) bool {
+	for _, r := range requested {
+		covered := false
+		for _, g := range granted {
+			if m.Match(g.ID, r.ID) {
+				covered = true
+				break
+			}
+		}
+
+		if !covered {
+			return false
+		}
+	}
+	return true
+}
+
+func (m ScopeMatcher) match(granted, requested []string) bool {
+	wildcard := m.wildcard()
+	for i, g := range granted {
+		if i >= len(requested) {
+			return false
+		}
+
+		if g == wildcard {
+			if i == len(granted)-1 {
+				return true
+			}
+			continue
+		}
+
+		if g != requested[i] {
+			return false
+		}
+	}
+	return len(granted) == len(requested)
+}
+
+// implied returns scope along with every scope it implicitly grants.
+func (m ScopeMatcher) implied(scope string) []string {
+	scopes := []string{scope}
+	if len(m.Implies) == 0 {
+		return scopes
+	}
+
+	sep := m.separator()
+	prefix, last := "", scope
+	if i := strings.LastIndex(scope, sep); i >= 0 {
+		prefix, last = scope[:i+len(sep)], scope[i+len(sep):]
+	}
+
+	seen := map[string]bool{last: true}
+	pending := []string{last}
+	for len(pending) > 0 {
+		segment := pending[0]
+		pending = pending[1:]
+		for _, s := range m.Implies[segment] {
+			if seen[s] {
+				continue
+			}
+			seen[s] = true
+			pending = append(pending, s)
+			scopes = append(scopes, prefix+s)
+		}
+	}
+	return scopes
+}
+
+// Covers returns whether s covers every requested scope, using
+// DefaultScopeMatcher.
+func (s Scopes) Covers(requested Scopes) bool {
+	return DefaultScopeMatcher.Covers(s, requested)
+}
@@ -0,0 +1,60 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package types
+
+import "testing"
+
+func TestScopeMatcher(t *testing.T) {
+	m := ScopeMatcher{
+		Implies: map[string][]string{
+			"admin": {"write"},
+			"write": {"read"},
+		},
+	}
+
+	tests := []struct {
+		granted   string
+		requested string
+		match     bool
+	}{
+		{"read", "read", true},
+		{"read", "read:admin", false},
+		{"read:admin", "read", false},
+		{"repo:*", "repo:read", true},
+		{"repo:*", "repo:hooks:read", true},
+		{"repo:*", "repo", false},
+		{"repo:*:read", "repo:hooks:read", true},
+		{"repo:*:read", "repo:hooks:write", false},
+		{"repo:write", "repo:read", true},
+		{"repo:read", "repo:write", false},
+		{"repo:admin", "repo:read", true},
+		{"write", "read", true},
+		{"user:write", "repo:read", false},
+	}
+
+	for _, tt := range tests {
+		if got := m.Match(tt.granted, tt.requested); got != tt.match {
+			t.Errorf("Match(%q, %q): expected %t, got %t", tt.granted, tt.requested, tt.match, got)
+		}
+	}
+}
+
+func TestScopeMatcherValidate(t *testing.T) {
+	m := DefaultScopeMatcher
+
+	valid := []string{"read", "repo:read", "repo:*", "https://example.com/scope"}
+	for _, s := range valid {
+		if err := m.Validate(s); err != nil {
+			t.Errorf("%q was expected to be valid: %v", s, err)
+		}
+	}
+
+	invalid := []string{"", "repo:", "re\"po", "repo:re*d", "repo::read"}
+	for _, s := range invalid {
+		if err := m.Validate(s); err == nil {
+			t.Errorf("%q was expected to be invalid", s)
+		}
+	}
+}
@@ -6,11 +6,37 @@
 package types
 
 import (
+	"crypto/rsa"
 	"fmt"
 	"net/url"
 	"time"
 )
 
+// ClientType defines the client types described in
+// http://tools.ietf.org/html/rfc6749#section-2.1
+type ClientType string
+
+const (
+	// Confidential clients are capable of keeping their credentials secret,
+	// such as web applications running on a server.
+	ClientConfidential ClientType = "confidential"
+	// Public clients can't keep credentials secret, such as single-page and
+	// native applications.
+	ClientPublic ClientType = "public"
+)
+
+// SubjectType defines the subject identifier types described in
+// http://openid.net/specs/openid-connect-core-1_0.html#SubjectIDTypes
+type SubjectType string
+
+const (
+	// Public subject identifiers are the same for every client.
+	SubjectPublic SubjectType = "public"
+	// Pairwise subject identifiers are different for each sector, so clients
+	// from different sectors can't correlate resource owners.
+	SubjectPairwise SubjectType = "pairwise"
+)
+
 // Client defines client information required by oauth2 to:
 //   * Show an authorization form to a resource owner
 //   * Validate that the provided request_uri parameter matches the one previously
@@ -18,6 +44,8 @@ import (
 type Client struct {
 	// Client's identifier.
 	ID string
+	// Client's type, clients with no type are considered confidential.
+	Type ClientType
 	// Client's name.
 	Name string
 	// Client's description.
@@ -28,6 +56,101 @@ type Client struct {
 	HomepageURL *url.URL `db:"homepage_url" json:"homepage_url"`
 	// Redirect URL registered for this client.
 	RedirectURL *url.URL `db:"redirect_url" json:"redirect_url"`
+	// URL the resource owner can be sent back to after logging out.
+	PostLogoutRedirectURL *url.URL `db:"post_logout_redirect_url" json:"post_logout_redirect_url"`
+	// URL receiving OpenID Connect back-channel logout tokens.
+	BackChannelLogoutURL *url.URL `db:"backchannel_logout_url" json:"backchannel_logout_url"`
+	// URL rendered in an iframe to log the resource owner out of the client.
+	FrontChannelLogoutURL *url.URL `db:"frontchannel_logout_url" json:"frontchannel_logout_url"`
+	// CIBA token delivery mode, either "poll", "ping" or "push". Defaults to "poll".
+	BackchannelTokenDeliveryMode string `db:"backchannel_token_delivery_mode" json:"backchannel_token_delivery_mode"`
+	// URL receiving CIBA ping and push notifications.
+	BackchannelNotificationURL *url.URL `db:"backchannel_client_notification_endpoint" json:"backchannel_client_notification_endpoint"`
+	// First-party clients are trusted by the authorization server and their
+	// authorization requests are approved without asking the resource owner.
+	FirstParty bool `db:"first_party" json:"first_party"`
+	// Grant types this client is allowed to use at the token endpoint. Every
+	// grant type is allowed if empty.
+	GrantTypes []string `db:"grant_types" json:"grant_types"`
+	// Response types this client is allowed to use at the authorization
+	// endpoint. Every response type is allowed if empty.
+	ResponseTypes []string `db:"response_types" json:"response_types"`
+	// Maximum set of scopes this client can request. Any scope can be
+	// requested if empty.
+	Scopes Scopes
+	// Scopes used when this client does not send any.
+	DefaultScopes Scopes `db:"default_scopes" json:"default_scopes"`
+	// Lifetime of access tokens issued to this client. It overrides the server
+	// default if greater than zero.
+	AccessTokenLifetime time.Duration `db:"access_token_lifetime" json:"access_token_lifetime"`
+	// Lifetime of authorization codes issued to this client. It overrides the
+	// server default if greater than zero.
+	AuthzCodeLifetime time.Duration `db:"authz_code_lifetime" json:"authz_code_lifetime"`
+	// JWS algorithm used to sign JWT-secured authorization responses sent to
+	// this client. Defaults to the algorithm of the first server signing key.
+	AuthzSignedResponseAlg string `db:"authz_signed_response_alg" json:"authorization_signed_response_alg"`
+	// RSA public key used to encrypt JWT-secured authorization responses sent
+	// to this client. Responses are only signed if nil.
+	AuthzEncryptionKey *rsa.PublicKey `db:"-" json:"-"`
+	// Identifier of AuthzEncryptionKey, sent in the "kid" JWE header.
+	AuthzEncryptionKeyID string `db:"authz_encryption_key_id" json:"authz_encryption_key_id"`
+	// Maximum lifetime of the sessions started by this client, refresh tokens
+	// can't be used once it is exceeded. It overrides the server default if
+	// greater than zero.
+	RefreshTokenLifetime time.Duration `db:"refresh_token_lifetime" json:"refresh_token_lifetime"`
+	// Maximum time a refresh token issued to this client can go unused. It
+	// overrides the server default if greater than zero.
+	RefreshTokenIdleTimeout time.Duration `db:"refresh_token_idle_timeout" json:"refresh_token_idle_timeout"`
+	// Type of subject identifiers sent to this client, clients with no type
+	// get public identifiers.
+	SubjectType SubjectType `db:"subject_type" json:"subject_type"`
+	// Host of the sector this client belongs to, clients of the same sector
+	// get the same pairwise identifiers. Defaults to the redirect URL host.
+	SectorIdentifier string `db:"sector_identifier" json:"sector_identifier"`
+}
+
+// Public returns whether the client is unable to keep its credentials secret.
+func (c Client) Public() bool {
+	return c.Type == ClientPublic
+}
+
+// Session represents the resource owner's session with the authorization server.
+type Session struct {
+	// Resource owner's identifier.
+	Subject string
+	// When the resource owner last authenticated.
+	AuthTime time.Time `db:"auth_time" json:"auth_time"`
+	// Authentication context class reference satisfied by the authentication.
+	ACR string
+	// Identifier of the session, sent in the sid claim of back-channel
+	// logout tokens if not empty.
+	SessionID string `db:"session_id" json:"session_id"`
+}
+
+// Consent represents the scopes a resource owner has already approved for
+// a given client.
+type Consent struct {
+	// Resource owner's identifier.
+	Subject string
+	// Client's identifier.
+	ClientID string `db:"client_id" json:"client_id"`
+	// Approved scopes.
+	Scopes Scopes
+	// Expiration time for this consent, a zero value means it does not expire.
+	ExpiresAt time.Time `db:"expires_at" json:"expires_at"`
+}
+
+// AuthorizedClient describes a client authorized by a resource owner to
+// access her resources.
+type AuthorizedClient struct {
+	// Authorized client.
+	Client Client
+	// Scopes granted to the client.
+	Scopes Scopes
+	// When the resource owner first authorized the client.
+	AuthorizedAt time.Time `db:"authorized_at" json:"authorized_at"`
+	// Last time the client used one of its tokens.
+	LastUsedAt time.Time `db:"last_used_at" json:"last_used_at"`
 }
 
 // Scope defines a type for manipulating OAuth2 scopes.
@@ -36,6 +159,12 @@ type Scope struct {
 	ID string
 	// Scope's description
 	Description string
+	// Authentication context class reference the resource owner must have
+	// satisfied for this scope to be granted or used, empty if any will do.
+	ACR string
+	// Maximum time since the resource owner last authenticated for this scope
+	// to be granted or used. Ignored if zero.
+	MaxAge time.Duration `db:"max_age" json:"max_age"`
 }
 
 // Defines a type commonly used for manipulating a group of Scopes.
@@ -53,6 +182,24 @@ func (s Scopes) Encode() string {
 	return scope[:len(scope)-1] // removes last space
 }
 
+// Equal returns whether s and o contain the same scope identifiers, regardless
+// of their order.
+func (s Scopes) Equal(o Scopes) bool {
+	ids := make(map[string]bool)
+	for _, v := range s {
+		ids[v.ID] = true
+	}
+
+	oids := make(map[string]bool)
+	for _, v := range o {
+		if !ids[v.ID] {
+			return false
+		}
+		oids[v.ID] = true
+	}
+	return len(ids) == len(oids)
+}
+
 // GrantStatus defines a type for possible statuses of an authorization grant.
 type GrantStatus string
 
@@ -74,6 +221,22 @@ type Grant struct {
 	RedirectURL *url.URL `db:"redirect_url" json:"redirect_url"`
 	// List of authorization scopes for which this authorization code was generated.
 	Scopes Scopes
+	// List of scopes originally requested by the client. It may differ from
+	// Scopes if the resource owner only approved some of them.
+	RequestedScopes Scopes `db:"requested_scopes" json:"requested_scopes,omitempty"`
+	// PKCE code challenge sent along with the authorization request, as
+	// described in https://tools.ietf.org/html/rfc7636#section-4.3
+	CodeChallenge string `db:"code_challenge" json:"code_challenge,omitempty"`
+	// Method used to derive CodeChallenge, either "plain" or "S256".
+	CodeChallengeMethod string `db:"code_challenge_method" json:"code_challenge_method,omitempty"`
+	// Identifier of the resource owner who authorized the grant.
+	Subject string
+	// OpenID Connect nonce to include in the ID token issued for this grant.
+	Nonce string
+	// When the resource owner authenticated, as reported by its session.
+	AuthTime time.Time `db:"auth_time" json:"auth_time"`
+	// Authentication context class reference satisfied by the resource owner.
+	ACR string
 	// The status of this authorization grant code
 	Status GrantStatus `json:"-"`
 }
@@ -100,15 +263,118 @@ type Token struct {
 	RefreshToken string `db:"refresh_token" json:"refresh_token,omitempty"`
 	// Authorization scope allowed for this token
 	Scopes Scopes `json:"-"`
+	// Granted scope, only sent back to the client when it differs from the
+	// requested one. http://tools.ietf.org/html/rfc6749#section-5.1
+	Scope string `db:"-" json:"scope,omitempty"`
+	// OpenID Connect ID token issued along with the access token.
+	IDToken string `db:"-" json:"id_token,omitempty"`
+	// Authentication context class reference satisfied by the resource owner
+	// when authorizing this token, copied from the grant.
+	ACR string `db:"acr" json:"-"`
+	// When the resource owner authenticated, copied from the grant.
+	AuthTime time.Time `db:"auth_time" json:"-"`
 	// The status of this token
 	Status TokenStatus `json:"-"`
 }
 
+// LineageRecord links an authorization code or token to the code or token it
+// was derived from, so that everything issued from a compromised credential
+// can be found and revoked.
+type LineageRecord struct {
+	// Authorization code or token value.
+	Value string
+	// Authorization code or token this one was derived from, empty for roots.
+	Parent string
+	// Client's identifier to which the code or token was issued to.
+	ClientID string `db:"client_id" json:"client_id"`
+	// When the code or token was issued.
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+	// When the token family the code or token belongs to was started,
+	// refresh token lifetimes are counted from it.
+	IssuedAt time.Time `db:"issued_at" json:"issued_at"`
+	// Time until which the record has to be kept, as refresh token lifetimes
+	// may be enforced until then. Zero if only the store's retention applies.
+	RetainUntil time.Time `db:"retain_until" json:"retain_until"`
+	// When the refresh token was rotated, zero if it is still current.
+	SupersededAt time.Time `db:"superseded_at" json:"superseded_at"`
+	// Last time the refresh token was used without being rotated.
+	LastUsedAt time.Time `db:"last_used_at" json:"last_used_at"`
+}
+
+// AuditEventType defines a type for security relevant events.
+type AuditEventType string
+
+const (
+	// An authorization code was presented more than once.
+	EventAuthzCodeReused AuditEventType = "authorization_code_reused"
+	// A refresh token was presented after being rotated.
+	EventRefreshTokenReused AuditEventType = "refresh_token_reused"
+)
+
+// AuditEvent describes a security relevant event, along with the action taken
+// by the authorization server.
+type AuditEvent struct {
+	Type AuditEventType
+	Time time.Time
+	// Client's identifier involved in the event.
+	ClientID string `db:"client_id" json:"client_id"`
+	// Human readable description of the event.
+	Description string
+	// Number of tokens revoked as a consequence of the event.
+	RevokedTokens int `db:"revoked_tokens" json:"revoked_tokens"`
+}
+
+// BackchannelStatus defines a type for possible statuses of a backchannel
+// authentication request.
+type BackchannelStatus string
+
+const (
+	BackchannelPending  BackchannelStatus = "pending"
+	BackchannelApproved BackchannelStatus = "approved"
+	BackchannelDenied   BackchannelStatus = "denied"
+)
+
+// BackchannelRequest represents an OpenID Connect Client Initiated Backchannel
+// Authentication request, waiting for the resource owner to approve it on
+// their authentication device.
+type BackchannelRequest struct {
+	// Authentication request identifier, sent to the client as auth_req_id.
+	ID string `db:"id" json:"auth_req_id"`
+	// Client's identifier that started the request.
+	ClientID string `db:"client_id" json:"client_id"`
+	// Resource owner's identifier, as resolved from the login hint.
+	Subject string `db:"subject" json:"subject"`
+	// Requested scopes.
+	Scopes Scopes `db:"scopes" json:"scopes"`
+	// Message to display on both the consumption and authentication devices.
+	BindingMessage string `db:"binding_message" json:"binding_message"`
+	// Bearer token the client expects when receiving ping and push
+	// notifications.
+	ClientNotificationToken string `db:"client_notification_token" json:"-"`
+	// Token delivery mode, either "poll", "ping" or "push".
+	DeliveryMode string `db:"delivery_mode" json:"delivery_mode"`
+	// Minimum time the client must wait between token requests.
+	Interval time.Duration `db:"interval" json:"interval"`
+	// Expiration time for this request.
+	ExpiresAt time.Time `db:"expires_at" json:"expires_at"`
+	// Last time the client polled the token endpoint.
+	LastPolledAt time.Time `db:"last_polled_at" json:"last_polled_at"`
+	// When the resource owner approved the request.
+	AuthTime time.Time `db:"auth_time" json:"auth_time"`
+	// The status of this request.
+	Status BackchannelStatus `db:"status" json:"status"`
+}
+
 type AuthzError struct {
 	Code        string `json:"error"`
 	Description string `json:"error_description"`
 	URI         string `json:"error_uri,omitempty"`
 	State       string `json:"state,omitempty"`
+	// Authentication context class references and maximum authentication age,
+	// in seconds, required to access the resource.
+	// -- https://tools.ietf.org/html/rfc9470#section-3
+	ACRValues string `json:"-"`
+	MaxAge    string `json:"-"`
 }
 
 func (a *AuthzError) Error() string {
@@ -120,5 +386,13 @@ func (a *AuthzError) Error() string {
 	if a.URI != "" {
 		str += fmt.Sprintf(`,error_uri="%s"`, a.URI)
 	}
+
+	if a.ACRValues != "" {
+		str += fmt.Sprintf(`,acr_values="%s"`, a.ACRValues)
+	}
+
+	if a.MaxAge != "" {
+		str += fmt.Sprintf(`,max_age="%s"`, a.MaxAge)
+	}
 	return str
 }